@@ -5,11 +5,13 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/rsb/failure"
+	data "github.com/rsb/prolog/app/api/handlers/v1"
 	"github.com/rsb/prolog/business"
+	"github.com/rsb/prolog/business/data/server"
 )
 
 type Handler struct {
-	log *business.Log
+	log server.CommitLog
 }
 
 type Request struct {
@@ -20,9 +22,9 @@ type Response struct {
 	Record *business.Record `json:"record"`
 }
 
-func NewHandler(l *business.Log) (*Handler, error) {
+func NewHandler(l server.CommitLog) (*Handler, error) {
 	if l == nil {
-		return nil, failure.InvalidParam("[l] business.Log is nil")
+		return nil, failure.InvalidParam("[l] server.CommitLog is nil")
 	}
 
 	return &Handler{log: l}, nil
@@ -39,6 +41,22 @@ func (h *Handler) Consume(c *fiber.Ctx) error {
 		return failure.ToSystem(err, "h.log.Read failed")
 	}
 
-	resp := Response{Record: &rec}
+	resp := Response{Record: fromRecord(rec)}
 	return c.Status(http.StatusOK).JSON(&resp)
 }
+
+// fromRecord converts a record read from the log into the one sent over http
+func fromRecord(r *data.Record) *business.Record {
+	rec := business.Record{
+		Value:             r.Value,
+		Offset:            r.Offset,
+		Key:               r.Key,
+		ProducerTimestamp: r.ProducerTimestamp,
+	}
+
+	for _, h := range r.Headers {
+		rec.Headers = append(rec.Headers, business.Header{Key: h.Key, Value: h.Value})
+	}
+
+	return &rec
+}
@@ -7,7 +7,9 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/rsb/failure"
+	data "github.com/rsb/prolog/app/api/handlers/v1"
 	"github.com/rsb/prolog/business"
+	"github.com/rsb/prolog/business/data/server"
 )
 
 type Request struct {
@@ -19,12 +21,12 @@ type Response struct {
 }
 
 type Handler struct {
-	log *business.Log
+	log server.CommitLog
 }
 
-func NewHandler(l *business.Log) (*Handler, error) {
+func NewHandler(l server.CommitLog) (*Handler, error) {
 	if l == nil {
-		return nil, failure.InvalidParam("[l] business.Log is nil")
+		return nil, failure.InvalidParam("[l] server.CommitLog is nil")
 	}
 
 	return &Handler{log: l}, nil
@@ -37,7 +39,7 @@ func (h *Handler) Produce(c *fiber.Ctx) error {
 		return failure.ToBadRequest(err, "invalid request")
 	}
 	fmt.Printf("%+v\n", req.Record)
-	off, err := h.log.Append(req.Record)
+	off, err := h.log.Append(toRecord(req.Record))
 	if err != nil {
 		return failure.ToSystem(err, "h.log.Append failed")
 	}
@@ -45,3 +47,18 @@ func (h *Handler) Produce(c *fiber.Ctx) error {
 	resp := Response{Offset: off}
 	return c.Status(http.StatusOK).JSON(&resp)
 }
+
+// toRecord converts the record sent over http into the one the log stores
+func toRecord(r business.Record) *data.Record {
+	rec := data.Record{
+		Value:             r.Value,
+		Key:               r.Key,
+		ProducerTimestamp: r.ProducerTimestamp,
+	}
+
+	for _, h := range r.Headers {
+		rec.Headers = append(rec.Headers, &data.Header{Key: h.Key, Value: h.Value})
+	}
+
+	return &rec
+}
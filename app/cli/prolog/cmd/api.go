@@ -5,6 +5,7 @@ import (
 	"expvar"
 	"github.com/rsb/prolog/conf"
 	construct2 "github.com/rsb/prolog/construct"
+	"net"
 	"os"
 	"os/signal"
 	"runtime"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/rsb/failure"
 	"github.com/rsb/prolog/app"
+	"github.com/rsb/prolog/business/data/server"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.uber.org/automaxprocs/maxprocs"
@@ -27,7 +29,7 @@ var apiCmd = &cobra.Command{
 	Use:   "api",
 	Short: "controls the prolog service",
 	Long: `prolog api can be started and stopped using
-serve - start the services server
+serve - start the http and grpc servers
 stop  - shutdown the services server
 `,
 }
@@ -97,15 +99,50 @@ func runAPI(config conf.PrologAPI, log *zap.SugaredLogger) error {
 		}
 	}()
 
+	// both transports share one log so records produced over one of them
+	// can be consumed over the other
+	commitLog, err := construct2.NewCommitLog(config.CommitLog, config.LogSettings, log)
+	if err != nil {
+		return failure.Wrap(err, "construct.NewCommitLog failed")
+	}
+	defer func() { _ = commitLog.Close() }()
+
 	apiMux := construct2.NewAPIMux(depend, config.API)
-	apiMux, err = construct2.AddAllRoutes(apiMux, &depend)
+	apiMux, err = construct2.AddAllRoutes(apiMux, &depend, commitLog)
 	if err != nil {
 		return failure.Wrap(err, "construct.AddAllRoutes failed")
 	}
 
-	// Make a channel to listen for errors coming from the listener. Use a
-	// buffered channel so the goroutine can exit if we don't collect this error.
-	serverErrors := make(chan error, 1)
+	// topics and committed offsets live next to the commit log unless they
+	// get a directory of their own, without one for the commit log there
+	// are no topics and the offsets are kept in memory
+	b, err := construct2.NewBroker(config.Topics, config.CommitLog, config.LogSettings, log)
+	if err != nil {
+		return failure.Wrap(err, "construct.NewBroker failed")
+	}
+	if b != nil {
+		defer func() { _ = b.Close() }()
+	}
+
+	groups, err := construct2.NewGroups(config.Groups, config.CommitLog, log)
+	if err != nil {
+		return failure.Wrap(err, "construct.NewGroups failed")
+	}
+	defer func() { _ = groups.Close() }()
+
+	grpcServer, err := server.NewGRPCServer(&server.Config{CommitLog: commitLog, Broker: b, Groups: groups})
+	if err != nil {
+		return failure.Wrap(err, "server.NewGRPCServer failed")
+	}
+
+	grpcListener, err := net.Listen("tcp", config.API.GRPCHost)
+	if err != nil {
+		return failure.ToSystem(err, "net.Listen failed (%s)", config.API.GRPCHost)
+	}
+
+	// Make a channel to listen for errors coming from the listeners. Use a
+	// buffered channel so the goroutines can exit if we don't collect their errors.
+	serverErrors := make(chan error, 2)
 
 	// Start the service listening for api requests
 	go func() {
@@ -113,7 +150,17 @@ func runAPI(config conf.PrologAPI, log *zap.SugaredLogger) error {
 			"status", "api router started",
 			"host", config.API.Host,
 		)
-		if err = apiMux.Listen(config.API.Host); err != nil {
+		if err := apiMux.Listen(config.API.Host); err != nil {
+			serverErrors <- err
+		}
+	}()
+
+	go func() {
+		log.Infow("startup",
+			"status", "grpc server started",
+			"host", config.API.GRPCHost,
+		)
+		if err := grpcServer.Serve(grpcListener); err != nil {
 			serverErrors <- err
 		}
 	}()
@@ -127,9 +174,23 @@ func runAPI(config conf.PrologAPI, log *zap.SugaredLogger) error {
 		log.Infow("shutdown", "status", "shutdown started", "signal", sig)
 
 		// Give outstanding requests a deadline for completion
-		_, cancel := context.WithTimeout(ctx, config.API.ShutdownTimeout)
+		ctx, cancel := context.WithTimeout(ctx, config.API.ShutdownTimeout)
 		defer cancel()
 
+		// consume streams never end on their own, they are cut off once the
+		// deadline passes
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			grpcServer.Stop()
+		}
+
 		// Asking listener to shut down and shed load
 		if sErr := apiMux.Shutdown(); sErr != nil {
 			return failure.Wrap(sErr, "could not stop server gracefully")
@@ -145,6 +206,12 @@ func logConfig(log *zap.SugaredLogger, cat string, c conf.PrologAPI) {
 		"version", c.Version.Build,
 		"host", api.Host,
 		"debug-host", api.DebugHost,
+		"grpc-host", api.GRPCHost,
+		"log-dir", c.CommitLog.Dir,
+		"tier-store", c.Tier.Store,
+		"topics-dir", c.Topics.Dir,
+		"group-dir", c.Groups.Dir,
+		"group-session-timeout", c.Groups.SessionTimeout,
 		"read-timeout", api.ReadTimeout,
 		"write-timeout", api.WriteTimeout,
 		"idle-timeout", api.IdleTimeout,
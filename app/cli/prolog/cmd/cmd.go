@@ -51,12 +51,20 @@ func init() {
 	viper.SetEnvPrefix(strings.ToUpper(app.ServiceName))
 
 	rootCmd.AddCommand(apiCmd)
+	rootCmd.AddCommand(logCmd)
 	// rootCmd.AddCommand(logFmtCmd)
 	// rootCmd.AddCommand(auth0Cmd)
 
 	// api sub commands
 	apiCmd.AddCommand(serveCmd)
 
+	// log sub commands
+	logCmd.AddCommand(verifyCmd)
+	logCmd.AddCommand(repairCmd)
+	logCmd.AddCommand(snapshotCmd)
+	logCmd.AddCommand(restoreCmd)
+	logCmd.AddCommand(migrateCmd)
+
 	//
 	// // auth0 sub commands
 	// auth0Cmd.AddCommand(genKeyCmd)
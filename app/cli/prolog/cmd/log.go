@@ -0,0 +1,250 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rsb/failure"
+	commitlog "github.com/rsb/prolog/business/data/log"
+	"github.com/rsb/prolog/conf"
+	"github.com/rsb/prolog/construct"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	var c conf.PrologLog
+	bindCLI(logCmd, viper.GetViper(), &c)
+}
+
+var logCmd = &cobra.Command{
+	Use:   "log",
+	Short: "manages a commit log directory without starting a server",
+	Long: `prolog log works directly on the files of a commit log. The server
+using the directory must not be running, every command except verify fails
+while the log is locked by it.
+verify - report inconsistencies between segment indexes and stores
+repair - truncate to the last good record and rebuild the indexes
+snapshot - archive the log to a file
+restore - recreate a log from a snapshot archive
+migrate - upgrade segment files to the current format version
+`,
+}
+
+// verifyCmd represents the log verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "checks every segment of a commit log for corruption",
+	Long: `verify walks every segment's index and store and reports offset gaps,
+index entries pointing past the end of the store, undecodable records and
+stray files. Nothing on disk is changed.`,
+	SilenceUsage: true,
+	RunE:         verifyLog,
+}
+
+// repairCmd represents the log repair command
+var repairCmd = &cobra.Command{
+	Use:   "repair",
+	Short: "truncates a commit log to its last good records",
+	Long: `repair truncates every segment to its last good record and rebuilds
+its index from the store, then prints a summary of what it changed.`,
+	SilenceUsage: true,
+	RunE:         repairLog,
+}
+
+// snapshotCmd represents the log snapshot command
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot <archive>",
+	Short: "archives a commit log to a file",
+	Long: `snapshot writes every segment store of the commit log up to its current
+high-water mark to a tar archive, followed by a manifest with their offsets
+and checksums. Segments offloaded to a remote tier are not archived.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         snapshotLog,
+}
+
+// restoreCmd represents the log restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore <archive>",
+	Short: "recreates a commit log from a snapshot archive",
+	Long: `restore extracts a snapshot archive into the storage directory, which must
+not hold a log yet, and checks every store against the manifest. Indexes are
+rebuilt the first time the restored log is opened.`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true,
+	RunE:         restoreLog,
+}
+
+// migrateCmd represents the log migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "upgrades the files of a commit log to the current format version",
+	Long: `migrate rewrites every segment written in an older format version with the
+header and frames of the current one and rebuilds its indexes. Segments that
+are already current are left alone. Logs written before records carried
+checksums must be migrated before they can be opened. When a segment can not
+be read to its end nothing is changed unless --force is given, and the bytes
+that are, or would be, dropped are printed either way.`,
+	SilenceUsage: true,
+	RunE:         migrateLog,
+}
+
+func verifyLog(cmd *cobra.Command, _ []string) error {
+	var c conf.PrologLog
+	if err := processConfigCLI(viper.GetViper(), &c); err != nil {
+		return failure.Wrap(err, "processConfigCLI failed")
+	}
+
+	lc, err := construct.NewLogConfig(c.Storage.LogSettings)
+	if err != nil {
+		return failure.Wrap(err, "construct.NewLogConfig failed")
+	}
+
+	report, err := commitlog.Verify(c.Storage.Dir, lc)
+	if err != nil {
+		return failure.Wrap(err, "commitlog.Verify failed (%s)", c.Storage.Dir)
+	}
+
+	out := cmd.OutOrStdout()
+	for _, seg := range report.Segments {
+		_, _ = fmt.Fprintf(out, "segment %d: offsets [%d, %d) version=%d records=%d index-entries=%d store-bytes=%d\n",
+			seg.BaseOffset, seg.BaseOffset, seg.NextOffset, seg.Version, seg.Records, seg.IndexEntries, seg.StoreBytes)
+	}
+
+	for _, p := range report.Problems {
+		_, _ = fmt.Fprintln(out, p.String())
+	}
+
+	if !report.OK() {
+		return failure.Validation("found (%d) problems in (%s)", len(report.Problems), report.Dir)
+	}
+
+	_, _ = fmt.Fprintf(out, "%s: %d segments ok\n", report.Dir, len(report.Segments))
+	return nil
+}
+
+func repairLog(cmd *cobra.Command, _ []string) error {
+	var c conf.PrologLog
+	if err := processConfigCLI(viper.GetViper(), &c); err != nil {
+		return failure.Wrap(err, "processConfigCLI failed")
+	}
+
+	lc, err := construct.NewLogConfig(c.Storage.LogSettings)
+	if err != nil {
+		return failure.Wrap(err, "construct.NewLogConfig failed")
+	}
+
+	report, err := commitlog.Repair(c.Storage.Dir, lc)
+	if err != nil {
+		return failure.Wrap(err, "commitlog.Repair failed (%s)", c.Storage.Dir)
+	}
+
+	out := cmd.OutOrStdout()
+	var changed int
+	for _, seg := range report.Segments {
+		status := "index rebuilt"
+		if seg.TruncatedBytes > 0 {
+			status = fmt.Sprintf("index rebuilt, truncated %d bytes", seg.TruncatedBytes)
+			changed++
+		}
+		_, _ = fmt.Fprintf(out, "segment %d: offsets [%d, %d) %s\n",
+			seg.BaseOffset, seg.BaseOffset, seg.NextOffset, status)
+	}
+
+	_, _ = fmt.Fprintf(out, "%s: repaired %d segments, %d truncated\n", report.Dir, len(report.Segments), changed)
+	return nil
+}
+
+func snapshotLog(cmd *cobra.Command, args []string) error {
+	var c conf.PrologLog
+	if err := processConfigCLI(viper.GetViper(), &c); err != nil {
+		return failure.Wrap(err, "processConfigCLI failed")
+	}
+
+	lc, err := construct.NewLogConfig(c.Storage.LogSettings)
+	if err != nil {
+		return failure.Wrap(err, "construct.NewLogConfig failed")
+	}
+
+	// the log is only read, retention or compaction must not change it
+	// while it is being archived
+	lc.NoBackground = true
+	l, err := commitlog.NewLog(c.Storage.Dir, lc)
+	if err != nil {
+		return failure.Wrap(err, "commitlog.NewLog failed (%s)", c.Storage.Dir)
+	}
+	defer func() { _ = l.Close() }()
+
+	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return failure.ToSystem(err, "os.OpenFile failed for (%s)", args[0])
+	}
+
+	m, err := l.Snapshot(f)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(args[0])
+		return failure.Wrap(err, "l.Snapshot failed (%s)", c.Storage.Dir)
+	}
+
+	if err = f.Close(); err != nil {
+		return failure.ToSystem(err, "f.Close failed for (%s)", args[0])
+	}
+
+	_, _ = fmt.Fprintf(cmd.OutOrStdout(), "%s: archived %d segments (high-water mark %d) to %s\n",
+		c.Storage.Dir, len(m.Segments), m.HighWaterMark, args[0])
+	return nil
+}
+
+func restoreLog(cmd *cobra.Command, args []string) error {
+	var c conf.PrologLog
+	if err := processConfigCLI(viper.GetViper(), &c); err != nil {
+		return failure.Wrap(err, "processConfigCLI failed")
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return failure.ToSystem(err, "os.Open failed for (%s)", args[0])
+	}
+	defer func() { _ = f.Close() }()
+
+	m, err := commitlog.Restore(c.Storage.Dir, f)
+	if err != nil {
+		return failure.Wrap(err, "commitlog.Restore failed (%s)", c.Storage.Dir)
+	}
+
+	_, _ = fmt.Fprintf(cmd.OutOrStdout(), "%s: restored %d segments (high-water mark %d) from %s\n",
+		c.Storage.Dir, len(m.Segments), m.HighWaterMark, args[0])
+	return nil
+}
+
+func migrateLog(cmd *cobra.Command, _ []string) error {
+	var c conf.PrologLog
+	if err := processConfigCLI(viper.GetViper(), &c); err != nil {
+		return failure.Wrap(err, "processConfigCLI failed")
+	}
+
+	lc, err := construct.NewLogConfig(c.Storage.LogSettings)
+	if err != nil {
+		return failure.Wrap(err, "construct.NewLogConfig failed")
+	}
+
+	report, err := commitlog.Migrate(c.Storage.Dir, lc, c.Force)
+
+	// what is dropped is printed even when the migration was refused so the
+	// operator can decide whether to force it
+	out := cmd.OutOrStdout()
+	for _, seg := range report.Segments {
+		_, _ = fmt.Fprintf(out, "segment %d: offsets [%d, %d) version %d -> %d truncated-bytes=%d\n",
+			seg.BaseOffset, seg.BaseOffset, seg.NextOffset, seg.From, commitlog.CurrentVersion, seg.TruncatedBytes)
+	}
+
+	if err != nil {
+		return failure.Wrap(err, "commitlog.Migrate failed (%s)", c.Storage.Dir)
+	}
+
+	_, _ = fmt.Fprintf(out, "%s: migrated %d segments to version %d, truncated %d bytes\n",
+		report.Dir, len(report.Segments), commitlog.CurrentVersion, report.Truncated())
+	return nil
+}
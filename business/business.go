@@ -10,44 +10,21 @@
 // import types from this package.
 package business
 
-import (
-	"sync"
-
-	"github.com/rsb/failure"
-)
-
-type Log struct {
-	mu      sync.Mutex
-	records []Record
-}
-
-func NewLog() *Log {
-	return &Log{}
-}
-
-func (c *Log) Append(rec Record) (uint64, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	rec.Offset = uint64(len(c.records))
-	c.records = append(c.records, rec)
-
-	return rec.Offset, nil
-}
-
-func (c *Log) Read(offset uint64) (Record, error) {
-	var result Record
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	if offset >= uint64(len(c.records)) {
-		return result, failure.NotFound("offset")
-	}
-
-	return c.records[offset], nil
+// Record is a single entry in the log as it is sent over http, the log
+// itself stores it as a data.Record. Key, Headers and ProducerTimestamp
+// are optional so records from clients that do not send them still decode.
+type Record struct {
+	Value   []byte   `json:"value"`
+	Offset  uint64   `json:"offset"`
+	Key     []byte   `json:"key,omitempty"`
+	Headers []Header `json:"headers,omitempty"`
+	// ProducerTimestamp is the time the producer created the record in
+	// nanoseconds since the unix epoch.
+	ProducerTimestamp int64 `json:"producer_timestamp,omitempty"`
 }
 
-type Record struct {
-	Value  []byte `json:"value"`
-	Offset uint64 `json:"offset"`
+// Header is a piece of metadata attached to a record by its producer
+type Header struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
 }
@@ -0,0 +1,150 @@
+// Package broker manages the named topics of a server. Every topic is stored
+// in its own subdirectory of the broker's directory and is split into a fixed
+// number of partitions, each of them an independent commit log.
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rsb/failure"
+
+	"github.com/rsb/prolog/business/data/log"
+)
+
+var topicName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,248}$`)
+
+type Broker struct {
+	mu     sync.RWMutex
+	Dir    string
+	Config log.Config
+	topics map[string]*Topic
+}
+
+// New opens every topic found in dir, creating dir when it does not exist.
+// Each topic's log is opened with c.
+func New(dir string, c log.Config) (*Broker, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, failure.ToSystem(err, "os.MkdirAll failed for (%s)", dir)
+	}
+
+	b := Broker{
+		Dir:    dir,
+		Config: c,
+		topics: map[string]*Topic{},
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, failure.ToSystem(err, "ioutil.ReadDir failed for (%s)", dir)
+	}
+
+	for _, file := range files {
+		if !file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+
+		name := file.Name()
+		t, err := openTopic(path.Join(dir, name), name, c)
+		if err != nil {
+			_ = b.Close()
+			return nil, failure.Wrap(err, "openTopic failed (%s)", name)
+		}
+		b.topics[name] = t
+	}
+
+	return &b, nil
+}
+
+// CreateTopic creates a new empty topic with the given number of partitions.
+// The partition count is saved with the topic and can not be changed later
+// since that would move keys to different partitions.
+func (b *Broker) CreateTopic(name string, partitions uint32) (*Topic, error) {
+	if !topicName.MatchString(name) {
+		return nil, failure.InvalidParam("topic name (%s) must match %s", name, topicName)
+	}
+
+	if partitions == 0 {
+		return nil, failure.InvalidParam("topic (%s) needs at least one partition", name)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.topics[name]; ok {
+		return nil, failure.AlreadyExists("topic (%s) already exists", name)
+	}
+
+	t, err := createTopic(path.Join(b.Dir, name), name, partitions, b.Config)
+	if err != nil {
+		return nil, failure.Wrap(err, "createTopic failed (%s)", name)
+	}
+	b.topics[name] = t
+
+	return t, nil
+}
+
+// Topic returns an existing topic
+func (b *Broker) Topic(name string) (*Topic, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	t, ok := b.topics[name]
+	if !ok {
+		return nil, failure.NotFound("topic (%s) does not exist", name)
+	}
+
+	return t, nil
+}
+
+// Topics returns the names of every topic sorted alphabetically
+func (b *Broker) Topics() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	names := make([]string, 0, len(b.topics))
+	for name := range b.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// DeleteTopic closes the logs of the topic and removes all of its data
+func (b *Broker) DeleteTopic(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t, ok := b.topics[name]
+	if !ok {
+		return failure.NotFound("topic (%s) does not exist", name)
+	}
+
+	delete(b.topics, name)
+	if err := t.Remove(); err != nil {
+		return failure.Wrap(err, "t.Remove failed (%s)", name)
+	}
+
+	return nil
+}
+
+// Close closes every topic
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for name, t := range b.topics {
+		if err := t.Close(); err != nil {
+			return failure.Wrap(err, "t.Close failed (%s)", name)
+		}
+		delete(b.topics, name)
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package broker_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/rsb/failure"
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+	"github.com/rsb/prolog/business/data/broker"
+	"github.com/rsb/prolog/business/data/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBroker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "broker-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	b, err := broker.New(dir, log.Config{})
+	require.NoError(t, err)
+	require.Empty(t, b.Topics())
+
+	_, err = b.CreateTopic("../escape", 1)
+	require.True(t, failure.IsInvalidParam(err))
+
+	_, err = b.CreateTopic("empty", 0)
+	require.True(t, failure.IsInvalidParam(err))
+
+	orders, err := b.CreateTopic("orders", 1)
+	require.NoError(t, err)
+	payments, err := b.CreateTopic("payments", 1)
+	require.NoError(t, err)
+
+	_, err = b.CreateTopic("orders", 1)
+	require.True(t, failure.IsAlreadyExists(err))
+
+	// topics are independent logs with their own offsets
+	for i := 0; i < 2; i++ {
+		p, off, err := orders.Append(&data.Record{Value: []byte("order")})
+		require.NoError(t, err)
+		require.Equal(t, uint32(0), p)
+		require.Equal(t, uint64(i), off)
+	}
+	_, off, err := payments.Append(&data.Record{Value: []byte("payment")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	require.NoError(t, b.Close())
+
+	// topics are found again when the broker is reopened
+	b, err = broker.New(dir, log.Config{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders", "payments"}, b.Topics())
+
+	orders, err = b.Topic("orders")
+	require.NoError(t, err)
+	l, err := orders.Partition(0)
+	require.NoError(t, err)
+	read, err := l.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order"), read.Value)
+
+	require.NoError(t, b.DeleteTopic("payments"))
+	require.Equal(t, []string{"orders"}, b.Topics())
+	_, err = os.Stat(path.Join(dir, "payments"))
+	require.True(t, os.IsNotExist(err))
+
+	_, err = b.Topic("payments")
+	require.True(t, failure.IsNotFound(err))
+	require.True(t, failure.IsNotFound(b.DeleteTopic("payments")))
+
+	require.NoError(t, b.Close())
+}
+
+func TestBroker_Partitions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "broker-partitions-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	b, err := broker.New(dir, log.Config{})
+	require.NoError(t, err)
+
+	topic, err := b.CreateTopic("events", 3)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), topic.Partitions())
+
+	_, err = topic.Partition(3)
+	require.True(t, failure.IsNotFound(err))
+
+	// records without a key are spread round-robin
+	for i := 0; i < 6; i++ {
+		p, off, err := topic.Append(&data.Record{Value: []byte("no key")})
+		require.NoError(t, err)
+		require.Equal(t, uint32(i%3), p)
+		require.Equal(t, uint64(i/3), off)
+	}
+
+	// records with the same key always land in the same partition
+	want, _, err := topic.Append(&data.Record{Key: []byte("user-1"), Value: []byte("a")})
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		p, _, err := topic.Append(&data.Record{Key: []byte("user-1"), Value: []byte("b")})
+		require.NoError(t, err)
+		require.Equal(t, want, p)
+	}
+	require.NoError(t, b.Close())
+
+	// the partition count survives a restart and keys keep their partition
+	b, err = broker.New(dir, log.Config{})
+	require.NoError(t, err)
+	defer func() { _ = b.Close() }()
+
+	topic, err = b.Topic("events")
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), topic.Partitions())
+	require.Equal(t, want, topic.PartitionFor(&data.Record{Key: []byte("user-1")}))
+
+	// records of an idempotent producer without a key are not spread, a
+	// retry has to reach the partition of the first attempt
+	for i := 0; i < 3; i++ {
+		require.Equal(t, uint32(2), topic.PartitionFor(&data.Record{ProducerId: 5}))
+	}
+
+	// every record of a transaction goes to its partition, keyed or not
+	require.Equal(t, uint32(1), topic.PartitionFor(&data.Record{TransactionId: 4, Key: []byte("user-1")}))
+
+	l, err := topic.Partition(want)
+	require.NoError(t, err)
+	off, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+}
+
+func TestKeyHash(t *testing.T) {
+	// the hash must never change or keys would move between partitions
+	p := broker.KeyHash{}
+	require.Equal(t, uint32(0x811c9dc5%7), p.Partition(&data.Record{}, 7))
+	require.Equal(t, p.Partition(&data.Record{Key: []byte("a")}, 7), p.Partition(&data.Record{Key: []byte("a")}, 7))
+}
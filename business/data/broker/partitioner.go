@@ -0,0 +1,61 @@
+package broker
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+)
+
+// Partitioner picks the partition a record is appended to
+type Partitioner interface {
+	Partition(record *data.Record, partitions uint32) uint32
+}
+
+// KeyHash sends every record with the same key to the same partition by
+// hashing the key with FNV-1a. The hash is stable across restarts and
+// releases so a key never moves while the partition count stays the same.
+type KeyHash struct{}
+
+func (KeyHash) Partition(record *data.Record, partitions uint32) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write(record.Key)
+	return h.Sum32() % partitions
+}
+
+// RoundRobin spreads records evenly over the partitions in turn
+type RoundRobin struct {
+	next uint32
+}
+
+func (r *RoundRobin) Partition(_ *data.Record, partitions uint32) uint32 {
+	return (atomic.AddUint32(&r.next, 1) - 1) % partitions
+}
+
+// KeyOrRoundRobin hashes the key of keyed records so they keep their order
+// within a partition and spreads records without a key round-robin. Records
+// without a key from an idempotent producer all go to the partition picked
+// by the producer id, a retry has to land where the first attempt did to be
+// recognized. Every record of a transaction goes to the partition picked by
+// the transaction id, key or not, since a transaction is atomic within one
+// partition only.
+type KeyOrRoundRobin struct {
+	KeyHash    KeyHash
+	RoundRobin RoundRobin
+}
+
+func (p *KeyOrRoundRobin) Partition(record *data.Record, partitions uint32) uint32 {
+	if record.TransactionId != 0 {
+		return uint32(record.TransactionId % uint64(partitions))
+	}
+
+	if len(record.Key) > 0 {
+		return p.KeyHash.Partition(record, partitions)
+	}
+
+	if record.ProducerId != 0 {
+		return uint32(record.ProducerId % uint64(partitions))
+	}
+
+	return p.RoundRobin.Partition(record, partitions)
+}
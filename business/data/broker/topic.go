@@ -0,0 +1,163 @@
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/rsb/failure"
+
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+	"github.com/rsb/prolog/business/data/log"
+)
+
+// MetaFile is written to every topic directory and records the settings the
+// topic was created with.
+const MetaFile = "topic.json"
+
+// TopicMeta is the content of a topic's MetaFile
+type TopicMeta struct {
+	Partitions uint32 `json:"partitions"`
+}
+
+// Topic is a named stream split into a fixed number of partitions, each of
+// them its own log in a subdirectory of the topic named after its index.
+type Topic struct {
+	Name        string
+	Dir         string
+	Meta        TopicMeta
+	Partitioner Partitioner
+	partitions  []*log.Log
+}
+
+// createTopic writes the metadata of a new topic and opens it
+func createTopic(dir, name string, partitions uint32, c log.Config) (*Topic, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, failure.ToSystem(err, "os.MkdirAll failed for (%s)", dir)
+	}
+
+	b, err := json.Marshal(TopicMeta{Partitions: partitions})
+	if err != nil {
+		return nil, failure.ToSystem(err, "json.Marshal failed")
+	}
+
+	// the metadata is renamed into place so a topic never has a partial one
+	tmp := path.Join(dir, "."+MetaFile)
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return nil, failure.ToSystem(err, "ioutil.WriteFile failed for (%s)", tmp)
+	}
+
+	if err = os.Rename(tmp, path.Join(dir, MetaFile)); err != nil {
+		return nil, failure.ToSystem(err, "os.Rename failed for (%s)", tmp)
+	}
+
+	t, err := openTopic(dir, name, c)
+	if err != nil {
+		return nil, failure.Wrap(err, "openTopic failed")
+	}
+
+	return t, nil
+}
+
+// openTopic reads the topic's metadata and opens the log of every partition
+func openTopic(dir, name string, c log.Config) (*Topic, error) {
+	file := path.Join(dir, MetaFile)
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, failure.ToSystem(err, "ioutil.ReadFile failed for (%s)", file)
+	}
+
+	t := Topic{
+		Name:        name,
+		Dir:         dir,
+		Partitioner: &KeyOrRoundRobin{},
+	}
+	if err = json.Unmarshal(b, &t.Meta); err != nil {
+		return nil, failure.ToConfig(err, "json.Unmarshal failed for (%s)", file)
+	}
+
+	if t.Meta.Partitions == 0 {
+		return nil, failure.Config("topic (%s) has no partitions", name)
+	}
+
+	for p := uint32(0); p < t.Meta.Partitions; p++ {
+		pc := c
+		if pc.Logger != nil {
+			pc.Logger = pc.Logger.With("topic", name, "partition", p)
+		}
+
+		pdir := path.Join(dir, strconv.FormatUint(uint64(p), 10))
+		if err = os.MkdirAll(pdir, 0755); err != nil {
+			_ = t.Close()
+			return nil, failure.ToSystem(err, "os.MkdirAll failed for (%s)", pdir)
+		}
+
+		l, err := log.NewLog(pdir, pc)
+		if err != nil {
+			_ = t.Close()
+			return nil, failure.Wrap(err, "log.NewLog failed for partition (%d)", p)
+		}
+		t.partitions = append(t.partitions, l)
+	}
+
+	return &t, nil
+}
+
+// Partitions returns the number of partitions of the topic
+func (t *Topic) Partitions() uint32 {
+	return t.Meta.Partitions
+}
+
+// Partition returns the log of a partition
+func (t *Topic) Partition(p uint32) (*log.Log, error) {
+	if p >= t.Meta.Partitions {
+		return nil, failure.NotFound("topic (%s) has no partition (%d), it has (%d)", t.Name, p, t.Meta.Partitions)
+	}
+
+	return t.partitions[p], nil
+}
+
+// PartitionFor returns the partition record should be appended to
+func (t *Topic) PartitionFor(record *data.Record) uint32 {
+	return t.Partitioner.Partition(record, t.Meta.Partitions)
+}
+
+// Append appends record to the partition chosen by the topic's partitioner
+// and returns the partition along with the record's offset in it.
+func (t *Topic) Append(record *data.Record) (uint32, uint64, error) {
+	p := t.PartitionFor(record)
+	off, err := t.partitions[p].Append(record)
+	if err != nil {
+		return 0, 0, failure.Wrap(err, "Append failed for partition (%d)", p)
+	}
+
+	return p, off, nil
+}
+
+// Close closes the log of every partition
+func (t *Topic) Close() error {
+	for p, l := range t.partitions {
+		if err := l.Close(); err != nil {
+			return failure.Wrap(err, "l.Close failed for partition (%d)", p)
+		}
+	}
+
+	return nil
+}
+
+// Remove removes the log of every partition and then the topic's directory
+func (t *Topic) Remove() error {
+	for p, l := range t.partitions {
+		if err := l.Remove(); err != nil {
+			return failure.Wrap(err, "l.Remove failed for partition (%d)", p)
+		}
+	}
+
+	if err := os.RemoveAll(t.Dir); err != nil {
+		return failure.ToSystem(err, "os.RemoveAll failed for (%s)", t.Dir)
+	}
+
+	return nil
+}
@@ -0,0 +1,493 @@
+// Package group coordinates the consumer groups of a server. Members of a
+// named group share the partitions of a topic, every partition is consumed
+// by one member at a time, and the group commits the offset it reached in
+// each partition so its members can resume where the group left off.
+//
+// Committed offsets are appended to an internal log as keyed records and
+// are read back from it when the coordinator is opened. Membership is only
+// kept in memory, members join again when the server restarts.
+package group
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rsb/failure"
+	"go.uber.org/zap"
+
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+)
+
+const (
+	// DefaultSessionTimeout is how long a member may go without a
+	// heartbeat before it is removed from its group
+	DefaultSessionTimeout = 10 * time.Second
+	// DefaultCheckInterval is how often members are checked for expired
+	// sessions
+	DefaultCheckInterval = time.Second
+)
+
+var groupName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,248}$`)
+
+// OffsetLog is the internal log committed offsets are stored in. The log on
+// disk and the one in memory both implement it.
+type OffsetLog interface {
+	Append(record *data.Record) (uint64, error)
+	ReadNext(ctx context.Context, offset uint64) (*data.Record, error)
+	LowestOffset() (uint64, error)
+	Close() error
+}
+
+type Config struct {
+	// SessionTimeout is how long a member may go without a heartbeat before
+	// it is removed and the group rebalances
+	SessionTimeout time.Duration
+	// CheckInterval is how often expired members are removed
+	CheckInterval time.Duration
+	Logger        *zap.SugaredLogger
+}
+
+// Assignment is what a member consumes in a generation of its group
+type Assignment struct {
+	MemberID   string
+	Generation uint64
+	Partitions []uint32
+}
+
+// Commit is the value of a committed offset record
+type Commit struct {
+	Group     string `json:"group"`
+	Topic     string `json:"topic"`
+	Partition uint32 `json:"partition"`
+	Offset    uint64 `json:"offset"`
+}
+
+// key is the record key of a committed offset, the offsets log is compacted
+// down to the last commit of every key
+func (c Commit) key() string {
+	return fmt.Sprintf("%s/%s/%d", c.Group, c.Topic, c.Partition)
+}
+
+type member struct {
+	partitions []uint32
+	lastSeen   time.Time
+}
+
+type group struct {
+	topic      string
+	partitions uint32
+	generation uint64
+	members    map[string]*member
+}
+
+// Coordinator manages the consumer groups of a server and owns the log
+// their committed offsets are stored in
+type Coordinator struct {
+	Config Config
+
+	mu      sync.Mutex
+	log     OffsetLog
+	groups  map[string]*group
+	offsets map[string]uint64
+	closed  bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New reads the committed offsets back from l and starts removing members
+// whose session expired. The coordinator closes l when it is closed.
+func New(l OffsetLog, c Config) (*Coordinator, error) {
+	if c.SessionTimeout == 0 {
+		c.SessionTimeout = DefaultSessionTimeout
+	}
+	if c.CheckInterval == 0 {
+		c.CheckInterval = DefaultCheckInterval
+	}
+	if c.Logger == nil {
+		c.Logger = zap.NewNop().Sugar()
+	}
+
+	co := Coordinator{
+		Config:  c,
+		log:     l,
+		groups:  map[string]*group{},
+		offsets: map[string]uint64{},
+		done:    make(chan struct{}),
+	}
+
+	if err := co.load(); err != nil {
+		return nil, failure.Wrap(err, "co.load failed")
+	}
+
+	co.wg.Add(1)
+	go co.expireMembers()
+
+	return &co, nil
+}
+
+// load replays the offsets log, the last commit of every key wins
+func (co *Coordinator) load() error {
+	off, err := co.log.LowestOffset()
+	if err != nil {
+		return failure.Wrap(err, "co.log.LowestOffset failed")
+	}
+
+	// ReadNext returns the records that are already there and only waits,
+	// failing right away on the canceled context, once it reaches the end
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for {
+		rec, err := co.log.ReadNext(ctx, off)
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+		if err != nil {
+			return failure.Wrap(err, "co.log.ReadNext failed (%d)", off)
+		}
+
+		var c Commit
+		if err = json.Unmarshal(rec.Value, &c); err != nil {
+			return failure.ToSystem(err, "json.Unmarshal failed for offset (%d)", rec.Offset)
+		}
+		co.offsets[c.key()] = c.Offset
+		off = rec.Offset + 1
+	}
+}
+
+// Join adds memberID to the group consuming topic, which has the given
+// number of partitions, and rebalances the group. An empty memberID is
+// replaced by a new one. A group consumes a single topic, joining it for
+// another one fails with failure.InvalidParam while it has members.
+func (co *Coordinator) Join(name, topic string, partitions uint32, memberID string, now time.Time) (Assignment, error) {
+	if !groupName.MatchString(name) {
+		return Assignment{}, failure.InvalidParam("group name (%s) must match %s", name, groupName)
+	}
+
+	if memberID == "" {
+		id, err := newMemberID()
+		if err != nil {
+			return Assignment{}, failure.Wrap(err, "newMemberID failed")
+		}
+		memberID = id
+	}
+
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	if err := co.checkOpen(); err != nil {
+		return Assignment{}, failure.Wrap(err, "co.checkOpen failed")
+	}
+
+	g, ok := co.groups[name]
+	if !ok {
+		g = &group{members: map[string]*member{}}
+		co.groups[name] = g
+	}
+
+	if len(g.members) > 0 && g.topic != topic {
+		return Assignment{}, failure.InvalidParam("group (%s) consumes topic (%s), not (%s)", name, g.topic, topic)
+	}
+	g.topic = topic
+	g.partitions = partitions
+
+	// a member that joins again keeps its id and only refreshes its session
+	if m, ok := g.members[memberID]; ok {
+		m.lastSeen = now
+		return g.assignment(memberID), nil
+	}
+
+	g.members[memberID] = &member{lastSeen: now}
+	g.rebalance()
+	co.Config.Logger.Infow("group",
+		"status", "member joined",
+		"group", name,
+		"member-id", memberID,
+		"generation", g.generation,
+	)
+
+	return g.assignment(memberID), nil
+}
+
+// Heartbeat keeps the session of memberID alive and returns its current
+// assignment, which has a new generation once the group rebalanced. A
+// member that is not in the group, because it left or its session expired,
+// gets failure.NotFound and has to join again.
+func (co *Coordinator) Heartbeat(name, memberID string, now time.Time) (Assignment, error) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	if err := co.checkOpen(); err != nil {
+		return Assignment{}, failure.Wrap(err, "co.checkOpen failed")
+	}
+
+	g, m, err := co.member(name, memberID)
+	if err != nil {
+		return Assignment{}, failure.Wrap(err, "co.member failed")
+	}
+	m.lastSeen = now
+
+	return g.assignment(memberID), nil
+}
+
+// Leave removes memberID from the group and rebalances it
+func (co *Coordinator) Leave(name, memberID string) error {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	if err := co.checkOpen(); err != nil {
+		return failure.Wrap(err, "co.checkOpen failed")
+	}
+
+	g, _, err := co.member(name, memberID)
+	if err != nil {
+		return failure.Wrap(err, "co.member failed")
+	}
+
+	co.remove(name, g, memberID, "member left")
+	return nil
+}
+
+// Expire removes every member whose last heartbeat is older than
+// SessionTimeout as of now
+func (co *Coordinator) Expire(now time.Time) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	deadline := now.Add(-co.Config.SessionTimeout)
+	for name, g := range co.groups {
+		for id, m := range g.members {
+			if m.lastSeen.Before(deadline) {
+				co.remove(name, g, id, "member session expired")
+			}
+		}
+	}
+}
+
+// CommitOffset durably records that the group consumed the partition of
+// topic up to offset, which is the next offset the group reads. A member
+// can only commit for the partitions of its current assignment, a commit
+// with an older generation or for a partition it does not own fails with
+// failure.Validation. Groups without members commit with an empty memberID.
+func (co *Coordinator) CommitOffset(name, topic string, partition uint32, offset uint64, memberID string, generation uint64) error {
+	if !groupName.MatchString(name) {
+		return failure.InvalidParam("group name (%s) must match %s", name, groupName)
+	}
+
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	if err := co.checkOpen(); err != nil {
+		return failure.Wrap(err, "co.checkOpen failed")
+	}
+
+	if err := co.checkCommit(name, topic, partition, memberID, generation); err != nil {
+		return failure.Wrap(err, "co.checkCommit failed")
+	}
+
+	c := Commit{Group: name, Topic: topic, Partition: partition, Offset: offset}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return failure.ToSystem(err, "json.Marshal failed")
+	}
+
+	// the offset is only visible once it is in the log, so a commit that
+	// was acknowledged is never lost on restart
+	if _, err = co.log.Append(&data.Record{Key: []byte(c.key()), Value: b}); err != nil {
+		return failure.Wrap(err, "co.log.Append failed")
+	}
+	co.offsets[c.key()] = offset
+
+	return nil
+}
+
+// FetchOffset returns the offset the group committed for the partition of
+// topic. It fails with failure.NotFound when the group never committed one.
+func (co *Coordinator) FetchOffset(name, topic string, partition uint32) (uint64, error) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	if err := co.checkOpen(); err != nil {
+		return 0, failure.Wrap(err, "co.checkOpen failed")
+	}
+
+	c := Commit{Group: name, Topic: topic, Partition: partition}
+	off, ok := co.offsets[c.key()]
+	if !ok {
+		return 0, failure.NotFound("group (%s) has no offset for topic (%s) partition (%d)", name, topic, partition)
+	}
+
+	return off, nil
+}
+
+// Close stops removing expired members and closes the offsets log
+func (co *Coordinator) Close() error {
+	co.mu.Lock()
+	if co.closed {
+		co.mu.Unlock()
+		return nil
+	}
+	co.closed = true
+	co.mu.Unlock()
+
+	close(co.done)
+	co.wg.Wait()
+
+	if err := co.log.Close(); err != nil {
+		return failure.Wrap(err, "co.log.Close failed")
+	}
+
+	return nil
+}
+
+// checkCommit fences commits of members that no longer own the partition.
+// The caller must hold mu.
+func (co *Coordinator) checkCommit(name, topic string, partition uint32, memberID string, generation uint64) error {
+	g, ok := co.groups[name]
+	if memberID == "" {
+		if ok && len(g.members) > 0 {
+			return failure.Validation("group (%s) has members, commits need a member id", name)
+		}
+		return nil
+	}
+
+	g, m, err := co.member(name, memberID)
+	if err != nil {
+		return failure.Wrap(err, "co.member failed")
+	}
+
+	if generation != g.generation {
+		return failure.Validation("generation (%d) of group (%s) is stale, it is (%d)", generation, name, g.generation)
+	}
+
+	if topic != g.topic || !owns(m.partitions, partition) {
+		return failure.Validation("member (%s) of group (%s) is not assigned topic (%s) partition (%d)", memberID, name, topic, partition)
+	}
+
+	return nil
+}
+
+// member returns the group and the member memberID of it. The caller must
+// hold mu.
+func (co *Coordinator) member(name, memberID string) (*group, *member, error) {
+	g, ok := co.groups[name]
+	if !ok {
+		return nil, nil, failure.NotFound("group (%s) has no members", name)
+	}
+
+	m, ok := g.members[memberID]
+	if !ok {
+		return nil, nil, failure.NotFound("member (%s) is not in group (%s)", memberID, name)
+	}
+
+	return g, m, nil
+}
+
+// remove takes memberID out of the group and rebalances the members that
+// are left, a group without members is forgotten. The caller must hold mu.
+func (co *Coordinator) remove(name string, g *group, memberID, status string) {
+	delete(g.members, memberID)
+	g.rebalance()
+	if len(g.members) == 0 {
+		delete(co.groups, name)
+	}
+	co.Config.Logger.Infow("group",
+		"status", status,
+		"group", name,
+		"member-id", memberID,
+		"generation", g.generation,
+	)
+}
+
+// checkOpen fails once the coordinator is closed. The caller must hold mu.
+func (co *Coordinator) checkOpen() error {
+	if co.closed {
+		return failure.Shutdown("group coordinator is closed")
+	}
+
+	return nil
+}
+
+func (co *Coordinator) expireMembers() {
+	defer co.wg.Done()
+
+	ticker := time.NewTicker(co.Config.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-co.done:
+			return
+		case now := <-ticker.C:
+			co.Expire(now)
+		}
+	}
+}
+
+// rebalance starts a new generation and splits the partitions into ranges
+// of consecutive partitions, one for every member in the order of their
+// ids. The first members get one partition more when they do not divide
+// evenly and members past the number of partitions get none.
+func (g *group) rebalance() {
+	g.generation++
+
+	ids := make([]string, 0, len(g.members))
+	for id := range g.members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	n := uint32(len(ids))
+	p := uint32(0)
+	for i, id := range ids {
+		count := g.partitions / n
+		if uint32(i) < g.partitions%n {
+			count++
+		}
+
+		partitions := make([]uint32, 0, count)
+		for ; count > 0; count-- {
+			partitions = append(partitions, p)
+			p++
+		}
+		g.members[id].partitions = partitions
+	}
+}
+
+func (g *group) assignment(memberID string) Assignment {
+	partitions := g.members[memberID].partitions
+	return Assignment{
+		MemberID:   memberID,
+		Generation: g.generation,
+		Partitions: append([]uint32(nil), partitions...),
+	}
+}
+
+func owns(partitions []uint32, partition uint32) bool {
+	for _, p := range partitions {
+		if p == partition {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newMemberID returns a random member id
+func newMemberID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", failure.ToSystem(err, "rand.Read failed")
+	}
+
+	return hex.EncodeToString(b), nil
+}
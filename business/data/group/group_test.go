@@ -0,0 +1,148 @@
+package group_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rsb/failure"
+	"github.com/rsb/prolog/business/data/group"
+	"github.com/rsb/prolog/business/data/log"
+	"github.com/rsb/prolog/business/data/memlog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCoordinator_Rebalance(t *testing.T) {
+	co, err := group.New(memlog.New(), group.Config{SessionTimeout: time.Minute})
+	require.NoError(t, err)
+	defer func() { _ = co.Close() }()
+
+	now := time.Now()
+	_, err = co.Join("../escape", "orders", 4, "", now)
+	require.True(t, failure.IsInvalidParam(err), err)
+
+	a, err := co.Join("billing", "orders", 4, "a", now)
+	require.NoError(t, err)
+	require.Equal(t, group.Assignment{MemberID: "a", Generation: 1, Partitions: []uint32{0, 1, 2, 3}}, a)
+
+	_, err = co.Join("billing", "payments", 4, "x", now)
+	require.True(t, failure.IsInvalidParam(err), err)
+
+	// members get a new id when they do not bring one
+	c, err := co.Join("billing", "orders", 4, "", now)
+	require.NoError(t, err)
+	require.NotEmpty(t, c.MemberID)
+
+	b, err := co.Join("billing", "orders", 4, "b", now)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), b.Generation)
+
+	// every partition is assigned to exactly one member
+	assigned := map[uint32]string{}
+	for _, id := range []string{"a", "b", c.MemberID} {
+		a, err = co.Heartbeat("billing", id, now)
+		require.NoError(t, err)
+		require.Equal(t, uint64(3), a.Generation)
+		for _, p := range a.Partitions {
+			require.NotContains(t, assigned, p)
+			assigned[p] = id
+		}
+	}
+	require.Len(t, assigned, 4)
+
+	a, err = co.Heartbeat("billing", "a", now)
+	require.NoError(t, err)
+	b, err = co.Heartbeat("billing", "b", now)
+	require.NoError(t, err)
+
+	// an old generation can no longer commit
+	err = co.CommitOffset("billing", "orders", a.Partitions[0], 10, "a", 1)
+	require.True(t, failure.IsValidation(err), err)
+	// and a member can only commit for its own partitions
+	err = co.CommitOffset("billing", "orders", b.Partitions[0], 10, "a", 3)
+	require.True(t, failure.IsValidation(err), err)
+	err = co.CommitOffset("billing", "orders", a.Partitions[0], 10, "", 0)
+	require.True(t, failure.IsValidation(err), err)
+	require.NoError(t, co.CommitOffset("billing", "orders", a.Partitions[0], 10, "a", 3))
+
+	require.NoError(t, co.Leave("billing", c.MemberID))
+	_, err = co.Heartbeat("billing", c.MemberID, now)
+	require.True(t, failure.IsNotFound(err), err)
+
+	a, err = co.Heartbeat("billing", "a", now)
+	require.NoError(t, err)
+	require.Equal(t, group.Assignment{MemberID: "a", Generation: 4, Partitions: []uint32{0, 1}}, a)
+
+	// a member that stops sending heartbeats is removed
+	_, err = co.Heartbeat("billing", "b", now.Add(30*time.Second))
+	require.NoError(t, err)
+	co.Expire(now.Add(90 * time.Second))
+
+	_, err = co.Heartbeat("billing", "a", now)
+	require.True(t, failure.IsNotFound(err), err)
+	b, err = co.Heartbeat("billing", "b", now)
+	require.NoError(t, err)
+	require.Equal(t, group.Assignment{MemberID: "b", Generation: 5, Partitions: []uint32{0, 1, 2, 3}}, b)
+
+	// members past the number of partitions wait for one to free up
+	for _, id := range []string{"a", "c", "d", "e"} {
+		_, err = co.Join("billing", "orders", 4, id, now)
+		require.NoError(t, err)
+	}
+	e, err := co.Heartbeat("billing", "e", now)
+	require.NoError(t, err)
+	require.Empty(t, e.Partitions)
+}
+
+func TestCoordinator_Offsets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "group-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 256
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+
+	co, err := group.New(l, group.Config{})
+	require.NoError(t, err)
+
+	_, err = co.FetchOffset("billing", "orders", 0)
+	require.True(t, failure.IsNotFound(err), err)
+
+	// groups without members commit without a member id
+	for off := uint64(1); off <= 10; off++ {
+		require.NoError(t, co.CommitOffset("billing", "orders", 0, off, "", 0))
+	}
+	require.NoError(t, co.CommitOffset("billing", "orders", 1, 7, "", 0))
+	require.NoError(t, co.CommitOffset("audit", "orders", 0, 3, "", 0))
+	require.NoError(t, co.CommitOffset("audit", "", 0, 5, "", 0))
+
+	require.NoError(t, co.Close())
+	_, err = co.FetchOffset("billing", "orders", 0)
+	require.Error(t, err)
+
+	// the offsets are read back from the log
+	l, err = log.NewLog(dir, c)
+	require.NoError(t, err)
+	co, err = group.New(l, group.Config{})
+	require.NoError(t, err)
+	defer func() { _ = co.Close() }()
+
+	for _, tc := range []struct {
+		group     string
+		topic     string
+		partition uint32
+		offset    uint64
+	}{
+		{group: "billing", topic: "orders", partition: 0, offset: 10},
+		{group: "billing", topic: "orders", partition: 1, offset: 7},
+		{group: "audit", topic: "orders", partition: 0, offset: 3},
+		{group: "audit", topic: "", partition: 0, offset: 5},
+	} {
+		off, err := co.FetchOffset(tc.group, tc.topic, tc.partition)
+		require.NoError(t, err)
+		require.Equal(t, tc.offset, off)
+	}
+}
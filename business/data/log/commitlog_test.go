@@ -0,0 +1,29 @@
+package log_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rsb/prolog/business/data/log"
+	"github.com/rsb/prolog/business/data/logtest"
+	"github.com/rsb/prolog/business/data/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog_CommitLog(t *testing.T) {
+	logtest.TestCommitLog(t, func(t *testing.T) (server.CommitLog, func()) {
+		dir, err := ioutil.TempDir("", "commitlog-test")
+		require.NoError(t, err)
+
+		c := log.Config{}
+		c.Segment.MaxStoreBytes = 64
+		l, err := log.NewLog(dir, c)
+		require.NoError(t, err)
+
+		return l, func() {
+			_ = l.Close()
+			_ = os.RemoveAll(dir)
+		}
+	})
+}
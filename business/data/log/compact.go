@@ -0,0 +1,203 @@
+package log
+
+import (
+	"os"
+	"path"
+	"time"
+
+	"github.com/rsb/failure"
+
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+)
+
+// CompactDir is the directory inside the log where compacted segments are
+// written before they replace the originals. Anything left in it after a
+// crash is discarded the next time the log is opened.
+const CompactDir = ".compact"
+
+// IsTombstone reports whether record marks its key as deleted, which is a
+// record with a key and no value.
+func IsTombstone(record *data.Record) bool {
+	return len(record.Key) > 0 && len(record.Value) == 0
+}
+
+// Compact rewrites every sealed segment so that only the newest record for
+// each key survives. Records without a key are never removed and offsets are
+// preserved, which leaves holes in the offsets of a compacted segment. The
+// last record of a segment is always kept so the segment keeps its place in
+// the offset space. Tombstones are dropped once their segment has not been
+// written to for longer than Compaction.DeleteRetention. Records of open
+// transactions are kept and records of aborted ones are dropped like the
+// older records of their key.
+//
+// Sealed segments are rewritten while holding the read lock, so reads and
+// appends keep going, and then swapped in under the write lock.
+func (l *Log) Compact(now time.Time) error {
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	tmpDir := path.Join(l.Dir, CompactDir)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return failure.ToSystem(err, "os.RemoveAll failed for (%s)", tmpDir)
+	}
+
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return failure.ToSystem(err, "os.MkdirAll failed for (%s)", tmpDir)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	l.mu.RLock()
+	compacted, err := l.compactSealed(tmpDir, now)
+	l.mu.RUnlock()
+	if err != nil {
+		return failure.Wrap(err, "l.compactSealed failed")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// the log may have been closed while the copies were written
+	if err = l.checkOpen(); err != nil {
+		return failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	for _, old := range compacted {
+		if err = l.swapSegment(old, tmpDir); err != nil {
+			return failure.Wrap(err, "l.swapSegment failed (%d)", old.BaseOffset())
+		}
+	}
+
+	return nil
+}
+
+// compactSealed writes a compacted copy of every sealed segment that has
+// something to drop into tmpDir and returns the segments that were copied.
+// The caller must hold at least the read lock.
+func (l *Log) compactSealed(tmpDir string, now time.Time) ([]*Segment, error) {
+	if err := l.checkOpen(); err != nil {
+		return nil, failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	latest := map[string]uint64{}
+	for _, s := range l.segments {
+		err := s.scan(func(_ uint64, record *data.Record) error {
+			// only a committed record can replace what came before it
+			if _, visible := l.transactions.Visibility(record); visible && len(record.Key) > 0 {
+				latest[string(record.Key)] = record.Offset
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, failure.Wrap(err, "s.scan failed (%d)", s.BaseOffset())
+		}
+	}
+
+	var compacted []*Segment
+	for _, s := range l.segments {
+		if s == l.activeSegment {
+			break
+		}
+
+		expired := now.Sub(s.LastModified()) > l.Config.Compaction.DeleteRetention
+		keep := func(record *data.Record) bool {
+			stable, _ := l.transactions.Visibility(record)
+			switch {
+			case record.Offset == s.NextOffset()-1:
+				return true
+			case !stable:
+				return true
+			case len(record.Key) == 0:
+				return true
+			case latest[string(record.Key)] != record.Offset:
+				return false
+			case IsTombstone(record):
+				return !expired
+			}
+			return true
+		}
+
+		seg, dropped, err := s.copyTo(tmpDir, keep)
+		if err != nil {
+			return nil, failure.Wrap(err, "s.copyTo failed (%d)", s.BaseOffset())
+		}
+
+		if err = seg.Close(); err != nil {
+			return nil, failure.Wrap(err, "seg.Close failed (%d)", s.BaseOffset())
+		}
+
+		if dropped == 0 {
+			continue
+		}
+
+		compacted = append(compacted, s)
+	}
+
+	return compacted, nil
+}
+
+// swapSegment replaces old with its compacted copy in tmpDir. The caller must
+// hold the write lock.
+func (l *Log) swapSegment(old *Segment, tmpDir string) error {
+	i := -1
+	for j, s := range l.segments {
+		if s == old {
+			i = j
+			break
+		}
+	}
+
+	// the segment was removed by retention while it was being compacted
+	if i == -1 {
+		return nil
+	}
+
+	base := old.BaseOffset()
+	modTime := old.LastModified()
+	before := old.Size()
+	if err := old.Close(); err != nil {
+		return failure.Wrap(err, "old.Close failed")
+	}
+
+	for _, ext := range []string{StoreExt, IndexExt, TimeIndexExt, KeyExt} {
+		name := segmentName(base, ext)
+		err := os.Rename(path.Join(tmpDir, name), path.Join(l.Dir, name))
+		if ext == KeyExt && os.IsNotExist(err) {
+			// the copy is in plain text, the original's key no longer applies
+			err = os.Remove(path.Join(l.Dir, name))
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return failure.ToSystem(err, "os.Rename failed for (%s)", name)
+		}
+	}
+
+	// keep the age of the data so retention is not reset by compaction
+	storeFile := path.Join(l.Dir, segmentName(base, StoreExt))
+	if err := os.Chtimes(storeFile, modTime, modTime); err != nil {
+		return failure.ToSystem(err, "os.Chtimes failed for (%s)", storeFile)
+	}
+
+	s, err := NewSegment(l.Dir, base, l.Config)
+	if err != nil {
+		return failure.Wrap(err, "NewSegment failed")
+	}
+
+	if err = s.seal(); err != nil {
+		_ = s.Close()
+		return failure.Wrap(err, "s.seal failed")
+	}
+	l.segments[i] = s
+
+	l.Config.Logger.Infow("compaction",
+		"status", "segment compacted",
+		"dir", l.Dir,
+		"base-offset", base,
+		"next-offset", s.NextOffset(),
+		"bytes-before", before,
+		"bytes-after", s.Size(),
+	)
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package log_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rsb/failure"
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+	"github.com/rsb/prolog/business/data/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog_Compact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compact-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := log.Config{}
+	c.Segment.MaxIndexBytes = log.EntWidth * 3
+	c.Compaction.DeleteRetention = time.Hour
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+
+	records := []*data.Record{
+		{Key: []byte("a"), Value: []byte("1")},
+		{Key: []byte("b"), Value: []byte("1")},
+		{Key: []byte("a"), Value: []byte("2")},
+		// segment 3
+		{Key: []byte("a"), Value: []byte("3")},
+		{Key: []byte("b")},
+		{Key: []byte("c"), Value: []byte("1")},
+		// segment 6
+		{Value: []byte("no key")},
+		{Key: []byte("c"), Value: []byte("2")},
+	}
+	for _, rec := range records {
+		_, err = l.Append(rec)
+		require.NoError(t, err)
+	}
+
+	// the tombstone for b is still within its delete retention
+	require.NoError(t, l.Compact(time.Now()))
+	requireOffsets(t, l, []uint64{2, 3, 4, 5, 6, 7}, []uint64{0, 1})
+
+	require.NoError(t, l.Compact(time.Now().Add(2*time.Hour)))
+	requireOffsets(t, l, []uint64{2, 3, 5, 6, 7}, []uint64{0, 1, 4})
+
+	read, err := l.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), read.Value)
+
+	// compacted segments survive a restart
+	require.NoError(t, l.Close())
+	l, err = log.NewLog(dir, c)
+	require.NoError(t, err)
+	requireOffsets(t, l, []uint64{2, 3, 5, 6, 7}, []uint64{0, 1, 4})
+
+	off, err := l.Append(&data.Record{Value: []byte("after")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), off)
+	require.NoError(t, l.Close())
+
+	report, err := log.Verify(dir, log.Config{})
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.Problems)
+}
+
+func requireOffsets(t *testing.T, l *log.Log, found, compacted []uint64) {
+	t.Helper()
+
+	for _, off := range found {
+		read, err := l.Read(off)
+		require.NoError(t, err, off)
+		require.Equal(t, off, read.Offset)
+	}
+
+	for _, off := range compacted {
+		_, err := l.Read(off)
+		require.Error(t, err, off)
+		require.True(t, failure.IsNotFound(err), off)
+	}
+}
@@ -0,0 +1,141 @@
+package log
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/rsb/failure"
+)
+
+// KeyExt is the extension of the file holding the ID of the key a segment's
+// store is encrypted with. A segment without one is stored in plain text.
+const KeyExt = ".key"
+
+// LoadKeyFile reads encryption keys from a JSON file that maps key IDs to
+// base64 encoded AES keys of 16, 24 or 32 bytes.
+func LoadKeyFile(file string) (map[string][]byte, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, failure.ToSystem(err, "ioutil.ReadFile failed for (%s)", file)
+	}
+
+	var encoded map[string]string
+	if err = json.Unmarshal(b, &encoded); err != nil {
+		return nil, failure.ToConfig(err, "json.Unmarshal failed for (%s)", file)
+	}
+
+	keys := map[string][]byte{}
+	for id, v := range encoded {
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, failure.ToConfig(err, "key (%s) in (%s) is not base64", id, file)
+		}
+		keys[id] = key
+	}
+
+	return keys, nil
+}
+
+// applyEncryption rejects a current key that can not be used to encrypt
+func applyEncryption(c *Config) error {
+	id := c.Encryption.KeyID
+	if id == "" {
+		return nil
+	}
+
+	if strings.ContainsAny(id, "\n\r") {
+		return failure.Config("encryption key id (%q) must be a single line", id)
+	}
+
+	if _, err := newAEAD(c, id); err != nil {
+		return failure.Wrap(err, "newAEAD failed")
+	}
+
+	return nil
+}
+
+func newAEAD(c *Config, id string) (cipher.AEAD, error) {
+	key, ok := c.Encryption.Keys[id]
+	if !ok {
+		return nil, failure.Config("encryption key (%s) is not configured", id)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, failure.ToConfig(err, "aes.NewCipher failed for key (%s)", id)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, failure.ToSystem(err, "cipher.NewGCM failed for key (%s)", id)
+	}
+
+	return aead, nil
+}
+
+// segmentCipher returns the cipher a segment's store is encrypted with or
+// nil when it is stored in plain text. A segment records the ID of its key
+// when it is created, so a new segment uses the current key while existing
+// segments keep being read with the key they were written with.
+func segmentCipher(dir string, baseOffset uint64, c Config, empty bool) (cipher.AEAD, error) {
+	id, err := readKeyID(dir, baseOffset)
+	switch {
+	case err != nil:
+		return nil, failure.Wrap(err, "readKeyID failed")
+	case id != "":
+		aead, err := newAEAD(&c, id)
+		if err != nil {
+			return nil, failure.Wrap(err, "newAEAD failed for segment (%d)", baseOffset)
+		}
+		return aead, nil
+	case !empty || c.Encryption.KeyID == "":
+		return nil, nil
+	}
+
+	file := path.Join(dir, segmentName(baseOffset, KeyExt))
+	if err = ioutil.WriteFile(file, []byte(c.Encryption.KeyID+"\n"), 0644); err != nil {
+		return nil, failure.ToSystem(err, "ioutil.WriteFile failed for (%s)", file)
+	}
+
+	aead, err := newAEAD(&c, c.Encryption.KeyID)
+	if err != nil {
+		return nil, failure.Wrap(err, "newAEAD failed for segment (%d)", baseOffset)
+	}
+
+	return aead, nil
+}
+
+// seal encrypts p with a random nonce which is prepended to the result
+func seal(aead cipher.AEAD, p []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(p)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, failure.ToSystem(err, "rand.Reader failed")
+	}
+
+	return aead.Seal(nonce, nonce, p, nil), nil
+}
+
+// open is the reverse of seal
+func open(aead cipher.AEAD, b []byte) ([]byte, error) {
+	n := aead.NonceSize()
+	if len(b) < n+aead.Overhead() {
+		return nil, Corrupt("encrypted record of (%d) bytes is too short", len(b))
+	}
+
+	// the checksum already passed so the bytes are what was written, a
+	// failure here means the key is wrong rather than the data. It is not
+	// reported as corrupt so recovery never truncates a store over it.
+	p, err := aead.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return nil, failure.ToConfig(err, "record can not be decrypted, wrong key")
+	}
+
+	return p, nil
+}
@@ -0,0 +1,144 @@
+package log_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/rsb/failure"
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+	"github.com/rsb/prolog/business/data/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog_Encryption(t *testing.T) {
+	keys := map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 16),
+	}
+	value := []byte("a very secret value")
+
+	for scenario, fn := range map[string]func(t *testing.T, dir string, c log.Config){
+		"store is unreadable without the key": testEncryptedStore,
+		"rotated keys keep old segments":      testKeyRotation,
+		"missing or wrong key is a config error": func(t *testing.T, dir string, c log.Config) {
+			testWrongKey(t, dir, c, value)
+		},
+		"verify decrypts with the configured keys": testVerifyEncrypted,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "crypt-test")
+			require.NoError(t, err)
+			defer func() { _ = os.RemoveAll(dir) }()
+
+			c := log.Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Encryption.KeyID = "k1"
+			c.Encryption.Keys = keys
+
+			l, err := log.NewLog(dir, c)
+			require.NoError(t, err)
+			_, err = l.Append(&data.Record{Value: value})
+			require.NoError(t, err)
+			require.NoError(t, l.Close())
+
+			fn(t, dir, c)
+		})
+	}
+}
+
+func testEncryptedStore(t *testing.T, dir string, c log.Config) {
+	b, err := ioutil.ReadFile(path.Join(dir, "0"+log.StoreExt))
+	require.NoError(t, err)
+	require.NotContains(t, string(b), "a very secret value")
+
+	id, err := ioutil.ReadFile(path.Join(dir, "0"+log.KeyExt))
+	require.NoError(t, err)
+	require.Equal(t, "k1\n", string(id))
+
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	read, err := l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a very secret value"), read.Value)
+}
+
+func testKeyRotation(t *testing.T, dir string, c log.Config) {
+	c.Segment.MaxStoreBytes = 1
+	c.Encryption.KeyID = "k2"
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+
+	off, err := l.Append(&data.Record{Value: []byte("rotated")})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	id, err := ioutil.ReadFile(path.Join(dir, "1"+log.KeyExt))
+	require.NoError(t, err)
+	require.Equal(t, "k2\n", string(id))
+
+	// the current key alone is not enough for the older segment
+	c.Encryption.Keys = map[string][]byte{"k2": c.Encryption.Keys["k2"]}
+	_, err = log.NewLog(dir, c)
+	require.Error(t, err)
+	require.True(t, failure.IsConfig(err))
+
+	c.Encryption.Keys = map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 16),
+	}
+	l, err = log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	read, err := l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a very secret value"), read.Value)
+
+	read, err = l.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("rotated"), read.Value)
+}
+
+func testWrongKey(t *testing.T, dir string, c log.Config, value []byte) {
+	c.Encryption.Keys = map[string][]byte{"k1": bytes.Repeat([]byte{9}, 32)}
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+
+	_, err = l.Read(0)
+	require.Error(t, err)
+	require.True(t, failure.IsConfig(err))
+	require.NoError(t, l.Close())
+
+	// a wrong key must not look like corruption during recovery, the
+	// store would be truncated otherwise.
+	require.NoError(t, os.Remove(path.Join(dir, log.CleanShutdownFile)))
+	_, err = log.NewLog(dir, c)
+	require.Error(t, err)
+	require.True(t, failure.IsConfig(err))
+
+	c.Encryption.Keys = map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)}
+	l, err = log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	read, err := l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, value, read.Value)
+}
+
+func testVerifyEncrypted(t *testing.T, dir string, c log.Config) {
+	report, err := log.Verify(dir, c)
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.Problems)
+	require.Len(t, report.Segments, 1)
+	require.Equal(t, uint64(1), report.Segments[0].Records)
+
+	_, err = log.Verify(dir, log.Config{})
+	require.Error(t, err)
+	require.True(t, failure.IsConfig(err))
+}
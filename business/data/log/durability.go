@@ -0,0 +1,126 @@
+package log
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rsb/failure"
+)
+
+// DurabilityMode decides when appended records are synced to disk, which is
+// what an acknowledged append actually guarantees.
+type DurabilityMode string
+
+const (
+	// DurabilityOS leaves syncing to the operating system. An acknowledged
+	// record survives a crash of the process but not a power loss.
+	DurabilityOS DurabilityMode = "os"
+	// DurabilityAlways syncs every append or batch before it is acknowledged
+	// or seen by readers.
+	DurabilityAlways DurabilityMode = "always"
+	// DurabilityRecords syncs once every Durability.Records records, so at
+	// most that many acknowledged records can be lost on power loss.
+	DurabilityRecords DurabilityMode = "records"
+	// DurabilityInterval syncs every Durability.Interval, so records
+	// acknowledged within the last interval can be lost on power loss.
+	DurabilityInterval DurabilityMode = "interval"
+)
+
+// Durability describes the durability policy in effect for the log so it can
+// be reported back to producers along with their offsets.
+func (l *Log) Durability() string {
+	d := l.Config.Durability
+	switch d.Mode {
+	case DurabilityRecords:
+		return fmt.Sprintf("%s:%d", d.Mode, d.Records)
+	case DurabilityInterval:
+		return fmt.Sprintf("%s:%s", d.Mode, d.Interval)
+	}
+
+	return string(d.Mode)
+}
+
+// Sync commits every record appended so far to stable storage regardless of
+// the durability policy.
+func (l *Log) Sync() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
+		return failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	if err := l.activeSegment.Sync(); err != nil {
+		return failure.Wrap(err, "l.activeSegment.Sync failed")
+	}
+
+	return nil
+}
+
+// Unsynced returns how many bytes of the active segment are not synced to
+// disk yet. Records reach the file as soon as they are published, so the
+// size of the file says nothing about what is on stable storage.
+func (l *Log) Unsynced() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
+		return 0, failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	return l.activeSegment.store.Unsynced(), nil
+}
+
+// applyDurability fills in the durability defaults and rejects policies that
+// can not be honored.
+func applyDurability(c *Config) error {
+	d := &c.Durability
+	switch d.Mode {
+	case "":
+		d.Mode = DurabilityOS
+	case DurabilityOS, DurabilityAlways:
+	case DurabilityRecords:
+		if d.Records == 0 {
+			return failure.Config("durability mode (%s) needs Durability.Records to be set", d.Mode)
+		}
+	case DurabilityInterval:
+		if d.Interval == 0 {
+			d.Interval = DefaultSyncInterval
+		}
+	default:
+		return failure.Config("unknown durability mode (%s)", d.Mode)
+	}
+
+	return nil
+}
+
+// synced applies the durability policy after n records were appended to the
+// active segment. The caller must hold appendMu.
+func (l *Log) synced(n uint64) error {
+	switch l.Config.Durability.Mode {
+	case DurabilityAlways:
+	case DurabilityRecords:
+		l.unsynced += n
+		if l.unsynced < l.Config.Durability.Records {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	if err := l.activeSegment.Sync(); err != nil {
+		return failure.Wrap(err, "l.activeSegment.Sync failed")
+	}
+	l.unsynced = 0
+
+	return nil
+}
+
+// syncEvery is the background task of the interval durability mode
+func (l *Log) syncEvery(_ time.Time) error {
+	if err := l.Sync(); err != nil {
+		return failure.Wrap(err, "l.Sync failed")
+	}
+
+	return nil
+}
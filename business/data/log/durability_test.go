@@ -0,0 +1,95 @@
+package log_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/rsb/failure"
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+	"github.com/rsb/prolog/business/data/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog_Durability(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		mode     log.DurabilityMode
+		records  uint64
+		interval time.Duration
+		want     string
+		// unsynced is how many of the three appends are not on disk right
+		// after they were acknowledged.
+		unsynced int
+	}{
+		"os":       {mode: "", want: "os", unsynced: 3},
+		"always":   {mode: log.DurabilityAlways, want: "always", unsynced: 0},
+		"records":  {mode: log.DurabilityRecords, records: 2, want: "records:2", unsynced: 1},
+		"interval": {mode: log.DurabilityInterval, interval: time.Hour, want: "interval:1h0m0s", unsynced: 3},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "durability-test")
+			require.NoError(t, err)
+			defer func() { _ = os.RemoveAll(dir) }()
+
+			c := log.Config{}
+			c.Durability.Mode = tc.mode
+			c.Durability.Records = tc.records
+			c.Durability.Interval = tc.interval
+			l, err := log.NewLog(dir, c)
+			require.NoError(t, err)
+			defer func() { _ = l.Close() }()
+			require.Equal(t, tc.want, l.Durability())
+
+			// a new store only holds its header
+			fi, err := os.Stat(path.Join(dir, "0"+log.StoreExt))
+			require.NoError(t, err)
+			sizes := []int64{fi.Size()}
+			for i := 0; i < 3; i++ {
+				_, err = l.Append(&data.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+
+				fi, err := os.Stat(path.Join(dir, "0"+log.StoreExt))
+				require.NoError(t, err)
+				sizes = append(sizes, fi.Size())
+			}
+
+			// every acknowledged append is published to readers, so it is in
+			// the file whether or not it was synced
+			for i := 1; i < len(sizes); i++ {
+				require.Greater(t, sizes[i], sizes[i-1])
+			}
+
+			unsynced, err := l.Unsynced()
+			require.NoError(t, err)
+			require.Equal(t, uint64(sizes[3]-sizes[3-tc.unsynced]), unsynced)
+
+			require.NoError(t, l.Sync())
+			unsynced, err = l.Unsynced()
+			require.NoError(t, err)
+			require.Zero(t, unsynced)
+			fi, err = os.Stat(path.Join(dir, "0"+log.StoreExt))
+			require.NoError(t, err)
+			indexes := 3 * (log.EntWidth + log.TimeEntWidth)
+			require.Equal(t, int64(l.Size()-indexes), fi.Size())
+		})
+	}
+}
+
+func TestLog_DurabilityConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "durability-config-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := log.Config{}
+	c.Durability.Mode = "sometimes"
+	_, err = log.NewLog(dir, c)
+	require.Error(t, err)
+	require.True(t, failure.IsConfig(err))
+
+	c.Durability.Mode = log.DurabilityRecords
+	_, err = log.NewLog(dir, c)
+	require.Error(t, err)
+	require.True(t, failure.IsConfig(err))
+}
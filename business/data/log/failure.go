@@ -0,0 +1,57 @@
+package log
+
+import (
+	"errors"
+
+	"github.com/rsb/failure"
+)
+
+const (
+	CorruptMsg = "corrupt record failure"
+	ClosedMsg  = "closed log failure"
+	LockedMsg  = "locked log failure"
+
+	corruptErr = kind(CorruptMsg)
+	closedErr  = kind(ClosedMsg)
+	lockedErr  = kind(LockedMsg)
+)
+
+// kind mirrors the opaque error pattern used by github.com/rsb/failure for
+// failures that only make sense inside the log.
+type kind string
+
+func (k kind) Error() string {
+	return string(k)
+}
+
+// Corrupt is used to signal that the bytes read back from disk are not the
+// bytes that were written, either because the checksum does not match or the
+// frame around the record is damaged. It lets callers tell bad data apart
+// from an offset that is simply out of range.
+func Corrupt(format string, a ...interface{}) error {
+	return failure.Wrap(corruptErr, format, a...)
+}
+
+func IsCorrupt(e error) bool {
+	return errors.Is(e, corruptErr)
+}
+
+// Closed is used to signal that an operation was attempted on a log after it
+// was closed, instead of letting it run into closed files.
+func Closed(format string, a ...interface{}) error {
+	return failure.Wrap(closedErr, format, a...)
+}
+
+func IsClosed(e error) bool {
+	return errors.Is(e, closedErr)
+}
+
+// Locked is used to signal that the directory of a log is held by another
+// process, which must close the log before it can be opened again.
+func Locked(format string, a ...interface{}) error {
+	return failure.Wrap(lockedErr, format, a...)
+}
+
+func IsLocked(e error) bool {
+	return errors.Is(e, lockedErr)
+}
@@ -0,0 +1,213 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/rsb/failure"
+)
+
+// Every segment file starts with a header made of a magic number, which
+// tells what kind of file it is, followed by the version of its layout.
+// Files written before the header existed have neither. None of them can be
+// mistaken for a header: a store starts with the length of its first
+// record, an index with relative offset zero and a time index with a
+// timestamp that is decades away from starting with a magic byte.
+//
+// A store without a header is either Version0 or Version1, storeFormat tells
+// them apart by the checksum of the first frame. Indexes without a header
+// are read as Version1, their layout never changed.
+const (
+	// Version0 is the layout of stores written before records carried a
+	// checksum. They have no header and their frames are [length][record].
+	// The log does not open them, Migrate converts them.
+	Version0 uint32 = 0
+	// Version1 is the layout of files without a header written once records
+	// carried a checksum. Store frames are [length][crc32][record] and index
+	// entries [offset][position].
+	Version1 uint32 = 1
+	// Version2 is Version1 with the header in front of it. Store positions
+	// in the index are still positions in the file, so the first record of
+	// a store is found right after its header.
+	Version2 uint32 = 2
+	// CurrentVersion is the version new files are written with
+	CurrentVersion = Version2
+
+	MagicWidth   = 4
+	VersionWidth = 4
+	HeaderWidth  = MagicWidth + VersionWidth
+)
+
+var (
+	StoreMagic     = []byte("PLST")
+	IndexMagic     = []byte("PLIX")
+	TimeIndexMagic = []byte("PLTI")
+
+	// headerWidths is how many bytes the header of each supported version
+	// takes up. A file is read according to the entry for its version.
+	headerWidths = map[uint32]uint64{
+		Version1: 0,
+		Version2: HeaderWidth,
+	}
+)
+
+// FileFormat is the layout a segment file was written with
+type FileFormat struct {
+	Version uint32
+	// Header is the number of bytes in front of the file's data
+	Header uint64
+}
+
+// ParseFormat reads the format from the start of a file's content, b may
+// be shorter than a header. It fails with failure.Config for versions this
+// build does not know how to read.
+func ParseFormat(b []byte, magic []byte) (FileFormat, error) {
+	if len(b) < HeaderWidth || !bytes.Equal(b[:MagicWidth], magic) {
+		return FileFormat{Version: Version1}, nil
+	}
+
+	v := Enc.Uint32(b[MagicWidth:HeaderWidth])
+	width, ok := headerWidths[v]
+	if !ok {
+		return FileFormat{}, failure.Config("format version (%d) is not supported", v)
+	}
+
+	return FileFormat{Version: v, Header: width}, nil
+}
+
+// readFormat reads the format from the header of f
+func readFormat(f *os.File, magic []byte) (FileFormat, error) {
+	b := make([]byte, HeaderWidth)
+	n, err := f.ReadAt(b, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return FileFormat{}, failure.ToSystem(err, "f.ReadAt failed for (%s)", f.Name())
+	}
+
+	format, err := ParseFormat(b[:n], magic)
+	if err != nil {
+		return format, failure.Wrap(err, "ParseFormat failed for (%s)", f.Name())
+	}
+
+	return format, nil
+}
+
+// storeFormat reads the format of a store. A store without a header is
+// Version1 when its first frame carries a valid checksum and Version0 when
+// frames without a checksum fill it exactly. known is false when it is
+// neither, its first frame was torn or damaged and the store can not be
+// read without guessing its layout.
+func storeFormat(f *os.File) (format FileFormat, known bool, err error) {
+	if format, err = readFormat(f, StoreMagic); err != nil {
+		return format, false, failure.Wrap(err, "readFormat failed")
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return format, false, failure.ToSystem(err, "f.Stat failed for (%s)", f.Name())
+	}
+
+	size := uint64(fi.Size())
+	if format.Header > 0 || size == 0 {
+		return format, true, nil
+	}
+
+	ok, err := firstFrameValid(f, size)
+	if err != nil {
+		return format, false, failure.Wrap(err, "firstFrameValid failed")
+	}
+	if ok {
+		return format, true, nil
+	}
+
+	end, err := legacyFramesEnd(f, size)
+	if err != nil {
+		return format, false, failure.Wrap(err, "legacyFramesEnd failed")
+	}
+	if end == size {
+		return FileFormat{Version: Version0}, true, nil
+	}
+
+	return format, false, nil
+}
+
+// firstFrameValid reports whether the store starts with a complete
+// [length][crc32][record] frame whose checksum matches
+func firstFrameValid(f *os.File, size uint64) (bool, error) {
+	if size < FrameWidth {
+		return false, nil
+	}
+
+	header := make([]byte, FrameWidth)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return false, failure.ToSystem(err, "f.ReadAt failed for (%s)", f.Name())
+	}
+
+	n := Enc.Uint64(header[:LenWidth])
+	if n > size-FrameWidth {
+		return false, nil
+	}
+
+	b := make([]byte, n)
+	if _, err := f.ReadAt(b, FrameWidth); err != nil {
+		return false, failure.ToSystem(err, "f.ReadAt failed for (%s)", f.Name())
+	}
+
+	return crc32.ChecksumIEEE(b) == Enc.Uint32(header[LenWidth:]), nil
+}
+
+// legacyFramesEnd walks the [length][record] frames of a Version0 store and
+// returns the position after the last complete one
+func legacyFramesEnd(f *os.File, size uint64) (uint64, error) {
+	var pos uint64
+	b := make([]byte, LenWidth)
+	for pos+LenWidth <= size {
+		if _, err := f.ReadAt(b, int64(pos)); err != nil {
+			return 0, failure.ToSystem(err, "f.ReadAt failed for (%s)", f.Name())
+		}
+
+		n := Enc.Uint64(b)
+		if n > size-pos-LenWidth {
+			break
+		}
+		pos += LenWidth + n
+	}
+
+	return pos, nil
+}
+
+// header returns the header of a file of the current version
+func header(magic []byte) []byte {
+	b := make([]byte, HeaderWidth)
+	copy(b, magic)
+	Enc.PutUint32(b[MagicWidth:], CurrentVersion)
+	return b
+}
+
+// openSegmentFile opens a segment file, creating it with the header of the
+// current version when it does not exist or is empty.
+func openSegmentFile(name string, flag int, magic []byte) (*os.File, error) {
+	f, err := os.OpenFile(name, flag|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, failure.ToSystem(err, "os.OpenFile failed for (%s)", name)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, failure.ToSystem(err, "f.Stat failed for (%s)", name)
+	}
+
+	if fi.Size() > 0 {
+		return f, nil
+	}
+
+	if _, err = f.Write(header(magic)); err != nil {
+		_ = f.Close()
+		return nil, failure.ToSystem(err, "f.Write failed for header of (%s)", name)
+	}
+
+	return f, nil
+}
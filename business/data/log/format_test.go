@@ -0,0 +1,286 @@
+package log_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/rsb/failure"
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+	"github.com/rsb/prolog/business/data/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseFormat(t *testing.T) {
+	f, err := log.ParseFormat([]byte("PLST\x00\x00\x00\x02"), log.StoreMagic)
+	require.NoError(t, err)
+	require.Equal(t, log.FileFormat{Version: log.Version2, Header: log.HeaderWidth}, f)
+
+	// a headerless file starts with data, not with the magic
+	f, err = log.ParseFormat([]byte{0, 0, 0, 0, 0, 0, 0, 9}, log.StoreMagic)
+	require.NoError(t, err)
+	require.Equal(t, log.FileFormat{Version: log.Version1}, f)
+
+	f, err = log.ParseFormat(nil, log.IndexMagic)
+	require.NoError(t, err)
+	require.Equal(t, log.Version1, f.Version)
+
+	_, err = log.ParseFormat([]byte("PLST\x00\x00\x00\x63"), log.StoreMagic)
+	require.Error(t, err)
+	require.True(t, failure.IsConfig(err))
+}
+
+func TestLog_Format(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, dir string){
+		"new files start with a header":     testNewFileHeader,
+		"unknown version fails to open":     testUnknownVersion,
+		"legacy segments stay readable":     testLegacyReadable,
+		"migrate upgrades legacy segments":  testMigrate,
+		"checksumless segments are refused": testVersion0Refused,
+		"migrate adds checksums":            testMigrateVersion0,
+		"migrate refuses to truncate":       testMigrateTruncation,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "format-test")
+			require.NoError(t, err)
+			defer func() { _ = os.RemoveAll(dir) }()
+
+			fn(t, dir)
+		})
+	}
+}
+
+func testNewFileHeader(t *testing.T, dir string) {
+	l, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	_, err = l.Append(&data.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	for ext, magic := range map[string][]byte{
+		log.StoreExt:     log.StoreMagic,
+		log.IndexExt:     log.IndexMagic,
+		log.TimeIndexExt: log.TimeIndexMagic,
+	} {
+		b, err := ioutil.ReadFile(path.Join(dir, "0"+ext))
+		require.NoError(t, err)
+		f, err := log.ParseFormat(b, magic)
+		require.NoError(t, err)
+		require.Equal(t, log.CurrentVersion, f.Version, ext)
+	}
+
+	report, err := log.Verify(dir, log.Config{})
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.Problems)
+	require.Equal(t, log.CurrentVersion, report.Segments[0].Version)
+}
+
+func testUnknownVersion(t *testing.T, dir string) {
+	l, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	_, err = l.Append(&data.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	f, err := os.OpenFile(path.Join(dir, "0"+log.StoreExt), os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0, 0, 0, 99}, log.MagicWidth)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = log.NewLog(dir, log.Config{})
+	require.Error(t, err)
+	require.True(t, failure.IsConfig(err))
+}
+
+// writeLegacyLog writes the stores of a log the way they were written before
+// files had a header, with two records in the first segment and one in the
+// second, and no indexes.
+func writeLegacyLog(t *testing.T, dir string) {
+	for base, offsets := range map[uint64][]uint64{0: {0, 1}, 2: {2}} {
+		f, err := os.OpenFile(path.Join(dir, fmt.Sprintf("%d%s", base, log.StoreExt)), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		require.NoError(t, err)
+		store, err := log.NewStore(f)
+		require.NoError(t, err)
+
+		for _, off := range offsets {
+			b, err := proto.Marshal(&data.Record{
+				Value:     []byte(fmt.Sprintf("legacy-%d", off)),
+				Offset:    off,
+				Timestamp: time.Now().UnixNano(),
+			})
+			require.NoError(t, err)
+			_, _, err = store.Append(b)
+			require.NoError(t, err)
+		}
+		require.NoError(t, store.Close())
+	}
+}
+
+func requireLegacyRecords(t *testing.T, l *log.Log) {
+	for off := uint64(0); off < 3; off++ {
+		read, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("legacy-%d", off)), read.Value)
+	}
+}
+
+func testLegacyReadable(t *testing.T, dir string) {
+	writeLegacyLog(t, dir)
+
+	l, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	requireLegacyRecords(t, l)
+
+	off, err := l.Append(&data.Record{Value: []byte("new")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.NoError(t, l.Close())
+
+	report, err := log.Verify(dir, log.Config{})
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.Problems)
+	require.Equal(t, log.Version1, report.Segments[0].Version)
+}
+
+func testMigrate(t *testing.T, dir string) {
+	writeLegacyLog(t, dir)
+
+	old := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	store := path.Join(dir, "0"+log.StoreExt)
+	require.NoError(t, os.Chtimes(store, old, old))
+
+	report, err := log.Migrate(dir, log.Config{}, false)
+	require.NoError(t, err)
+	require.Len(t, report.Segments, 2)
+	require.Equal(t, log.Version1, report.Segments[0].From)
+	require.Equal(t, uint64(2), report.Segments[0].NextOffset)
+	require.Equal(t, uint64(3), report.Segments[1].NextOffset)
+
+	// retention is based on the age of the store, migrating must not reset it
+	fi, err := os.Stat(store)
+	require.NoError(t, err)
+	require.True(t, fi.ModTime().Equal(old))
+
+	verify, err := log.Verify(dir, log.Config{})
+	require.NoError(t, err)
+	require.True(t, verify.OK(), verify.Problems)
+	for _, seg := range verify.Segments {
+		require.Equal(t, log.CurrentVersion, seg.Version)
+	}
+
+	// a second run has nothing left to do
+	report, err = log.Migrate(dir, log.Config{}, false)
+	require.NoError(t, err)
+	require.Empty(t, report.Segments)
+
+	l, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	requireLegacyRecords(t, l)
+}
+
+// writeVersion0Log writes a log the way it was written before records had
+// checksums: headerless stores of [length][record] frames next to headerless
+// indexes, two records in the first segment and one in the second.
+func writeVersion0Log(t *testing.T, dir string) {
+	for base, offsets := range map[uint64][]uint64{0: {0, 1}, 2: {2}} {
+		var store, index []byte
+		for _, off := range offsets {
+			b, err := proto.Marshal(&data.Record{
+				Value:  []byte(fmt.Sprintf("legacy-%d", off)),
+				Offset: off,
+			})
+			require.NoError(t, err)
+
+			entry := make([]byte, log.EntWidth)
+			log.Enc.PutUint32(entry, uint32(off-base))
+			log.Enc.PutUint64(entry[log.OffWidth:], uint64(len(store)))
+			index = append(index, entry...)
+
+			frame := make([]byte, log.LenWidth)
+			log.Enc.PutUint64(frame, uint64(len(b)))
+			store = append(store, append(frame, b...)...)
+		}
+
+		name := path.Join(dir, fmt.Sprintf("%d", base))
+		require.NoError(t, ioutil.WriteFile(name+log.StoreExt, store, 0644))
+		require.NoError(t, ioutil.WriteFile(name+log.IndexExt, index, 0644))
+	}
+}
+
+func testVersion0Refused(t *testing.T, dir string) {
+	writeVersion0Log(t, dir)
+	before, err := ioutil.ReadFile(path.Join(dir, "0"+log.StoreExt))
+	require.NoError(t, err)
+
+	_, err = log.NewLog(dir, log.Config{})
+	require.True(t, failure.IsConfig(err), err)
+	require.Contains(t, err.Error(), "migrate")
+
+	// opening must not touch the data, nothing was recognized as damaged
+	after, err := ioutil.ReadFile(path.Join(dir, "0"+log.StoreExt))
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
+
+func testMigrateVersion0(t *testing.T, dir string) {
+	writeVersion0Log(t, dir)
+
+	report, err := log.Migrate(dir, log.Config{}, false)
+	require.NoError(t, err)
+	require.Len(t, report.Segments, 2)
+	for _, seg := range report.Segments {
+		require.Equal(t, log.Version0, seg.From)
+		require.Zero(t, seg.TruncatedBytes)
+	}
+
+	verify, err := log.Verify(dir, log.Config{})
+	require.NoError(t, err)
+	require.True(t, verify.OK(), verify.Problems)
+
+	l, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	requireLegacyRecords(t, l)
+}
+
+func testMigrateTruncation(t *testing.T, dir string) {
+	writeVersion0Log(t, dir)
+
+	// a torn frame at the end leaves the layout of the store uncertain
+	store := path.Join(dir, "0"+log.StoreExt)
+	f, err := os.OpenFile(store, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 9})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	before, err := ioutil.ReadFile(store)
+	require.NoError(t, err)
+
+	_, err = log.NewLog(dir, log.Config{})
+	require.True(t, failure.IsConfig(err), err)
+
+	report, err := log.Migrate(dir, log.Config{}, false)
+	require.True(t, failure.IsValidation(err), err)
+	require.Equal(t, uint64(3), report.Truncated())
+
+	after, err := ioutil.ReadFile(store)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+
+	report, err = log.Migrate(dir, log.Config{}, true)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), report.Truncated())
+	require.Equal(t, log.Version0, report.Segments[0].From)
+
+	l, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+	requireLegacyRecords(t, l)
+}
@@ -3,6 +3,8 @@ package log
 import (
 	"io"
 	"os"
+	"sort"
+	"sync/atomic"
 
 	"github.com/rsb/failure"
 
@@ -18,7 +20,12 @@ var (
 type Index struct {
 	file *os.File
 	mmap gommap.MMap
-	size uint64
+	// data is the part of mmap after the file's header
+	data gommap.MMap
+	// size is written by the appender and read by readers without a lock,
+	// an entry is written before size moves past it
+	size   atomic.Uint64
+	format FileFormat
 }
 
 func NewIndex(f *os.File, c Config) (*Index, error) {
@@ -31,8 +38,13 @@ func NewIndex(f *os.File, c Config) (*Index, error) {
 		return nil, failure.ToSystem(err, "os.Stat failed")
 	}
 
-	idx.size = uint64(fi.Size())
-	if err = os.Truncate(f.Name(), int64(c.Segment.MaxIndexBytes)); err != nil {
+	if idx.format, err = readFormat(f, IndexMagic); err != nil {
+		return nil, failure.Wrap(err, "readFormat failed")
+	}
+
+	// the header does not count against MaxIndexBytes
+	idx.size.Store(uint64(fi.Size()) - idx.format.Header)
+	if err = os.Truncate(f.Name(), int64(idx.format.Header+c.Segment.MaxIndexBytes)); err != nil {
 		return nil, failure.ToSystem(err, "os.Truncate failed")
 	}
 
@@ -40,6 +52,7 @@ func NewIndex(f *os.File, c Config) (*Index, error) {
 	if err != nil {
 		return nil, failure.ToSystem(err, "gommap.Map failed")
 	}
+	idx.data = idx.mmap[idx.format.Header:]
 
 	return &idx, nil
 }
@@ -54,7 +67,7 @@ func (i *Index) Close() error {
 		return failure.ToSystem(err, "i.file.Sync failed")
 	}
 
-	if err = i.file.Truncate(int64(i.size)); err != nil {
+	if err = i.file.Truncate(int64(i.format.Header + i.size.Load())); err != nil {
 		return failure.ToSystem(err, "i.file.Truncate failed")
 	}
 
@@ -69,37 +82,81 @@ func (i *Index) Read(in int64) (uint32, uint64, error) {
 	var out uint32
 	var pos uint64
 
-	if i.size == 0 {
+	size := i.size.Load()
+	if size == 0 {
 		return out, pos, io.EOF
 	}
 
 	out = uint32(in)
 	if in == -1 {
-		out = uint32((i.size / EntWidth) - 1)
+		out = uint32((size / EntWidth) - 1)
 	}
 
 	pos = uint64(out) * EntWidth
-	if i.size < pos+EntWidth {
+	if size < pos+EntWidth {
 		return 0, 0, io.EOF
 	}
 
-	out = Enc.Uint32(i.mmap[pos : pos+OffWidth])
-	pos = Enc.Uint64(i.mmap[pos+OffWidth : pos+EntWidth])
+	out = Enc.Uint32(i.data[pos : pos+OffWidth])
+	pos = Enc.Uint64(i.data[pos+OffWidth : pos+EntWidth])
 
 	return out, pos, nil
 }
 
 func (i *Index) Write(off uint32, pos uint64) error {
-	if uint64(len(i.mmap)) < i.size+EntWidth {
+	size := i.size.Load()
+	if uint64(len(i.data)) < size+EntWidth {
 		return io.EOF
 	}
 
-	Enc.PutUint32(i.mmap[i.size:i.size+OffWidth], off)
-	Enc.PutUint64(i.mmap[i.size+OffWidth:i.size+EntWidth], pos)
-	i.size += uint64(EntWidth)
+	Enc.PutUint32(i.data[size:size+OffWidth], off)
+	Enc.PutUint64(i.data[size+OffWidth:size+EntWidth], pos)
+	i.size.Store(size + EntWidth)
 	return nil
 }
 
+// Find returns the store position of the entry for the relative offset off.
+// Entries are always sorted by offset but after compaction they are no longer
+// contiguous, so the entries are binary searched. It returns io.EOF when the
+// index has no entry for off.
+func (i *Index) Find(off uint32) (uint64, error) {
+	n := int(i.size.Load() / EntWidth)
+	j := sort.Search(n, func(j int) bool {
+		pos := uint64(j) * EntWidth
+		return Enc.Uint32(i.data[pos:pos+OffWidth]) >= off
+	})
+	if j == n {
+		return 0, io.EOF
+	}
+
+	pos := uint64(j) * EntWidth
+	if Enc.Uint32(i.data[pos:pos+OffWidth]) != off {
+		return 0, io.EOF
+	}
+
+	return Enc.Uint64(i.data[pos+OffWidth : pos+EntWidth]), nil
+}
+
+// Floor returns the entry with the highest relative offset that is not
+// above off. It returns io.EOF when every entry is above off.
+func (i *Index) Floor(off uint32) (uint32, uint64, error) {
+	n := int(i.size.Load() / EntWidth)
+	j := sort.Search(n, func(j int) bool {
+		pos := uint64(j) * EntWidth
+		return Enc.Uint32(i.data[pos:pos+OffWidth]) > off
+	})
+	if j == 0 {
+		return 0, 0, io.EOF
+	}
+
+	return i.Read(int64(j - 1))
+}
+
+// Reset drops every entry from the index so it can be rebuilt from the store.
+func (i *Index) Reset() {
+	i.size.Store(0)
+}
+
 func (i *Index) Name() string {
 	return i.file.Name()
 }
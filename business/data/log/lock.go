@@ -0,0 +1,37 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/rsb/failure"
+)
+
+// LockFile is locked by whoever has the log's directory open, so a second
+// process such as the log commands of the cli can not work on a log that is
+// being served.
+const LockFile = ".lock"
+
+// lockDir takes the exclusive lock of dir. It fails with Locked when another
+// process holds it, the lock is released when the returned file is closed.
+func lockDir(dir string) (*os.File, error) {
+	file := path.Join(dir, LockFile)
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, failure.ToSystem(err, "os.OpenFile failed for (%s)", file)
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		_ = f.Close()
+		return nil, Locked("log (%s) is open in another process", dir)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, failure.ToSystem(err, "syscall.Flock failed for (%s)", file)
+	}
+
+	return f, nil
+}
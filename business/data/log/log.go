@@ -1,27 +1,48 @@
 package log
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"io"
-	"io/ioutil"
 	"os"
 	"path"
-	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"time"
 
 	data "github.com/rsb/prolog/app/api/handlers/v1"
 
 	"github.com/rsb/failure"
+	"go.uber.org/zap"
 )
 
 const (
 	// LenWidth number of bytes used to Store the record's length
-	LenWidth             = 8
+	LenWidth = 8
+	// CrcWidth number of bytes used to Store the record's CRC32 checksum
+	CrcWidth = 4
+	// FrameWidth number of bytes written in front of every record in the Store
+	FrameWidth = LenWidth + CrcWidth
+
 	DefaultMaxStoreBytes = 1024
 	DefaultMaxIndexBytes = 1024
+
+	DefaultRetentionCheckInterval = time.Minute
+	DefaultCompactionInterval     = 10 * time.Minute
+	DefaultSyncInterval           = time.Second
+	DefaultOffloadInterval        = time.Minute
+	DefaultTierCacheSegments      = 2
+
+	StoreExt = ".store"
+	IndexExt = ".index"
+	// TimeIndexExt is the extension of the file mapping append timestamps to
+	// offsets in a segment.
+	TimeIndexExt = ".timeindex"
+
+	// CleanShutdownFile is written to the log directory by Close. When it is
+	// missing on startup the log assumes it crashed and rebuilds every
+	// segment's index from its store.
+	CleanShutdownFile = ".clean_shutdown"
 )
 
 var (
@@ -34,15 +55,119 @@ type Config struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// MaxAge seals the active segment once its first record is older
+		// than this, even when it is not full, so retention can delete it.
+		// Zero only rolls segments on size.
+		MaxAge time.Duration
+		// IndexIntervalBytes makes the indexes sparse: a record is only
+		// indexed once this many store bytes were written since the last
+		// indexed record, and reads scan the store forward from the nearest
+		// entry. Zero indexes every record.
+		IndexIntervalBytes uint64
+	}
+	Retention struct {
+		// MaxAge is how long a sealed segment is kept after its newest
+		// record was appended. Zero keeps segments forever.
+		MaxAge time.Duration
+		// MaxLogBytes caps the sum of the store and index sizes of every
+		// segment. Zero means the log may grow without bound.
+		MaxLogBytes uint64
+		// CheckInterval is how often the retention policy is enforced
+		CheckInterval time.Duration
+	}
+	Compaction struct {
+		// Enabled turns on the background compaction of sealed segments
+		Enabled bool
+		// DeleteRetention is how long a tombstone survives compaction after
+		// its segment was last written to.
+		DeleteRetention time.Duration
+		// Interval is how often sealed segments are compacted
+		Interval time.Duration
+	}
+	Durability struct {
+		// Mode decides when appended records are synced to disk, it defaults
+		// to DurabilityOS.
+		Mode DurabilityMode
+		// Records is how many records are appended between syncs in the
+		// DurabilityRecords mode.
+		Records uint64
+		// Interval is how often the log is synced in the DurabilityInterval
+		// mode.
+		Interval time.Duration
 	}
+	Tier struct {
+		// Blobs is the remote tier sealed segments are offloaded to, nil
+		// keeps every segment on local disk. Retention only applies to the
+		// local tier, data in the remote tier is expected to be expired by
+		// the blob store itself.
+		Blobs BlobStore
+		// KeepLocal is how many of the newest sealed segments are kept on
+		// local disk after they were uploaded.
+		KeepLocal int
+		// CacheSegments is how many remote segments are kept on local disk
+		// after they were fetched for a read.
+		CacheSegments int
+		// Interval is how often sealed segments are offloaded
+		Interval time.Duration
+	}
+	Encryption struct {
+		// KeyID is the key new segments are encrypted with, empty leaves
+		// new segments in plain text.
+		KeyID string
+		// Keys holds every key by its ID. Keys that were rotated out must
+		// stay here for as long as segments encrypted with them exist.
+		Keys map[string][]byte
+	}
+	Transaction struct {
+		// Timeout is how long a transaction may stay open before it is
+		// aborted
+		Timeout time.Duration
+	}
+	// NoBackground opens the log without its background tasks, retention,
+	// compaction, rolling, transaction timeouts, interval syncs and
+	// offloading then only happen when they are called. Tools that open a
+	// log briefly use it.
+	NoBackground bool
+	Logger       *zap.SugaredLogger
 }
 
+// Log is a commit log made of segments. Readers take the read lock and only
+// see records once they are published. Appends are serialized by appendMu
+// and write under the read lock as well, so readers carry on while records
+// are written, and only take the write lock to roll a segment. Anything
+// that changes the active segment holds appendMu before the write lock.
 type Log struct {
 	mu            sync.RWMutex
+	appendMu      sync.Mutex
 	Dir           string
 	Config        Config
 	activeSegment *Segment
 	segments      []*Segment
+	compactMu     sync.Mutex
+	// remote holds the segments in the remote tier sorted by base offset,
+	// cache the remote segments fetched for reads which tierMu guards along
+	// with cacheClosed. Remote segments are fetched without the log's lock.
+	remote      []remoteSegment
+	tierMu      sync.Mutex
+	cache       []*Segment
+	cacheClosed bool
+	unsynced    uint64
+	// producers is the state of the idempotent producers, appendMu guards
+	// it. transactions guards itself, readers check it.
+	producers    *Producers
+	transactions *Transactions
+	// appended is closed and replaced every time records are published to
+	// wake up readers waiting in ReadNext, notifyMu guards it.
+	appended chan struct{}
+	notifyMu sync.Mutex
+	closed   bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+	// bgMu guards done so concurrent Close calls stop the background tasks
+	// once
+	bgMu sync.Mutex
+	// lock holds the lock of LockFile while the log is open
+	lock *os.File
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -54,137 +179,780 @@ func NewLog(dir string, c Config) (*Log, error) {
 		c.Segment.MaxIndexBytes = DefaultMaxIndexBytes
 	}
 
+	if c.Retention.CheckInterval == 0 {
+		c.Retention.CheckInterval = DefaultRetentionCheckInterval
+	}
+
+	if c.Compaction.Interval == 0 {
+		c.Compaction.Interval = DefaultCompactionInterval
+	}
+
+	if c.Tier.CacheSegments == 0 {
+		c.Tier.CacheSegments = DefaultTierCacheSegments
+	}
+
+	if c.Tier.Interval == 0 {
+		c.Tier.Interval = DefaultOffloadInterval
+	}
+
+	if c.Transaction.Timeout == 0 {
+		c.Transaction.Timeout = DefaultTransactionTimeout
+	}
+
+	if c.Logger == nil {
+		c.Logger = zap.NewNop().Sugar()
+	}
+
+	if err := applyDurability(&c); err != nil {
+		return nil, failure.Wrap(err, "applyDurability failed")
+	}
+
+	if err := applyEncryption(&c); err != nil {
+		return nil, failure.Wrap(err, "applyEncryption failed")
+	}
+
 	l := Log{
-		Dir:    dir,
-		Config: c,
+		Dir:      dir,
+		Config:   c,
+		appended: make(chan struct{}),
 	}
 
-	if err := l.setup(); err != nil {
-		return nil, failure.Wrap(err, "l.setup failed")
+	if err := l.open(); err != nil {
+		return nil, failure.Wrap(err, "l.open failed")
 	}
 
+	l.start()
+
+	c.Logger.Infow("log",
+		"status", "opened",
+		"dir", dir,
+		"durability", l.Durability(),
+	)
+
 	return &l, nil
 }
 
+// open takes the lock of the log's directory and sets the log up. The lock
+// is released again when the log can not be set up.
+func (l *Log) open() error {
+	lock, err := lockDir(l.Dir)
+	if err != nil {
+		return failure.Wrap(err, "lockDir failed")
+	}
+
+	if err = l.setup(); err != nil {
+		_ = lock.Close()
+		return failure.Wrap(err, "l.setup failed")
+	}
+	l.lock = lock
+
+	return nil
+}
+
 func (l *Log) setup() error {
-	files, err := ioutil.ReadDir(l.Dir)
+	clean, err := l.takeCleanMarker()
 	if err != nil {
-		return failure.Wrap(err, "ioutil.ReadDir failed")
+		return failure.Wrap(err, "l.takeCleanMarker failed")
 	}
 
-	var baseOffsets []uint64
-	for _, file := range files {
-		offStr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
+	// a compaction, migration or state file that was interrupted never
+	// replaced what it was written for and the cache of remote segments is
+	// rebuilt on demand
+	for _, dir := range []string{CompactDir, MigrateDir, TierCacheDir, stateTmpFile} {
+		if err = os.RemoveAll(path.Join(l.Dir, dir)); err != nil {
+			return failure.ToSystem(err, "os.RemoveAll failed for (%s)", dir)
+		}
+	}
 
-		off, err := strconv.ParseUint(offStr, 10, 0)
-		if err != nil {
-			return failure.Wrap(err, "strconv.ParseUint failed")
+	l.tierMu.Lock()
+	l.cacheClosed = false
+	l.tierMu.Unlock()
+
+	if l.isTiered() {
+		if err = l.loadRemote(); err != nil {
+			return failure.Wrap(err, "l.loadRemote failed")
 		}
-		baseOffsets = append(baseOffsets, off)
 	}
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
 
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
-			return failure.Wrap(err, "l.newSegment failed for (%d)", baseOffsets[i])
+	// the store is the source of truth for a segment, the index can always
+	// be rebuilt from it, so segments are discovered by their store files.
+	baseOffsets, _, err := segmentFiles(l.Dir)
+	if err != nil {
+		return failure.Wrap(err, "segmentFiles failed")
+	}
+
+	for _, off := range baseOffsets {
+		if err = l.newSegment(off); err != nil {
+			return failure.Wrap(err, "l.newSegment failed for (%d)", off)
+		}
+
+		if clean {
+			continue
+		}
+
+		if _, err = l.activeSegment.Recover(); err != nil {
+			return failure.Wrap(err, "l.activeSegment.Recover failed for (%d)", off)
 		}
-		// baseOffset contains dup for index and store so we skip the dup.
-		i++
 	}
 
 	if l.segments == nil {
-		if err = l.newSegment(l.Config.Segment.InitialOffset); err != nil {
-			return failure.Wrap(err, "l.newSegment failed for (%d)", l.Config.Segment.InitialOffset)
+		// a log whose local disk was lost carries on after the remote tier
+		off := l.Config.Segment.InitialOffset
+		if n := len(l.remote); n > 0 {
+			off = l.remote[n-1].nextOffset
+		}
+
+		if err = l.newSegment(off); err != nil {
+			return failure.Wrap(err, "l.newSegment failed for (%d)", off)
 		}
 	}
+
+	if l.activeSegment.IsMaxed() {
+		if err = l.newSegment(l.activeSegment.NextOffset()); err != nil {
+			return failure.Wrap(err, "l.newSegment failed for (%d)", l.activeSegment.NextOffset())
+		}
+	}
+
+	if err = l.loadState(); err != nil {
+		return failure.Wrap(err, "l.loadState failed")
+	}
+
 	return nil
 }
 
+// takeCleanMarker reports whether the log was shut down cleanly the last
+// time it was open. The marker is removed so that a crash from here on is
+// detected the next time the log is opened.
+func (l *Log) takeCleanMarker() (bool, error) {
+	marker := path.Join(l.Dir, CleanShutdownFile)
+	if _, err := os.Stat(marker); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, failure.ToSystem(err, "os.Stat failed for (%s)", marker)
+	}
+
+	if err := os.Remove(marker); err != nil {
+		return false, failure.ToSystem(err, "os.Remove failed for (%s)", marker)
+	}
+
+	return true, nil
+}
+
 func (l *Log) Append(record *data.Record) (uint64, error) {
+	l.appendMu.Lock()
+	defer l.appendMu.Unlock()
+
+	off, _, err := l.appendRecords([]*data.Record{record})
+	if err != nil {
+		return 0, failure.Wrap(err, "l.appendRecords failed")
+	}
+
+	return off, nil
+}
+
+// AppendBatch appends every record in one go and returns the offsets of the
+// first and last record. The records get contiguous offsets, segments are
+// rolled in the middle of the batch as they fill up and the whole batch is
+// published to readers with a single flush. When an append fails the
+// records before it stay in the log.
+func (l *Log) AppendBatch(records []*data.Record) (uint64, uint64, error) {
+	if len(records) == 0 {
+		return 0, 0, failure.InvalidParam("batch has no records")
+	}
+
+	l.appendMu.Lock()
+	defer l.appendMu.Unlock()
+
+	first, last, err := l.appendRecords(records)
+	if err != nil {
+		return 0, 0, failure.Wrap(err, "l.appendRecords failed")
+	}
+
+	return first, last, nil
+}
+
+// appendRecords appends the records of a producer. Records an idempotent
+// producer appended before are not appended again, their original offsets
+// are returned instead. The caller must hold appendMu.
+func (l *Log) appendRecords(records []*data.Record) (uint64, uint64, error) {
+	if err := l.checkAppend(); err != nil {
+		return 0, 0, failure.Wrap(err, "l.checkAppend failed")
+	}
+
+	dup, err := l.producers.Check(records)
+	if err != nil {
+		return 0, 0, failure.Wrap(err, "l.producers.Check failed")
+	}
+
+	if dup {
+		return records[0].Offset, records[len(records)-1].Offset, nil
+	}
+
+	if err = l.transactions.Check(records); err != nil {
+		return 0, 0, failure.Wrap(err, "l.transactions.Check failed")
+	}
+
+	first, last, err := l.writeRecords(records)
+	if err != nil {
+		return 0, 0, failure.Wrap(err, "l.writeRecords failed")
+	}
+
+	return first, last, nil
+}
+
+// writeRecords appends records and then publishes them, applies the
+// durability policy and wakes up waiting readers. The producers and
+// transactions learn about the records before they are published. The
+// caller must hold appendMu.
+func (l *Log) writeRecords(records []*data.Record) (uint64, uint64, error) {
+	var first, last uint64
+	var rolled bool
+	for i, record := range records {
+		off, r, err := l.append(record)
+		rolled = rolled || r
+		if err != nil {
+			err = failure.Wrap(err, "l.append failed (%d of %d)", i+1, len(records))
+			if i > 0 {
+				// the records before the failed one are in the log
+				l.producers.Add(records[:i])
+				l.transactions.Add(records[:i])
+				_ = l.publish(uint64(i), rolled)
+			}
+			return 0, 0, err
+		}
+
+		if i == 0 {
+			first = off
+		}
+		last = off
+	}
+
+	l.producers.Add(records)
+	l.transactions.Add(records)
+	if err := l.publish(uint64(len(records)), rolled); err != nil {
+		return 0, 0, failure.Wrap(err, "l.publish failed")
+	}
+
+	return first, last, nil
+}
+
+// checkAppend is checkOpen for appends, it is checked up front so a closed
+// log never answers a retry from the state of its producers.
+func (l *Log) checkAppend() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
+		return failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	return nil
+}
+
+// publish makes the n records just appended visible to readers. The
+// durability policy is applied first so in the always mode no reader sees a
+// record that is not on stable storage yet. The caller must hold appendMu.
+func (l *Log) publish(n uint64, rolled bool) error {
+	if err := l.synced(n); err != nil {
+		return failure.Wrap(err, "l.synced failed")
+	}
+
+	if err := l.activeSegment.publish(); err != nil {
+		return failure.Wrap(err, "l.activeSegment.publish failed")
+	}
+	l.notify()
+
+	if !rolled {
+		return nil
+	}
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	off, err := l.activeSegment.Append(record)
-	if err != nil {
-		return 0, failure.Wrap(err, "l.activeSegment.Append failed")
+	if err := l.rolled(); err != nil {
+		return failure.Wrap(err, "l.rolled failed")
 	}
 
-	if l.activeSegment.IsMaxed() {
-		if err := l.newSegment(off + 1); err != nil {
-			return 0, failure.Wrap(err, "l.newSegment failed")
+	return nil
+}
+
+// append writes record to the active segment and rolls a new one once it is
+// maxed, reporting whether it did. An active segment that expired is rolled
+// before the record is written. The record is written under the read lock
+// and is not visible to readers until it is published. The caller must hold
+// appendMu.
+func (l *Log) append(record *data.Record) (uint64, bool, error) {
+	var rolled bool
+	if l.activeSegment.IsExpired(time.Now(), l.Config.Segment.MaxAge) {
+		if err := l.lockedRoll(); err != nil {
+			return 0, false, failure.Wrap(err, "l.lockedRoll failed")
 		}
+		rolled = true
 	}
-	return off, nil
+
+	off, err := l.write(record)
+	if err != nil {
+		return 0, false, failure.Wrap(err, "l.write failed")
+	}
+
+	if !l.activeSegment.IsMaxed() {
+		return off, rolled, nil
+	}
+
+	if err = l.lockedRoll(); err != nil {
+		return 0, false, failure.Wrap(err, "l.lockedRoll failed")
+	}
+
+	return off, true, nil
 }
 
-func (l *Log) Read(off uint64) (*data.Record, error) {
+// write appends record to the active segment without publishing it. The
+// caller must hold appendMu.
+func (l *Log) write(record *data.Record) (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	var s *Segment
-	for _, seg := range l.segments {
-		if seg.BaseOffset() <= off && off < seg.NextOffset() {
-			s = seg
-			break
+	if err := l.checkOpen(); err != nil {
+		return 0, failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	off, err := l.activeSegment.append(record)
+	if err != nil {
+		return 0, failure.Wrap(err, "l.activeSegment.append failed")
+	}
+
+	return off, nil
+}
+
+// lockedRoll is roll under the write lock. The caller must hold appendMu.
+func (l *Log) lockedRoll() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkOpen(); err != nil {
+		return failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	return l.roll()
+}
+
+// roll seals the active segment and starts a new one at its next offset.
+// The caller must hold appendMu and the write lock.
+func (l *Log) roll() error {
+	// nothing syncs a segment once it is sealed so it is synced now, unless
+	// syncing is left to the operating system
+	if l.Config.Durability.Mode != DurabilityOS {
+		if err := l.activeSegment.Sync(); err != nil {
+			return failure.Wrap(err, "l.activeSegment.Sync failed")
 		}
 	}
 
-	if s == nil || s.NextOffset() <= off {
-		return nil, failure.OutOfRange("invalid offset %d", off)
+	// records appended since the last publish are published when the
+	// segment is sealed, so the new one starts after them
+	if err := l.newSegment(l.activeSegment.nextOffset); err != nil {
+		return failure.Wrap(err, "l.newSegment failed")
+	}
+
+	return nil
+}
+
+// RollExpired seals the active segment when its first record is older than
+// Segment.MaxAge as of now. It lets a log that receives no appends still
+// hand its data over to retention.
+func (l *Log) RollExpired(now time.Time) error {
+	l.appendMu.Lock()
+	defer l.appendMu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkOpen(); err != nil {
+		return failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	if !l.activeSegment.IsExpired(now, l.Config.Segment.MaxAge) {
+		return nil
+	}
+
+	base := l.activeSegment.BaseOffset()
+	if err := l.roll(); err != nil {
+		return failure.Wrap(err, "l.roll failed")
+	}
+
+	l.Config.Logger.Infow("roll",
+		"status", "expired segment sealed",
+		"dir", l.Dir,
+		"base-offset", base,
+		"next-offset", l.activeSegment.BaseOffset(),
+	)
+
+	if err := l.rolled(); err != nil {
+		return failure.Wrap(err, "l.rolled failed")
+	}
+
+	return nil
+}
+
+// rolled runs after one or more segments were sealed. A freshly sealed
+// segment may have pushed the log over its budget. The caller must hold the
+// write lock.
+func (l *Log) rolled() error {
+	if !l.isRetentionEnabled() {
+		return nil
+	}
+
+	if err := l.retain(time.Now()); err != nil {
+		return failure.Wrap(err, "l.retain failed")
+	}
+
+	return nil
+}
+
+func (l *Log) Read(off uint64) (*data.Record, error) {
+	l.mu.RLock()
+	if err := l.checkOpen(); err != nil {
+		l.mu.RUnlock()
+		return nil, failure.Wrap(err, "l.checkOpen failed")
 	}
 
-	rec, err := s.Read(off)
+	rec, r, err := l.read(off)
+	l.mu.RUnlock()
 	if err != nil {
-		return nil, failure.Wrap(err, "s.Read failed (offset: %d)", off)
+		return nil, failure.Wrap(err, "l.read failed")
+	}
+
+	if r != nil {
+		if rec, err = l.readRemote(*r, off); err != nil {
+			return nil, failure.Wrap(err, "l.readRemote failed")
+		}
 	}
 
 	return rec, nil
 }
 
+// read fetches off from the local segment holding it. When off is only in
+// the remote tier its remote segment is returned instead, the caller reads
+// it with readRemote once it released the lock so a slow fetch never holds
+// up appends. The caller must hold at least the read lock.
+func (l *Log) read(off uint64) (*data.Record, *remoteSegment, error) {
+	if s := l.segmentFor(off); s != nil {
+		rec, err := s.Read(off)
+		if err != nil {
+			return nil, nil, failure.Wrap(err, "s.Read failed (offset: %d)", off)
+		}
+
+		return rec, nil, nil
+	}
+
+	if r, ok := l.remoteFor(off); ok {
+		return nil, &r, nil
+	}
+
+	return nil, nil, failure.OutOfRange("invalid offset %d", off)
+}
+
+// ReadNext returns the first record at or after off, skipping offsets that
+// were removed by compaction. When off has not been appended yet it blocks
+// until it is, ctx is done or the log is closed. An offset that was already
+// removed by retention is reported as failure.OutOfRange.
+func (l *Log) ReadNext(ctx context.Context, off uint64) (*data.Record, error) {
+	for {
+		rec, appended, err := l.readNext(off)
+		if err != nil {
+			return nil, failure.Wrap(err, "l.readNext failed (%d)", off)
+		}
+
+		if rec != nil {
+			return rec, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-appended:
+		}
+	}
+}
+
+// readNext reads the first record at or after off. When there is none yet
+// it returns the channel that is closed by the next append instead.
+func (l *Log) readNext(off uint64) (*data.Record, <-chan struct{}, error) {
+	// taken before looking so an append published while looking still
+	// wakes the reader up
+	appended := l.appendedCh()
+
+	for {
+		rec, r, err := l.readNextLocal(off)
+		if err != nil {
+			return nil, nil, failure.Wrap(err, "l.readNextLocal failed")
+		}
+
+		if r == nil {
+			if rec == nil {
+				return nil, appended, nil
+			}
+			return rec, nil, nil
+		}
+
+		// the remote segment is read without the log's lock, off moves past
+		// it when every record left in it was removed by compaction
+		if off < r.baseOffset {
+			off = r.baseOffset
+		}
+		for ; off < r.nextOffset; off++ {
+			rec, err = l.readRemote(*r, off)
+			if failure.IsNotFound(err) || failure.IsOutOfRange(err) {
+				continue
+			}
+			if err != nil {
+				return nil, nil, failure.Wrap(err, "l.readRemote failed")
+			}
+
+			return rec, nil, nil
+		}
+	}
+}
+
+// readNextLocal reads the first record at or after off from the local
+// segments. It stops at the first offset only the remote tier holds and
+// returns its remote segment instead.
+func (l *Log) readNextLocal(off uint64) (*data.Record, *remoteSegment, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
+		return nil, nil, failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	if lowest := l.lowest(); off < lowest {
+		return nil, nil, failure.OutOfRange("offset (%d) is below the lowest offset (%d)", off, lowest)
+	}
+
+	for ; off < l.activeSegment.NextOffset(); off++ {
+		rec, r, err := l.read(off)
+		if failure.IsNotFound(err) || failure.IsOutOfRange(err) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, failure.Wrap(err, "l.read failed")
+		}
+
+		return rec, r, nil
+	}
+
+	return nil, nil, nil
+}
+
+// segmentFor returns the segment holding off or nil when no segment does.
+// The caller must hold at least the read lock.
+func (l *Log) segmentFor(off uint64) *Segment {
+	for _, s := range l.segments {
+		if s.BaseOffset() <= off && off < s.NextOffset() {
+			return s
+		}
+	}
+
+	return nil
+}
+
+// notify wakes up every reader waiting for an append
+func (l *Log) notify() {
+	l.notifyMu.Lock()
+	defer l.notifyMu.Unlock()
+
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+// appendedCh returns the channel closed by the next notify
+func (l *Log) appendedCh() <-chan struct{} {
+	l.notifyMu.Lock()
+	defer l.notifyMu.Unlock()
+
+	return l.appended
+}
+
+// Close stops the background tasks and closes every segment. Closing a log
+// that is already closed does nothing.
 func (l *Log) Close() error {
+	l.stopBackground()
+
+	l.appendMu.Lock()
+	defer l.appendMu.Unlock()
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	if l.closed {
+		return nil
+	}
+
+	// readers blocked in ReadNext find the log closed once they wake up
+	l.closed = true
+	l.notify()
+
+	if err := l.saveState(); err != nil {
+		return failure.Wrap(err, "l.saveState failed")
+	}
+
+	// the marker lets the next open trust the indexes, which only holds
+	// when every store reached stable storage before the marker did
 	for _, seg := range l.segments {
+		if err := seg.Sync(); err != nil {
+			return failure.Wrap(err, "seg.Sync failed")
+		}
+
 		if err := seg.Close(); err != nil {
 			return failure.Wrap(err, "seg.Close failed")
 		}
 	}
 
+	if err := l.closeCache(); err != nil {
+		return failure.Wrap(err, "l.closeCache failed")
+	}
+
+	marker := path.Join(l.Dir, CleanShutdownFile)
+	if err := writeSynced(marker, nil); err != nil {
+		return failure.Wrap(err, "writeSynced failed")
+	}
+
+	if err := syncDir(l.Dir); err != nil {
+		return failure.Wrap(err, "syncDir failed")
+	}
+
+	// another process may open the log from here on
+	if err := l.lock.Close(); err != nil {
+		return failure.ToSystem(err, "l.lock.Close failed")
+	}
+	l.lock = nil
+
+	return nil
+}
+
+// writeSynced writes b to file and commits it to stable storage
+func writeSynced(file string, b []byte) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return failure.ToSystem(err, "os.Create failed for (%s)", file)
+	}
+
+	if _, err = f.Write(b); err != nil {
+		_ = f.Close()
+		return failure.ToSystem(err, "f.Write failed for (%s)", file)
+	}
+
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return failure.ToSystem(err, "f.Sync failed for (%s)", file)
+	}
+
+	if err = f.Close(); err != nil {
+		return failure.ToSystem(err, "f.Close failed for (%s)", file)
+	}
+
 	return nil
 }
 
+// syncDir commits the entries of dir to stable storage so files created or
+// renamed in it survive a power loss
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return failure.ToSystem(err, "os.Open failed for (%s)", dir)
+	}
+	defer func() { _ = d.Close() }()
+
+	if err = d.Sync(); err != nil {
+		return failure.ToSystem(err, "d.Sync failed for (%s)", dir)
+	}
+
+	return nil
+}
+
+// Remove closes the log and deletes its directory along with the segments
+// it offloaded to the remote tier. The log can not be used afterwards unless
+// it is Reset.
 func (l *Log) Remove() error {
-	if err := l.Remove(); err != nil {
-		return failure.Wrap(err, "l.Remove failed")
+	if err := l.Close(); err != nil {
+		return failure.Wrap(err, "l.Close failed")
 	}
 
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, r := range l.remote {
+		if err := l.deleteRemote(r); err != nil {
+			return failure.Wrap(err, "l.deleteRemote failed")
+		}
+	}
+	l.remote = nil
+
 	if err := os.RemoveAll(l.Dir); err != nil {
-		return failure.Wrap(err, "os.RemoveAll failed")
+		return failure.ToSystem(err, "os.RemoveAll failed for (%s)", l.Dir)
 	}
 
 	return nil
 }
 
+// Reset removes the log and starts over with an empty log at
+// Segment.InitialOffset in the same directory and with the same config.
 func (l *Log) Reset() error {
 	if err := l.Remove(); err != nil {
 		return failure.Wrap(err, "l.Remove failed")
 	}
 
-	if err := l.setup(); err != nil {
-		return failure.Wrap(err, "l.setup failed")
+	l.appendMu.Lock()
+	defer l.appendMu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return failure.ToSystem(err, "os.MkdirAll failed for (%s)", l.Dir)
+	}
+
+	l.segments = nil
+	l.activeSegment = nil
+	l.unsynced = 0
+	if err := l.open(); err != nil {
+		return failure.Wrap(err, "l.open failed")
+	}
+
+	l.closed = false
+	l.start()
+
+	return nil
+}
+
+// checkOpen fails with Closed once the log was closed. The caller must hold
+// at least the read lock.
+func (l *Log) checkOpen() error {
+	if l.closed {
+		return Closed("log (%s) is closed", l.Dir)
 	}
 
 	return nil
 }
 
+// LowestOffset returns the earliest offset in the log across the local and
+// the remote tier.
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	return l.segments[0].BaseOffset(), nil
+	return l.lowest(), nil
+}
+
+// lowest is the earliest offset in either tier. The caller must hold at
+// least the read lock.
+func (l *Log) lowest() uint64 {
+	lowest := l.segments[0].BaseOffset()
+	if len(l.remote) > 0 && l.remote[0].baseOffset < lowest {
+		lowest = l.remote[0].baseOffset
+	}
+
+	return lowest
 }
 
 func (l *Log) HighestOffset() (uint64, error) {
@@ -199,15 +967,101 @@ func (l *Log) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
+// OffsetForTime returns the offset of the first record appended at or after
+// t. Consumers use it to replay everything since a point in time without
+// scanning the log from the start. It returns failure.NotFound when every
+// record in the log is older than t.
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	if err := l.checkOpen(); err != nil {
+		l.mu.RUnlock()
+		return 0, failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	var remote []remoteSegment
+	for _, r := range l.remote {
+		if r.baseOffset >= l.segments[0].BaseOffset() {
+			break
+		}
+		remote = append(remote, r)
+	}
+	l.mu.RUnlock()
+
+	// remote segments are fetched without the log's lock
+	ts := t.UnixNano()
+	for _, r := range remote {
+		off, err := l.remoteOffsetForTime(r, ts)
+		if errors.Is(err, io.EOF) {
+			continue
+		}
+		if err != nil {
+			return 0, failure.Wrap(err, "l.remoteOffsetForTime failed (%d)", r.baseOffset)
+		}
+
+		return off, nil
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
+		return 0, failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	for _, s := range l.segments {
+		off, err := s.OffsetForTime(ts)
+		if errors.Is(err, io.EOF) {
+			continue
+		}
+		if err != nil {
+			return 0, failure.Wrap(err, "s.OffsetForTime failed (%d)", s.BaseOffset())
+		}
+
+		return off, nil
+	}
+
+	return 0, failure.NotFound("no record was appended at or after (%s)", t.Format(time.RFC3339Nano))
+}
+
+// Size returns the number of bytes held by the stores and indexes of every
+// segment in the log.
+func (l *Log) Size() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.size()
+}
+
+func (l *Log) size() uint64 {
+	var total uint64
+	for _, s := range l.segments {
+		total += s.Size()
+	}
+
+	return total
+}
+
+// Truncate removes every segment whose records are all at or below lowest.
+// When that includes the active segment a new one takes its place, so the
+// next append gets the offset it would have had anyway.
 func (l *Log) Truncate(lowest uint64) error {
+	l.appendMu.Lock()
+	defer l.appendMu.Unlock()
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	if err := l.checkOpen(); err != nil {
+		return failure.Wrap(err, "l.checkOpen failed")
+	}
+
 	var segments []*Segment
 
+	next := l.activeSegment.NextOffset()
 	for _, s := range l.segments {
 		if s.NextOffset() <= lowest+1 {
 			if err := s.Remove(); err != nil {
+				l.segments = segments
 				return failure.Wrap(err, "s.Remove failed")
 			}
 			continue
@@ -216,6 +1070,25 @@ func (l *Log) Truncate(lowest uint64) error {
 	}
 	l.segments = segments
 
+	if len(l.segments) == 0 {
+		l.activeSegment = nil
+		if err := l.newSegment(next); err != nil {
+			return failure.Wrap(err, "l.newSegment failed (%d)", next)
+		}
+	}
+
+	var remote []remoteSegment
+	for _, r := range l.remote {
+		if r.nextOffset <= lowest+1 {
+			if err := l.deleteRemote(r); err != nil {
+				return failure.Wrap(err, "l.deleteRemote failed")
+			}
+			continue
+		}
+		remote = append(remote, r)
+	}
+	l.remote = remote
+
 	return nil
 }
 
@@ -223,15 +1096,27 @@ func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
+	if err := l.checkOpen(); err != nil {
+		return errReader{err: err}
+	}
+
 	readers := make([]io.Reader, len(l.segments))
 	for i, seg := range l.segments {
-		readers[i] = &originReader{seg.store, 0}
+		readers[i] = &originReader{Store: seg.store, off: seg.store.format.Header}
 	}
 
 	return io.MultiReader(readers...)
 }
 
+// newSegment starts a new active segment at off and seals the one before
+// it. The caller must hold appendMu and the write lock.
 func (l *Log) newSegment(off uint64) error {
+	if l.activeSegment != nil {
+		if err := l.activeSegment.seal(); err != nil {
+			return failure.Wrap(err, "l.activeSegment.seal failed")
+		}
+	}
+
 	s, err := NewSegment(l.Dir, off, l.Config)
 	if err != nil {
 		return failure.Wrap(err, "NewSegment failed")
@@ -241,21 +1126,118 @@ func (l *Log) newSegment(off uint64) error {
 	return nil
 }
 
+// start runs the background tasks the config asks for
+func (l *Log) start() {
+	l.bgMu.Lock()
+	defer l.bgMu.Unlock()
+
+	c := l.Config
+	if c.NoBackground {
+		return
+	}
+
+	l.done = make(chan struct{})
+	if l.isRetentionEnabled() {
+		l.every(c.Retention.CheckInterval, "retention", l.EnforceRetention)
+	}
+
+	if c.Compaction.Enabled {
+		l.every(c.Compaction.Interval, "compaction", l.Compact)
+	}
+
+	if c.Segment.MaxAge > 0 {
+		l.every(c.Retention.CheckInterval, "roll", l.RollExpired)
+	}
+
+	l.every(c.Retention.CheckInterval, "transactions", l.AbortExpired)
+
+	if c.Durability.Mode == DurabilityInterval {
+		l.every(c.Durability.Interval, "durability", l.syncEvery)
+	}
+
+	if l.isTiered() {
+		l.every(c.Tier.Interval, "tier", l.Offload)
+	}
+}
+
+// every runs fn on its own goroutine each interval until the log is closed.
+// Failures are logged since there is no caller to return them to.
+func (l *Log) every(interval time.Duration, task string, fn func(now time.Time) error) {
+	done := l.done
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if err := fn(now); err != nil {
+					l.Config.Logger.Errorw(task,
+						"status", task+" failed",
+						"dir", l.Dir,
+						"ERROR", err,
+					)
+				}
+			}
+		}
+	}()
+}
+
+// stopBackground signals every background task to exit and waits for them.
+// Only the first of concurrent calls stops them, the others wait until they
+// are stopped.
+func (l *Log) stopBackground() {
+	l.bgMu.Lock()
+	defer l.bgMu.Unlock()
+
+	if l.done == nil {
+		return
+	}
+
+	close(l.done)
+	l.wg.Wait()
+	l.done = nil
+}
+
+// errReader fails every read with err
+type errReader struct {
+	err error
+}
+
+func (e errReader) Read(_ []byte) (int, error) {
+	return 0, e.err
+}
+
+// originReader streams the frames of a store. Every record is read through
+// Store.Read so its checksum is verified before it is handed out, and the
+// frames of an encrypted store come out decrypted.
 type originReader struct {
 	*Store
-	off int64
+	off   uint64
+	frame []byte
 }
 
 func (o *originReader) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.off)
-	if err != nil {
-		if errors.Is(err, io.EOF) {
-			return n, io.EOF
+	if len(o.frame) == 0 {
+		b, err := o.Store.Read(o.off)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, io.EOF
+			}
+
+			return 0, failure.Wrap(err, "o.Store.Read failed (%d)", o.off)
 		}
 
-		return n, failure.Wrap(err, "o.ReadAt failed")
+		o.frame = append(frameHeader(b), b...)
+		o.off += o.Store.frameSize(b)
 	}
 
-	o.off += int64(n)
+	n := copy(p, o.frame)
+	o.frame = o.frame[n:]
 	return n, nil
 }
@@ -1,9 +1,15 @@
 package log_test
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/rsb/failure"
 
@@ -21,6 +27,16 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"recover after crash":               testRecoverAfterCrash,
+		"close writes clean marker":         testCleanMarker,
+		"offset for time":                   testOffsetForTime,
+		"append batch":                      testAppendBatch,
+		"read next waits for append":        testReadNext,
+		"closed log fails clearly":          testClosed,
+		"remove deletes the log":            testRemove,
+		"reset starts an empty log":         testReset,
+		"reads run alongside appends":       testConcurrentReadAppend,
+		"open log locks its directory":      testLocked,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -103,7 +119,7 @@ func testReader(t *testing.T, l *log.Log) {
 	require.NoError(t, err)
 
 	read := &data.Record{}
-	err = proto.Unmarshal(b[log.LenWidth:], read)
+	err = proto.Unmarshal(b[log.FrameWidth:], read)
 	require.NoError(t, err)
 	require.Equal(t, rec.Value, read.Value)
 }
@@ -123,4 +139,333 @@ func testTruncate(t *testing.T, l *log.Log) {
 
 	_, err = l.Read(0)
 	require.Error(t, err)
+
+	// truncating every segment leaves an empty active segment behind
+	require.NoError(t, l.Truncate(2))
+	off, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	off, err = l.Append(rec)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+func testRecoverAfterCrash(t *testing.T, l *log.Log) {
+	rec := &data.Record{
+		Value: []byte("hello world"),
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(rec)
+		require.NoError(t, err)
+	}
+
+	// without the marker and the state saved by Close the log is opened as
+	// after a crash
+	require.NoError(t, l.Close())
+	require.NoError(t, os.Remove(path.Join(l.Dir, log.CleanShutdownFile)))
+	require.NoError(t, os.Remove(path.Join(l.Dir, log.StateFile)))
+
+	// a torn write leaves a partial record at the end of the active store
+	storeFile := path.Join(l.Dir, fmt.Sprintf("%d%s", 2, log.StoreExt))
+	f, err := os.OpenFile(storeFile, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 42, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	old := time.Now().Add(-3 * time.Hour).Truncate(time.Second)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, os.Chtimes(path.Join(l.Dir, fmt.Sprintf("%d%s", i, log.StoreExt)), old, old))
+	}
+
+	n, err := log.NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+
+	// recovering keeps the age of every store, cut or not
+	for i := 0; i < 3; i++ {
+		fi, err := os.Stat(path.Join(l.Dir, fmt.Sprintf("%d%s", i, log.StoreExt)))
+		require.NoError(t, err)
+		require.True(t, old.Equal(fi.ModTime()), "%d: %s", i, fi.ModTime())
+	}
+
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	off, err = n.Append(rec)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	for i := uint64(0); i <= off; i++ {
+		read, err := n.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, rec.Value, read.Value)
+	}
+}
+
+func testCleanMarker(t *testing.T, l *log.Log) {
+	marker := path.Join(l.Dir, log.CleanShutdownFile)
+	_, err := os.Stat(marker)
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, l.Close())
+	_, err = os.Stat(marker)
+	require.NoError(t, err)
+
+	// opening the log consumes the marker again
+	n, err := log.NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	_, err = os.Stat(marker)
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, n.Close())
+}
+
+func testOffsetForTime(t *testing.T, l *log.Log) {
+	start := time.Now()
+
+	var stamps []int64
+	for i := 0; i < 3; i++ {
+		off, err := l.Append(&data.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+
+		read, err := l.Read(off)
+		require.NoError(t, err)
+		require.False(t, read.Timestamp < start.UnixNano())
+		stamps = append(stamps, read.Timestamp)
+	}
+
+	off, err := l.OffsetForTime(start.Add(-time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	for i, ts := range stamps {
+		off, err = l.OffsetForTime(time.Unix(0, ts))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+
+	// the time index is rebuilt along with the offset index after a crash
+	require.NoError(t, l.Close())
+	require.NoError(t, os.Remove(path.Join(l.Dir, log.CleanShutdownFile)))
+
+	l, err = log.NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+
+	off, err = l.OffsetForTime(time.Unix(0, stamps[1]))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	_, err = l.OffsetForTime(time.Unix(0, stamps[2]+1))
+	require.Error(t, err)
+	require.True(t, failure.IsNotFound(err))
+}
+
+func testAppendBatch(t *testing.T, l *log.Log) {
+	_, _, err := l.AppendBatch(nil)
+	require.Error(t, err)
+	require.True(t, failure.IsInvalidParam(err))
+
+	var records []*data.Record
+	for i := 0; i < 5; i++ {
+		records = append(records, &data.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+	}
+
+	first, last, err := l.AppendBatch(records)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), first)
+	require.Equal(t, uint64(4), last)
+
+	for i, want := range records {
+		read, err := l.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), read.Offset)
+		require.Equal(t, want.Value, read.Value)
+	}
+
+	off, err := l.Append(&data.Record{Value: []byte("after")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+}
+
+func testReadNext(t *testing.T, l *log.Log) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := l.ReadNext(ctx, 0)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	got := make(chan *data.Record)
+	go func() {
+		rec, err := l.ReadNext(context.Background(), 1)
+		require.NoError(t, err)
+		got <- rec
+	}()
+
+	for i := 0; i < 2; i++ {
+		_, err = l.Append(&data.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	select {
+	case rec := <-got:
+		require.Equal(t, uint64(1), rec.Offset)
+		require.Equal(t, []byte("record 1"), rec.Value)
+	case <-time.After(time.Second):
+		t.Fatal("ReadNext did not return after the append")
+	}
+
+	// closing the log releases anyone still waiting
+	failed := make(chan error)
+	go func() {
+		_, err := l.ReadNext(context.Background(), 2)
+		failed <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, l.Close())
+
+	select {
+	case err = <-failed:
+		require.True(t, log.IsClosed(err), err)
+	case <-time.After(time.Second):
+		t.Fatal("ReadNext did not return after the log was closed")
+	}
+}
+
+func testClosed(t *testing.T, l *log.Log) {
+	_, err := l.Append(&data.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// concurrent closes stop the background tasks once
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, l.Close())
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, l.Close())
+
+	_, err = l.Append(&data.Record{Value: []byte("hello world")})
+	require.True(t, log.IsClosed(err), err)
+
+	_, err = l.Read(0)
+	require.True(t, log.IsClosed(err), err)
+
+	_, err = ioutil.ReadAll(l.Reader())
+	require.True(t, log.IsClosed(err), err)
+
+	require.True(t, log.IsClosed(l.Truncate(0)))
+	require.True(t, log.IsClosed(l.Sync()))
+}
+
+func testRemove(t *testing.T, l *log.Log) {
+	_, err := l.Append(&data.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	require.NoError(t, l.Remove())
+	_, err = os.Stat(l.Dir)
+	require.True(t, os.IsNotExist(err))
+
+	_, err = l.Read(0)
+	require.True(t, log.IsClosed(err), err)
+}
+
+func testReset(t *testing.T, l *log.Log) {
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&data.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	l.Config.Segment.InitialOffset = 16
+	require.NoError(t, l.Reset())
+	defer func() { _ = l.Close() }()
+
+	off, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), off)
+
+	off, err = l.Append(&data.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(16), off)
+
+	_, err = l.Read(0)
+	require.True(t, failure.IsOutOfRange(err), err)
+
+	_, err = os.Stat(path.Join(l.Dir, "0"+log.StoreExt))
+	require.True(t, os.IsNotExist(err))
+}
+
+func testConcurrentReadAppend(t *testing.T, l *log.Log) {
+	const records = 200
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// every record fills a segment, so the readers go through the active
+	// segment as well as the sealed ones behind it
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for off := uint64(0); off < records; off++ {
+				rec, err := l.ReadNext(ctx, off)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				if want := fmt.Sprintf("record %d", off); string(rec.Value) != want {
+					errs <- fmt.Errorf("offset (%d) read (%s) want (%s)", off, rec.Value, want)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < records; i += 2 {
+		_, _, err := l.AppendBatch([]*data.Record{
+			{Value: []byte(fmt.Sprintf("record %d", i))},
+			{Value: []byte(fmt.Sprintf("record %d", i+1))},
+		})
+		require.NoError(t, err)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func testLocked(t *testing.T, l *log.Log) {
+	_, err := l.Append(&data.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	_, err = log.NewLog(l.Dir, l.Config)
+	require.True(t, log.IsLocked(err), err)
+
+	_, err = log.Repair(l.Dir, l.Config)
+	require.True(t, log.IsLocked(err), err)
+
+	_, err = log.Migrate(l.Dir, l.Config, false)
+	require.True(t, log.IsLocked(err), err)
+
+	_, err = log.Restore(l.Dir, bytes.NewReader(nil))
+	require.True(t, log.IsLocked(err), err)
+
+	require.NoError(t, l.Close())
+	l2, err := log.NewLog(l.Dir, l.Config)
+	require.NoError(t, err)
+	defer func() { _ = l2.Close() }()
+
+	rec, err := l2.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), rec.Value)
 }
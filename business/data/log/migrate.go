@@ -0,0 +1,334 @@
+package log
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/rsb/failure"
+)
+
+// MigrateDir is the directory inside the log where Migrate writes upgraded
+// stores before they replace the originals. Anything left in it after a
+// crash is discarded the next time the log is opened.
+const MigrateDir = ".migrate"
+
+// MigratedSegment describes what Migrate changed for one segment
+type MigratedSegment struct {
+	BaseOffset uint64
+	NextOffset uint64
+	// From is the format version of the store before it was migrated
+	From uint32
+	// TruncatedBytes is how much of the store could not be read and was
+	// dropped, or would be dropped when the migration was refused
+	TruncatedBytes uint64
+}
+
+// MigrateReport is the result of migrating a log directory
+type MigrateReport struct {
+	Dir      string
+	Segments []MigratedSegment
+}
+
+// Truncated returns how many bytes the migration drops across every segment
+func (r MigrateReport) Truncated() uint64 {
+	var n uint64
+	for _, seg := range r.Segments {
+		n += seg.TruncatedBytes
+	}
+
+	return n
+}
+
+// Migrate upgrades every segment in dir whose files are not written in
+// CurrentVersion. Every such store is first converted into MigrateDir with
+// the current header in front of it and the current frames, and its
+// indexes are rebuilt there the same way Repair does. Only when every
+// segment was converted are the copies moved over the originals, segments
+// that are current are left alone. A store that can not be read to its end
+// would lose data, in which case nothing is changed and the migration fails
+// with failure.Validation unless force is set. The report lists what was,
+// or would have been, dropped either way. The keys in c are needed to
+// rebuild the indexes of encrypted segments. The log must not be open while
+// it is being migrated, Migrate fails with Locked when it is.
+func Migrate(dir string, c Config, force bool) (MigrateReport, error) {
+	report := MigrateReport{Dir: dir}
+	if c.Segment.MaxIndexBytes == 0 {
+		c.Segment.MaxIndexBytes = DefaultMaxIndexBytes
+	}
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return report, failure.Wrap(err, "lockDir failed")
+	}
+	defer func() { _ = lock.Close() }()
+
+	tmpDir := path.Join(dir, MigrateDir)
+	if err = os.RemoveAll(tmpDir); err != nil {
+		return report, failure.ToSystem(err, "os.RemoveAll failed for (%s)", tmpDir)
+	}
+
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return report, failure.ToSystem(err, "os.MkdirAll failed for (%s)", tmpDir)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	baseOffsets, _, err := segmentFiles(dir)
+	if err != nil {
+		return report, failure.Wrap(err, "segmentFiles failed")
+	}
+
+	var workDirs []string
+	for _, base := range baseOffsets {
+		froms, current, err := segmentVersion(dir, base)
+		if err != nil {
+			return report, failure.Wrap(err, "segmentVersion failed (%d)", base)
+		}
+
+		if current {
+			continue
+		}
+
+		// a store whose layout is not known is converted both ways and the
+		// one that reads furthest wins
+		var seg MigratedSegment
+		var workDir string
+		for i, from := range froms {
+			work := path.Join(tmpDir, strconv.FormatUint(uint64(from), 10))
+			candidate, err := convertSegment(dir, work, base, from, c)
+			if err != nil {
+				return report, failure.Wrap(err, "convertSegment failed (%d)", base)
+			}
+
+			if i == 0 || candidate.TruncatedBytes < seg.TruncatedBytes {
+				seg, workDir = candidate, work
+			}
+		}
+
+		report.Segments = append(report.Segments, seg)
+		workDirs = append(workDirs, workDir)
+	}
+
+	if n := report.Truncated(); n > 0 && !force {
+		return report, failure.Validation("migrating (%s) would drop (%d) bytes that can not be read, nothing was changed", dir, n)
+	}
+
+	for i, seg := range report.Segments {
+		if err := replaceSegment(dir, workDirs[i], seg.BaseOffset); err != nil {
+			return report, failure.Wrap(err, "replaceSegment failed (%d)", seg.BaseOffset)
+		}
+	}
+
+	return report, nil
+}
+
+// segmentVersion returns the versions the segment's store may be in and
+// whether the store and both of its indexes are in CurrentVersion. There is
+// more than one only when the store has no header and its layout could not
+// be told. A missing index is rebuilt anyway so it counts as current.
+func segmentVersion(dir string, base uint64) ([]uint32, bool, error) {
+	name := path.Join(dir, segmentName(base, StoreExt))
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, false, failure.ToSystem(err, "os.Open failed for (%s)", name)
+	}
+
+	format, known, err := storeFormat(f)
+	_ = f.Close()
+	if err != nil {
+		return nil, false, failure.Wrap(err, "storeFormat failed")
+	}
+
+	versions := []uint32{format.Version}
+	if !known {
+		versions = []uint32{Version0, Version1}
+	}
+	current := known && format.Version == CurrentVersion
+
+	for ext, magic := range map[string][]byte{IndexExt: IndexMagic, TimeIndexExt: TimeIndexMagic} {
+		name := path.Join(dir, segmentName(base, ext))
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, false, failure.ToSystem(err, "os.Open failed for (%s)", name)
+		}
+
+		format, err := readFormat(f, magic)
+		_ = f.Close()
+		if err != nil {
+			return nil, false, failure.Wrap(err, "readFormat failed")
+		}
+
+		current = current && format.Version == CurrentVersion
+	}
+
+	return versions, current, nil
+}
+
+// convertSegment writes the segment's store into work in the current
+// version, reading it as from, and rebuilds both indexes next to it.
+func convertSegment(dir, work string, base uint64, from uint32, c Config) (MigratedSegment, error) {
+	report := MigratedSegment{BaseOffset: base, From: from}
+	if err := os.MkdirAll(work, 0755); err != nil {
+		return report, failure.ToSystem(err, "os.MkdirAll failed for (%s)", work)
+	}
+
+	storeFile := path.Join(dir, segmentName(base, StoreExt))
+	fi, err := os.Stat(storeFile)
+	if err != nil {
+		return report, failure.ToSystem(err, "os.Stat failed for (%s)", storeFile)
+	}
+
+	if err = convertStore(storeFile, path.Join(work, segmentName(base, StoreExt)), from); err != nil {
+		return report, failure.Wrap(err, "convertStore failed")
+	}
+
+	// the key the segment is encrypted with is needed to read it in work,
+	// the original key file stays where it is
+	keyFile := segmentName(base, KeyExt)
+	b, err := ioutil.ReadFile(path.Join(dir, keyFile))
+	switch {
+	case err == nil:
+		if err = ioutil.WriteFile(path.Join(work, keyFile), b, 0644); err != nil {
+			return report, failure.ToSystem(err, "ioutil.WriteFile failed for (%s)", keyFile)
+		}
+	case !os.IsNotExist(err):
+		return report, failure.ToSystem(err, "ioutil.ReadFile failed for (%s)", keyFile)
+	}
+
+	seg, err := NewSegment(work, base, c)
+	if err != nil {
+		return report, failure.Wrap(err, "NewSegment failed")
+	}
+
+	if report.TruncatedBytes, err = seg.Recover(); err != nil {
+		_ = seg.Close()
+		return report, failure.Wrap(err, "seg.Recover failed")
+	}
+	report.NextOffset = seg.NextOffset()
+
+	if err = seg.Close(); err != nil {
+		return report, failure.Wrap(err, "seg.Close failed")
+	}
+
+	// keep the age of the data so retention is not reset by the migration
+	converted := path.Join(work, segmentName(base, StoreExt))
+	if err = os.Chtimes(converted, fi.ModTime(), fi.ModTime()); err != nil {
+		return report, failure.ToSystem(err, "os.Chtimes failed for (%s)", converted)
+	}
+
+	return report, nil
+}
+
+// convertStore copies the store src, read as from, to dst with the current
+// header in front of it. Records are copied as they are, so an encrypted
+// store stays encrypted, Version0 frames get the checksum of their record.
+func convertStore(src, dst string, from uint32) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return failure.ToSystem(err, "os.Open failed for (%s)", src)
+	}
+	defer func() { _ = in.Close() }()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return failure.ToSystem(err, "os.OpenFile failed for (%s)", dst)
+	}
+
+	w := bufio.NewWriter(out)
+	if _, err = w.Write(header(StoreMagic)); err != nil {
+		_ = out.Close()
+		return failure.ToSystem(err, "w.Write failed for header of (%s)", dst)
+	}
+
+	switch from {
+	case Version0:
+		err = copyLegacyFrames(w, bufio.NewReader(in))
+	default:
+		if _, err = in.Seek(int64(headerWidths[from]), io.SeekStart); err != nil {
+			_ = out.Close()
+			return failure.ToSystem(err, "in.Seek failed for (%s)", src)
+		}
+		_, err = io.Copy(w, in)
+	}
+	if err != nil {
+		_ = out.Close()
+		return failure.Wrap(err, "copy failed for (%s)", src)
+	}
+
+	if err = w.Flush(); err != nil {
+		_ = out.Close()
+		return failure.ToSystem(err, "w.Flush failed for (%s)", dst)
+	}
+
+	// the copy must be on disk before it replaces the only other copy
+	if err = out.Sync(); err != nil {
+		_ = out.Close()
+		return failure.ToSystem(err, "out.Sync failed for (%s)", dst)
+	}
+
+	if err = out.Close(); err != nil {
+		return failure.ToSystem(err, "out.Close failed for (%s)", dst)
+	}
+
+	return nil
+}
+
+// copyLegacyFrames rewrites the [length][record] frames of a Version0 store
+// as [length][crc32][record]. A torn frame at the end is copied as it is,
+// the recovery that follows drops it and counts every byte of it.
+func copyLegacyFrames(w io.Writer, r io.Reader) error {
+	size := make([]byte, LenWidth)
+	for {
+		n, err := io.ReadFull(r, size)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			if _, err = w.Write(size[:n]); err != nil {
+				return failure.ToSystem(err, "w.Write failed for torn length")
+			}
+			return nil
+		}
+		if err != nil {
+			return failure.ToSystem(err, "io.ReadFull failed for length")
+		}
+
+		b, err := ioutil.ReadAll(io.LimitReader(r, int64(Enc.Uint64(size))))
+		if err != nil {
+			return failure.ToSystem(err, "ioutil.ReadAll failed for record")
+		}
+
+		if uint64(len(b)) < Enc.Uint64(size) {
+			if _, err = w.Write(append(size, b...)); err != nil {
+				return failure.ToSystem(err, "w.Write failed for torn record")
+			}
+			return nil
+		}
+
+		if _, err = w.Write(append(frameHeader(b), b...)); err != nil {
+			return failure.ToSystem(err, "w.Write failed")
+		}
+	}
+}
+
+// replaceSegment moves the converted files of a segment from work over the
+// originals. The store goes last, a crash before it leaves the original
+// store, which is not current, next to the new indexes and running the
+// migration again converts it once more.
+func replaceSegment(dir, work string, base uint64) error {
+	for _, ext := range []string{IndexExt, TimeIndexExt, StoreExt} {
+		name := segmentName(base, ext)
+		if err := os.Rename(path.Join(work, name), path.Join(dir, name)); err != nil {
+			return failure.ToSystem(err, "os.Rename failed for (%s)", name)
+		}
+	}
+
+	return nil
+}
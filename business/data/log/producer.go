@@ -0,0 +1,141 @@
+package log
+
+import (
+	"crypto/rand"
+
+	"github.com/rsb/failure"
+
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+)
+
+// ProducerWindow is how many of its most recent batches are remembered for
+// every producer. A retry of an older batch is rejected instead of being
+// answered with its offsets.
+const ProducerWindow = 5
+
+// NewProducerID returns a random producer id. Ids are not coordinated
+// between servers or logs, they are drawn from 64 random bits so two
+// producers never end up with the same one in practice. Zero is never
+// returned since it marks records appended without deduplication.
+func NewProducerID() (uint64, error) {
+	id, err := randomID()
+	if err != nil {
+		return 0, failure.Wrap(err, "randomID failed")
+	}
+
+	return id, nil
+}
+
+// randomID returns a random id that is never zero
+func randomID() (uint64, error) {
+	b := make([]byte, 8)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			return 0, failure.ToSystem(err, "rand.Read failed")
+		}
+
+		if id := Enc.Uint64(b); id != 0 {
+			return id, nil
+		}
+	}
+}
+
+// ProducerBatch is a run of records a producer appended with contiguous
+// sequences at contiguous offsets
+type ProducerBatch struct {
+	FirstSequence uint64 `json:"first_sequence"`
+	LastSequence  uint64 `json:"last_sequence"`
+	FirstOffset   uint64 `json:"first_offset"`
+}
+
+// offset returns the offset the record with seq was appended at
+func (b ProducerBatch) offset(seq uint64) uint64 {
+	return b.FirstOffset + seq - b.FirstSequence
+}
+
+// Producers remembers the last batches every idempotent producer appended
+// so a retried append is answered with the offsets it got the first time
+// instead of being appended again. Records with a producer id of zero are
+// not tracked. Sequences must increase for each producer but may skip
+// numbers, a producer writing to several partitions numbers its records
+// across all of them. Producers is not safe for concurrent use.
+type Producers struct {
+	batches map[uint64][]ProducerBatch
+}
+
+func NewProducers() *Producers {
+	return &Producers{batches: map[uint64][]ProducerBatch{}}
+}
+
+// Check validates the producer id and sequences of records before they are
+// appended. When every record was appended already it reports true and
+// sets each record's offset to the one it was appended at. A batch that is
+// neither new nor a known duplicate fails with failure.AlreadyExists and
+// records of more than one producer or with gaps in their sequences fail
+// with failure.InvalidParam.
+func (p *Producers) Check(records []*data.Record) (bool, error) {
+	id := records[0].ProducerId
+	first := records[0].Sequence
+	for i, record := range records {
+		if record.ProducerId != id {
+			return false, failure.InvalidParam("batch mixes producers (%d) and (%d)", id, record.ProducerId)
+		}
+
+		if id != 0 && record.Sequence != first+uint64(i) {
+			return false, failure.InvalidParam("sequence (%d) of producer (%d) does not follow (%d)", record.Sequence, id, first+uint64(i)-1)
+		}
+	}
+
+	batches := p.batches[id]
+	if id == 0 || len(batches) == 0 {
+		return false, nil
+	}
+
+	last := first + uint64(len(records)) - 1
+	if first > batches[len(batches)-1].LastSequence {
+		return false, nil
+	}
+
+	for _, b := range batches {
+		if first >= b.FirstSequence && last <= b.LastSequence {
+			for _, record := range records {
+				record.Offset = b.offset(record.Sequence)
+			}
+			return true, nil
+		}
+	}
+
+	return false, failure.AlreadyExists(
+		"sequence (%d) of producer (%d) is not after the last one appended (%d)",
+		first, id, batches[len(batches)-1].LastSequence,
+	)
+}
+
+// Add remembers records once they were appended. A record that follows the
+// producer's last batch in both sequence and offset extends it.
+func (p *Producers) Add(records []*data.Record) {
+	for _, record := range records {
+		if record.ProducerId == 0 {
+			continue
+		}
+
+		batches := p.batches[record.ProducerId]
+		if n := len(batches); n > 0 {
+			b := &batches[n-1]
+			if record.Sequence == b.LastSequence+1 && record.Offset == b.offset(record.Sequence) {
+				b.LastSequence = record.Sequence
+				continue
+			}
+		}
+
+		batches = append(batches, ProducerBatch{
+			FirstSequence: record.Sequence,
+			LastSequence:  record.Sequence,
+			FirstOffset:   record.Offset,
+		})
+		if len(batches) > ProducerWindow {
+			batches = batches[len(batches)-ProducerWindow:]
+		}
+		p.batches[record.ProducerId] = batches
+	}
+}
@@ -0,0 +1,112 @@
+package log_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/rsb/failure"
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+	"github.com/rsb/prolog/business/data/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewProducerID(t *testing.T) {
+	a, err := log.NewProducerID()
+	require.NoError(t, err)
+	b, err := log.NewProducerID()
+	require.NoError(t, err)
+
+	require.NotZero(t, a)
+	require.NotEqual(t, a, b)
+}
+
+func TestProducers(t *testing.T) {
+	p := log.NewProducers()
+	appended := func(seq, off uint64) *data.Record {
+		return &data.Record{ProducerId: 1, Sequence: seq, Offset: off}
+	}
+
+	// an unknown producer may start at any sequence
+	dup, err := p.Check([]*data.Record{appended(10, 0)})
+	require.NoError(t, err)
+	require.False(t, dup)
+	p.Add([]*data.Record{appended(10, 0), appended(11, 1)})
+
+	// sequences may skip numbers, the producer wrote to another partition
+	dup, err = p.Check([]*data.Record{appended(20, 0)})
+	require.NoError(t, err)
+	require.False(t, dup)
+	p.Add([]*data.Record{appended(20, 5)})
+
+	// a retry of part of a batch gets the offsets of those records
+	retry := &data.Record{ProducerId: 1, Sequence: 11}
+	dup, err = p.Check([]*data.Record{retry})
+	require.NoError(t, err)
+	require.True(t, dup)
+	require.Equal(t, uint64(1), retry.Offset)
+
+	// the oldest batches are forgotten once the window is full
+	for i := uint64(0); i < log.ProducerWindow; i++ {
+		p.Add([]*data.Record{appended(30+2*i, 10+2*i)})
+	}
+	_, err = p.Check([]*data.Record{{ProducerId: 1, Sequence: 11}})
+	require.True(t, failure.IsAlreadyExists(err), err)
+
+	_, err = p.Check([]*data.Record{{ProducerId: 1, Sequence: 50}, {ProducerId: 2, Sequence: 51}})
+	require.True(t, failure.IsInvalidParam(err), err)
+
+	// nothing is tracked without a producer id
+	p.Add([]*data.Record{{Offset: 99}})
+	dup, err = p.Check([]*data.Record{{Offset: 99}})
+	require.NoError(t, err)
+	require.False(t, dup)
+}
+
+func TestLog_Producers(t *testing.T) {
+	for scenario, crash := range map[string]bool{
+		"clean shutdown": false,
+		"crash":          true,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "producers-test")
+			require.NoError(t, err)
+			defer func() { _ = os.RemoveAll(dir) }()
+
+			c := log.Config{}
+			c.Segment.MaxStoreBytes = 64
+			l, err := log.NewLog(dir, c)
+			require.NoError(t, err)
+
+			for seq := uint64(0); seq < 4; seq++ {
+				_, err = l.Append(&data.Record{Value: []byte("hello world"), ProducerId: 3, Sequence: seq})
+				require.NoError(t, err)
+			}
+			require.NoError(t, l.Close())
+
+			if crash {
+				// without the state saved by Close, the records are scanned
+				require.NoError(t, os.Remove(path.Join(dir, log.CleanShutdownFile)))
+				require.NoError(t, os.Remove(path.Join(dir, log.StateFile)))
+			}
+
+			l, err = log.NewLog(dir, c)
+			require.NoError(t, err)
+
+			off, err := l.Append(&data.Record{Value: []byte("hello world"), ProducerId: 3, Sequence: 2})
+			require.NoError(t, err)
+			require.Equal(t, uint64(2), off)
+
+			off, err = l.Append(&data.Record{Value: []byte("hello world"), ProducerId: 3, Sequence: 4})
+			require.NoError(t, err)
+			require.Equal(t, uint64(4), off)
+			require.NoError(t, l.Close())
+
+			// the state of the producers is not mistaken for a segment
+			report, err := log.Verify(dir, log.Config{})
+			require.NoError(t, err)
+			require.True(t, report.OK(), report.Problems)
+		})
+	}
+}
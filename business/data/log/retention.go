@@ -0,0 +1,92 @@
+package log
+
+import (
+	"time"
+
+	"github.com/rsb/failure"
+)
+
+// EnforceRetention removes the oldest sealed segments that fall outside of
+// the retention policy as of now. Only a contiguous run of segments from the
+// start of the log is removed so the log never ends up with holes in it, and
+// the active segment is never touched. With a remote tier only segments that
+// were uploaded are removed.
+func (l *Log) EnforceRetention(now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkOpen(); err != nil {
+		return failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	if err := l.retain(now); err != nil {
+		return failure.Wrap(err, "l.retain failed")
+	}
+
+	return nil
+}
+
+// retain applies the retention policy. A segment is removed when it is older
+// than MaxAge or while the log is over its MaxLogBytes budget. The caller
+// must hold the write lock.
+func (l *Log) retain(now time.Time) error {
+	r := l.Config.Retention
+	total := l.size()
+
+	var removed int
+	for _, s := range l.segments {
+		if s == l.activeSegment {
+			break
+		}
+
+		var reason string
+		age := now.Sub(s.LastModified())
+		switch {
+		case r.MaxAge > 0 && age > r.MaxAge:
+			reason = "max-age"
+		case r.MaxLogBytes > 0 && total > r.MaxLogBytes:
+			reason = "max-log-bytes"
+		}
+
+		if reason == "" {
+			break
+		}
+
+		// retention only applies to the local tier, a segment that was not
+		// uploaded yet holds the only copy of its records
+		if l.isTiered() && !l.isRemote(s.BaseOffset()) {
+			break
+		}
+
+		size := s.Size()
+		if err := s.Remove(); err != nil {
+			l.segments = l.segments[removed:]
+			return failure.Wrap(err, "s.Remove failed (%d)", s.BaseOffset())
+		}
+		removed++
+		total -= size
+
+		l.Config.Logger.Infow("retention",
+			"status", "segment removed",
+			"reason", reason,
+			"dir", l.Dir,
+			"base-offset", s.BaseOffset(),
+			"next-offset", s.NextOffset(),
+			"age", age.String(),
+			"segment-bytes", size,
+			"log-bytes", total,
+		)
+	}
+
+	l.segments = l.segments[removed:]
+	if removed > 0 {
+		l.transactions.Prune(l.lowest())
+	}
+
+	return nil
+}
+
+// isRetentionEnabled is true when any retention policy is configured
+func (l *Log) isRetentionEnabled() bool {
+	return l.Config.Retention.MaxAge > 0 || l.Config.Retention.MaxLogBytes > 0
+}
@@ -0,0 +1,241 @@
+package log_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+	"github.com/rsb/prolog/business/data/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog_EnforceRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 16
+	c.Retention.MaxAge = time.Hour
+	c.Retention.CheckInterval = time.Hour
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	rec := &data.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(rec)
+		require.NoError(t, err)
+	}
+
+	// nothing is old enough yet
+	require.NoError(t, l.EnforceRetention(time.Now()))
+	off, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// every sealed segment has expired, the active one must survive
+	require.NoError(t, l.EnforceRetention(time.Now().Add(2*time.Hour)))
+	off, err = l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	_, err = l.Read(2)
+	require.Error(t, err)
+
+	off, err = l.Append(rec)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+func TestLog_RetentionAgeFromRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 16
+	c.Retention.MaxAge = 90 * time.Minute
+	c.Retention.CheckInterval = time.Hour
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+
+	rec := &data.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(rec)
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	// rewriting a store, as recovery does, must not make its records younger
+	later := time.Now().Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, os.Chtimes(path.Join(dir, fmt.Sprintf("%d%s", i, log.StoreExt)), later, later))
+	}
+
+	l, err = log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	require.NoError(t, l.EnforceRetention(time.Now().Add(2*time.Hour)))
+	off, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+func TestLog_RetentionInBackground(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention-bg-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 16
+	c.Retention.MaxAge = time.Nanosecond
+	c.Retention.CheckInterval = 10 * time.Millisecond
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+
+	rec := &data.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(rec)
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		off, err := l.LowestOffset()
+		return err == nil && off == 3
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, l.Close())
+}
+
+func TestLog_RetentionNoBackground(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention-nobg-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 16
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+
+	rec := &data.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(rec)
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	c.NoBackground = true
+	c.Retention.MaxAge = time.Nanosecond
+	c.Retention.CheckInterval = 10 * time.Millisecond
+	l, err = log.NewLog(dir, c)
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	off, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	require.NoError(t, l.Close())
+}
+
+func TestLog_RetentionMaxLogBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "retention-size-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 16
+	c.Retention.MaxLogBytes = 100
+	c.Retention.CheckInterval = time.Hour
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	rec := &data.Record{Value: []byte("hello world")}
+	var off uint64
+	for i := 0; i < 5; i++ {
+		off, err = l.Append(rec)
+		require.NoError(t, err)
+		require.LessOrEqual(t, l.Size(), c.Retention.MaxLogBytes)
+	}
+
+	lowest, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.NotZero(t, lowest)
+
+	_, err = l.Read(lowest - 1)
+	require.Error(t, err)
+
+	read, err := l.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, rec.Value, read.Value)
+}
+
+func TestLog_RollExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roll-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := log.Config{}
+	c.Segment.MaxAge = time.Hour
+	c.Retention.MaxAge = time.Hour
+	c.Retention.CheckInterval = time.Hour
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	rec := &data.Record{Value: []byte("hello world")}
+	for i := 0; i < 2; i++ {
+		_, err = l.Append(rec)
+		require.NoError(t, err)
+	}
+
+	// the active segment is neither full nor old enough to be sealed
+	require.NoError(t, l.RollExpired(time.Now()))
+	require.NoError(t, l.EnforceRetention(time.Now().Add(2*time.Hour)))
+	off, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// once sealed on age retention can remove it
+	require.NoError(t, l.RollExpired(time.Now().Add(2*time.Hour)))
+	require.NoError(t, l.EnforceRetention(time.Now().Add(2*time.Hour)))
+	off, err = l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	off, err = l.Append(rec)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+func TestLog_RollExpiredOnAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roll-append-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := log.Config{}
+	c.Segment.MaxAge = 10 * time.Millisecond
+	c.Retention.CheckInterval = time.Hour
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	rec := &data.Record{Value: []byte("hello world")}
+	_, err = l.Append(rec)
+	require.NoError(t, err)
+
+	time.Sleep(20 * time.Millisecond)
+	off, err := l.Append(rec)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+
+	_, err = os.Stat(path.Join(dir, "1"+log.StoreExt))
+	require.NoError(t, err)
+}
@@ -1,9 +1,13 @@
 package log
 
 import (
-	"fmt"
+	"errors"
+	"io"
 	"os"
 	"path"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	data "github.com/rsb/prolog/app/api/handlers/v1"
 	"google.golang.org/protobuf/proto"
@@ -14,8 +18,14 @@ import (
 type Segment struct {
 	store      *Store
 	index      *Index
+	timeIndex  *TimeIndex
 	baseOffset uint64
+	// nextOffset is the offset the next record is written at, published
+	// is the offset readers see as the next one. Records between the two
+	// were written but not published yet.
 	nextOffset uint64
+	published  atomic.Uint64
+	modTime    time.Time
 	config     Config
 }
 
@@ -23,10 +33,12 @@ func NewSegment(dir string, baseOffset uint64, c Config) (*Segment, error) {
 	var err error
 	var nextOffset uint64
 
-	sf := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store"))
-	storeFile, err := os.OpenFile(sf, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	// new files are created with the header of the current version while
+	// existing ones are read according to the version in their header
+	sf := path.Join(dir, segmentName(baseOffset, StoreExt))
+	storeFile, err := openSegmentFile(sf, os.O_RDWR|os.O_APPEND, StoreMagic)
 	if err != nil {
-		return nil, failure.ToSystem(err, "os.OpenFile failed for (storeFile)")
+		return nil, failure.Wrap(err, "openSegmentFile failed for (storeFile)")
 	}
 
 	store, err := NewStore(storeFile)
@@ -34,10 +46,19 @@ func NewSegment(dir string, baseOffset uint64, c Config) (*Segment, error) {
 		return nil, failure.Wrap(err, "NewSTore failed")
 	}
 
-	idxF := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index"))
-	idxFile, err := os.OpenFile(idxF, os.O_RDWR|os.O_CREATE, 0644)
+	if store.aead, err = segmentCipher(dir, baseOffset, c, store.size == store.format.Header); err != nil {
+		return nil, failure.Wrap(err, "segmentCipher failed")
+	}
+
+	fi, err := storeFile.Stat()
+	if err != nil {
+		return nil, failure.ToSystem(err, "storeFile.Stat failed")
+	}
+
+	idxF := path.Join(dir, segmentName(baseOffset, IndexExt))
+	idxFile, err := openSegmentFile(idxF, os.O_RDWR, IndexMagic)
 	if err != nil {
-		return nil, failure.ToSystem(err, "os.OpenFile failed for (indexFile)")
+		return nil, failure.Wrap(err, "openSegmentFile failed for (indexFile)")
 	}
 
 	idx, err := NewIndex(idxFile, c)
@@ -45,7 +66,18 @@ func NewSegment(dir string, baseOffset uint64, c Config) (*Segment, error) {
 		return nil, failure.Wrap(err, "NewIndex failed")
 	}
 
-	off, _, err := idx.Read(-1)
+	tiF := path.Join(dir, segmentName(baseOffset, TimeIndexExt))
+	tiFile, err := openSegmentFile(tiF, os.O_RDWR, TimeIndexMagic)
+	if err != nil {
+		return nil, failure.Wrap(err, "openSegmentFile failed for (timeIndexFile)")
+	}
+
+	timeIdx, err := NewTimeIndex(tiFile, c)
+	if err != nil {
+		return nil, failure.Wrap(err, "NewTimeIndex failed")
+	}
+
+	off, lastPos, err := idx.Read(-1)
 	if err != nil {
 		nextOffset = baseOffset
 	} else {
@@ -55,64 +87,195 @@ func NewSegment(dir string, baseOffset uint64, c Config) (*Segment, error) {
 	s := Segment{
 		store:      store,
 		index:      idx,
+		timeIndex:  timeIdx,
 		baseOffset: baseOffset,
 		nextOffset: nextOffset,
+		modTime:    fi.ModTime(),
 		config:     c,
 	}
 
+	// records after the last entry of a sparse index are only found in the
+	// store. Reading stops at the first bad record, Recover deals with those
+	// as well as with an index that was not closed, which is zero padded so
+	// its last entry points at the start of the store.
+	padded := off == 0 && lastPos == 0 && idx.size.Load() > EntWidth
+	if err == nil && !padded {
+		_ = s.scanFrom(lastPos, func(_ uint64, record *data.Record) error {
+			s.nextOffset = record.Offset + 1
+			return nil
+		})
+	}
+	s.published.Store(s.nextOffset)
+
 	return &s, nil
 }
 
+// NextOffset returns the offset after the last record readers can see
 func (s *Segment) NextOffset() uint64 {
-	return s.nextOffset
+	return s.published.Load()
 }
 
 func (s *Segment) BaseOffset() uint64 {
 	return s.baseOffset
 }
 
+// LastModified is the time the newest record was appended to the segment,
+// taken from its time index so rewriting the store does not change it.
+// Segments without timestamped records fall back to the modification time
+// of their store.
+func (s *Segment) LastModified() time.Time {
+	if ts, _, err := s.timeIndex.Last(); err == nil {
+		return time.Unix(0, ts)
+	}
+
+	return s.modTime
+}
+
+// IsExpired reports whether the first record in the segment was appended
+// more than maxAge before now. An empty segment never expires. Segments
+// written before records carried timestamps use their modification time.
+func (s *Segment) IsExpired(now time.Time, maxAge time.Duration) bool {
+	if maxAge <= 0 || s.nextOffset == s.baseOffset {
+		return false
+	}
+
+	first := s.modTime
+	if ts, _, err := s.timeIndex.First(); err == nil {
+		first = time.Unix(0, ts)
+	}
+
+	return now.Sub(first) >= maxAge
+}
+
 // Append writes the record to the segment and returns the newly appended
 // record's offset. The segment appends the record in a two-step process:
 // it appends the data to the store and then adds an index entry. Since the
 // offsets are relative to the base offset, we subtract the segment's next
 // offset from its base offset (which are both absolute offsets) to get the
 // entry's relative offset in the segment. We then increment the next offset
-// to prep for a future append.
+// to prep for a future append. The record is stamped with the time it was
+// appended, in nanoseconds since the unix epoch, and published to readers.
 func (s *Segment) Append(record *data.Record) (uint64, error) {
-	var err error
+	off, err := s.append(record)
+	if err != nil {
+		return 0, failure.Wrap(err, "s.append failed")
+	}
+
+	if err = s.publish(); err != nil {
+		return 0, failure.Wrap(err, "s.publish failed")
+	}
+
+	return off, nil
+}
+
+// append is Append without publishing the record, the log appends a whole
+// batch before it publishes them together.
+func (s *Segment) append(record *data.Record) (uint64, error) {
+	record.Offset = s.nextOffset
+	record.Timestamp = time.Now().UnixNano()
+	if err := s.write(record); err != nil {
+		return 0, failure.Wrap(err, "s.write failed")
+	}
+
+	return record.Offset, nil
+}
 
-	cur := s.nextOffset
-	record.Offset = cur
+// publish makes every record written so far visible to readers. The store
+// is flushed before the next offset moves, so a reader never finds an
+// offset whose bytes are not in the file yet. The indexes need no step of
+// their own, readers only look up offsets below the next offset.
+func (s *Segment) publish() error {
+	if err := s.store.Flush(); err != nil {
+		return failure.Wrap(err, "s.store.Flush failed")
+	}
+
+	s.published.Store(s.nextOffset)
+	return nil
+}
+
+// seal publishes the segment and maps its store into memory once nothing is
+// appended to it anymore.
+func (s *Segment) seal() error {
+	if err := s.publish(); err != nil {
+		return failure.Wrap(err, "s.publish failed")
+	}
+
+	if err := s.store.seal(); err != nil {
+		return failure.Wrap(err, "s.store.seal failed")
+	}
+
+	return nil
+}
+
+// write persists record at the offset it already carries, which must not be
+// lower than the segment's next offset. Compaction uses this directly to copy
+// records into a new segment without changing their offsets.
+func (s *Segment) write(record *data.Record) error {
+	if record.Offset < s.nextOffset {
+		return failure.InvalidParam("offset (%d) is behind the segment's next offset (%d)", record.Offset, s.nextOffset)
+	}
 
 	p, err := proto.Marshal(record)
 	if err != nil {
-		return 0, failure.ToSystem(err, "proto.Marshal failed")
+		return failure.ToSystem(err, "proto.Marshal failed")
 	}
 
 	_, pos, err := s.store.Append(p)
 	if err != nil {
-		return 0, failure.Wrap(err, "s.store.Append failed")
+		return failure.Wrap(err, "s.store.Append failed")
+	}
+
+	if err = s.indexRecord(record, pos); err != nil {
+		return failure.Wrap(err, "s.indexRecord failed")
+	}
+
+	s.nextOffset = record.Offset + 1
+	s.modTime = time.Now()
+	return nil
+}
+
+// indexRecord adds the index entries for a record written at pos in the
+// store. With a sparse index only the first record and then the first one
+// at least Segment.IndexIntervalBytes past the last indexed record get an
+// entry. The time index follows the offset index so it stays just as sparse.
+func (s *Segment) indexRecord(record *data.Record, pos uint64) error {
+	if interval := s.config.Segment.IndexIntervalBytes; interval > 0 {
+		if _, last, err := s.index.Read(-1); err == nil && pos-last < interval {
+			return nil
+		}
 	}
 
-	if err = s.index.Write(uint32(s.nextOffset-s.baseOffset), pos); err != nil {
-		return 0, failure.Wrap(err, "s.index.Write failed")
+	rel := uint32(record.Offset - s.baseOffset)
+	if err := s.index.Write(rel, pos); err != nil {
+		return failure.Wrap(err, "s.index.Write failed")
 	}
 
-	s.nextOffset++
-	return cur, nil
+	if err := s.timeIndex.Write(record.Timestamp, rel); err != nil {
+		return failure.Wrap(err, "s.timeIndex.Write failed")
+	}
+
+	return nil
 }
 
 // Read fetches the record for a given offset. Similar to writes, to read a
 // record the segment must first translate the absolute index into a relative
 // offset and get the associated index entry. Once it has the index try, the
 // segment can go straight to the record's position in the store and read the
-// proper amount of data.
+// proper amount of data. A dense index that was never compacted has an entry
+// for every offset so the entry is read directly. Otherwise the store is
+// scanned forward from the nearest entry below the offset, and an offset
+// that is not found there was compacted away.
 func (s *Segment) Read(off uint64) (*data.Record, error) {
+	// the indexes may already hold entries for records that are not
+	// published yet
+	if off >= s.NextOffset() {
+		return nil, failure.OutOfRange("offset (%d) is past the end of segment (%d)", off, s.baseOffset)
+	}
 
 	in := int64(off - s.baseOffset)
-	_, pos, err := s.index.Read(in)
-	if err != nil {
-		return nil, failure.Wrap(err, "s.index.Read failed (%d)", in)
+	rel, pos, err := s.index.Read(in)
+	if err != nil || int64(rel) != in {
+		return s.seek(off)
 	}
 
 	p, err := s.store.Read(pos)
@@ -128,17 +291,229 @@ func (s *Segment) Read(off uint64) (*data.Record, error) {
 	return &record, nil
 }
 
+// seek finds off by scanning the store forward from the nearest index entry
+// below it.
+func (s *Segment) seek(off uint64) (*data.Record, error) {
+	_, pos, err := s.index.Floor(uint32(off - s.baseOffset))
+	if errors.Is(err, io.EOF) {
+		return nil, failure.NotFound("offset (%d) was removed by compaction", off)
+	}
+	if err != nil {
+		return nil, failure.Wrap(err, "s.index.Floor failed (%d)", off)
+	}
+
+	var found *data.Record
+	err = s.scanFrom(pos, func(_ uint64, record *data.Record) error {
+		if record.Offset < off {
+			return nil
+		}
+
+		if record.Offset == off {
+			found = record
+		}
+		return errStopScan
+	})
+	if err != nil {
+		return nil, failure.Wrap(err, "s.scanFrom failed (%d)", pos)
+	}
+
+	if found == nil {
+		return nil, failure.NotFound("offset (%d) was removed by compaction", off)
+	}
+
+	return found, nil
+}
+
+// OffsetForTime returns the offset of the first record appended at or after
+// ts, in nanoseconds since the unix epoch. The time index may be sparse so
+// the store is scanned forward from the newest entry older than ts. It
+// returns io.EOF when every record in the segment is older than ts.
+func (s *Segment) OffsetForTime(ts int64) (uint64, error) {
+	pos := s.store.format.Header
+	if off, err := s.timeIndex.Before(ts); err == nil {
+		if _, pos, err = s.index.Floor(off); err != nil {
+			return 0, failure.Wrap(err, "s.index.Floor failed (%d)", off)
+		}
+	}
+
+	found := false
+	var off uint64
+	err := s.scanFrom(pos, func(_ uint64, record *data.Record) error {
+		if record.Timestamp < ts {
+			return nil
+		}
+
+		found = true
+		off = record.Offset
+		return errStopScan
+	})
+	if err != nil {
+		return 0, failure.Wrap(err, "s.scanFrom failed (%d)", pos)
+	}
+
+	if !found {
+		return 0, io.EOF
+	}
+
+	return off, nil
+}
+
+// errStopScan ends a scan early without failing it
+var errStopScan = errors.New("stop scan")
+
+// scan calls fn for every record in the store in the order they were
+// written along with the record's position in the store.
+func (s *Segment) scan(fn func(pos uint64, record *data.Record) error) error {
+	return s.scanFrom(s.store.format.Header, fn)
+}
+
+// scanFrom is scan starting at the record at pos. When fn returns
+// errStopScan the scan ends without an error.
+func (s *Segment) scanFrom(pos uint64, fn func(pos uint64, record *data.Record) error) error {
+	for {
+		p, err := s.store.Read(pos)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return failure.Wrap(err, "s.store.Read failed (%d)", pos)
+		}
+
+		record := data.Record{}
+		if err = proto.Unmarshal(p, &record); err != nil {
+			return failure.ToSystem(err, "proto.Unmarshal failed (%d)", pos)
+		}
+
+		if err = fn(pos, &record); err != nil {
+			if errors.Is(err, errStopScan) {
+				return nil
+			}
+			return err
+		}
+		pos += s.store.frameSize(p)
+	}
+}
+
 // IsMaxed returns whether the segment has reached its max size, either by
 // writing too much to the store or index. If you wrote a small number of long
 // logs, then you'd hit the segment bytes limit; if you wrote a lot of small
 // logs, then you'd hit the index bytes limit. The log uses this method to know
 // it needs to create a new segment.
 func (s *Segment) IsMaxed() bool {
-	return s.store.size >= s.config.Segment.MaxStoreBytes ||
-		s.index.size >= s.config.Segment.MaxIndexBytes
+	return s.store.size-s.store.format.Header >= s.config.Segment.MaxStoreBytes ||
+		s.index.size.Load() >= s.config.Segment.MaxIndexBytes
 }
 
-// Remove closes the segment and removes the index and store files
+// copyTo writes the records that keep returns true for to a new segment in
+// dir with the same base offset, preserving their offsets. It returns the new
+// segment, still open, and the number of records that were dropped.
+func (s *Segment) copyTo(dir string, keep func(record *data.Record) bool) (*Segment, uint64, error) {
+	seg, err := NewSegment(dir, s.baseOffset, s.config)
+	if err != nil {
+		return nil, 0, failure.Wrap(err, "NewSegment failed")
+	}
+
+	var dropped uint64
+	err = s.scan(func(_ uint64, record *data.Record) error {
+		if !keep(record) {
+			dropped++
+			return nil
+		}
+
+		return seg.write(record)
+	})
+	if err != nil {
+		_ = seg.Close()
+		return nil, 0, failure.Wrap(err, "s.scan failed")
+	}
+
+	if err = seg.publish(); err != nil {
+		_ = seg.Close()
+		return nil, 0, failure.Wrap(err, "seg.publish failed")
+	}
+
+	return seg, dropped, nil
+}
+
+// Recover rebuilds the segment's indexes by scanning its store. Records are
+// read from the start of the store until the first one that is missing,
+// truncated, fails its checksum, can not be decoded or does not have a higher
+// offset than the record before it, and everything from that point on is cut
+// from the store. It returns the number of bytes that were dropped.
+func (s *Segment) Recover() (uint64, error) {
+	pos := s.store.format.Header
+
+	s.index.Reset()
+	s.timeIndex.Reset()
+	s.nextOffset = s.baseOffset
+	for {
+		p, err := s.store.Read(pos)
+		if errors.Is(err, io.EOF) || IsCorrupt(err) {
+			break
+		}
+		if err != nil {
+			return 0, failure.Wrap(err, "s.store.Read failed (%d)", pos)
+		}
+
+		record := data.Record{}
+		if err = proto.Unmarshal(p, &record); err != nil {
+			break
+		}
+
+		// compaction leaves holes in the offsets but they always increase
+		if record.Offset < s.nextOffset {
+			break
+		}
+
+		err = s.indexRecord(&record, pos)
+		if errors.Is(err, io.EOF) {
+			// the store holds more records than the index can address, which
+			// only happens when MaxIndexBytes was lowered. Cutting the store
+			// here would throw away good data so we refuse instead.
+			return 0, failure.Config("segment (%d) holds more records than MaxIndexBytes (%d) allows", s.baseOffset, s.config.Segment.MaxIndexBytes)
+		}
+		if err != nil {
+			return 0, failure.Wrap(err, "s.indexRecord failed")
+		}
+
+		s.nextOffset = record.Offset + 1
+		pos += s.store.frameSize(p)
+	}
+
+	// the store is only written to when there is something to cut, and its
+	// age is kept so retention is not reset by the recovery
+	dropped := s.store.size - pos
+	if dropped > 0 {
+		if err := s.store.Truncate(pos); err != nil {
+			return 0, failure.Wrap(err, "s.store.Truncate failed (%d)", pos)
+		}
+
+		if err := os.Chtimes(s.store.Name(), s.modTime, s.modTime); err != nil {
+			return 0, failure.ToSystem(err, "os.Chtimes failed for (%s)", s.store.Name())
+		}
+	}
+	s.published.Store(s.nextOffset)
+
+	return dropped, nil
+}
+
+// Size returns the number of bytes published in the segment's store plus
+// the size of its indexes
+func (s *Segment) Size() uint64 {
+	return s.store.published.Load() + s.index.size.Load() + s.timeIndex.size.Load()
+}
+
+// Sync commits the segment's store to stable storage. The indexes are not
+// synced since they are rebuilt from the store after a crash.
+func (s *Segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return failure.Wrap(err, "s.store.Sync failed")
+	}
+
+	return nil
+}
+
+// Remove closes the segment and removes the index, time index and store files
 func (s *Segment) Remove() error {
 	if err := s.Close(); err != nil {
 		return failure.Wrap(err, "s.Close failed")
@@ -148,19 +523,32 @@ func (s *Segment) Remove() error {
 		return failure.ToSystem(err, "os.Remove failed for index")
 	}
 
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return failure.ToSystem(err, "os.Remove failed for time index")
+	}
+
 	if err := os.Remove(s.store.Name()); err != nil {
 		return failure.ToSystem(err, "os.Remove failed for store")
 	}
 
+	keyFile := strings.TrimSuffix(s.store.Name(), StoreExt) + KeyExt
+	if err := os.Remove(keyFile); err != nil && !os.IsNotExist(err) {
+		return failure.ToSystem(err, "os.Remove failed for key")
+	}
+
 	return nil
 }
 
-// Close will close both the index and the store files
+// Close will close the index, time index and store files
 func (s *Segment) Close() error {
 	if err := s.index.Close(); err != nil {
 		return failure.Wrap(err, "s.index.Close failed")
 	}
 
+	if err := s.timeIndex.Close(); err != nil {
+		return failure.Wrap(err, "s.timeIndex.Close failed")
+	}
+
 	if err := s.store.Close(); err != nil {
 		return failure.Wrap(err, "s.store.Close failed")
 	}
@@ -2,12 +2,16 @@ package log_test
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
+	"time"
 
 	"github.com/rsb/prolog/business/data/log"
+	"google.golang.org/protobuf/proto"
 
 	data "github.com/rsb/prolog/app/api/handlers/v1"
 
@@ -64,3 +68,151 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, seg.IsMaxed())
 }
+
+func TestSegment_Recover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment-recover-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	want := &data.Record{Value: []byte("hello world")}
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	seg, err := log.NewSegment(dir, 16, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = seg.Append(want)
+		require.NoError(t, err)
+	}
+	_, err = seg.Read(18)
+	require.NoError(t, err)
+
+	// reopening without a close leaves the index zero padded
+	seg, err = log.NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.NotEqual(t, uint64(19), seg.NextOffset())
+
+	dropped, err := seg.Recover()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), dropped)
+	require.Equal(t, uint64(19), seg.NextOffset())
+
+	for off := uint64(16); off < 19; off++ {
+		got, err := seg.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+}
+
+func TestSegment_RecordMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment-metadata-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	// a record written before keys, headers and producer timestamps existed
+	f, err := os.OpenFile(path.Join(dir, "0"+log.StoreExt), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	store, err := log.NewStore(f)
+	require.NoError(t, err)
+	legacy, err := proto.Marshal(&data.Record{Value: []byte("legacy"), Offset: 0})
+	require.NoError(t, err)
+	_, _, err = store.Append(legacy)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	seg, err := log.NewSegment(dir, 0, c)
+	require.NoError(t, err)
+	_, err = seg.Recover()
+	require.NoError(t, err)
+
+	want := &data.Record{
+		Value: []byte("hello world"),
+		Key:   []byte("user-1"),
+		Headers: []*data.Header{
+			{Key: "trace-id", Value: []byte("abc")},
+			{Key: "content-type", Value: []byte("text/plain")},
+		},
+		ProducerTimestamp: 1650000000000000000,
+	}
+	off, err := seg.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.NoError(t, seg.Close())
+
+	seg, err = log.NewSegment(dir, 0, c)
+	require.NoError(t, err)
+	defer func() { _ = seg.Close() }()
+
+	got, err := seg.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("legacy"), got.Value)
+	require.Empty(t, got.Key)
+	require.Empty(t, got.Headers)
+	require.Zero(t, got.ProducerTimestamp)
+
+	got, err = seg.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, want.Key, got.Key)
+	require.Equal(t, want.ProducerTimestamp, got.ProducerTimestamp)
+	require.Len(t, got.Headers, 2)
+	for i, h := range want.Headers {
+		require.Equal(t, h.Key, got.Headers[i].Key)
+		require.Equal(t, h.Value, got.Headers[i].Value)
+	}
+}
+
+func TestSegment_SparseIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment-sparse-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 4096
+	c.Segment.MaxIndexBytes = 3 * log.EntWidth
+	c.Segment.IndexIntervalBytes = 100
+
+	seg, err := log.NewSegment(dir, 16, c)
+	require.NoError(t, err)
+
+	var times []time.Time
+	for !seg.IsMaxed() {
+		times = append(times, time.Now())
+		_, err = seg.Append(&data.Record{Value: []byte(fmt.Sprintf("record %d", seg.NextOffset()))})
+		require.NoError(t, err)
+	}
+
+	// a dense index would have been full after three records
+	n := len(times)
+	require.Greater(t, n, 3)
+	require.NoError(t, seg.Close())
+
+	seg, err = log.NewSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer func() { _ = seg.Close() }()
+	require.Equal(t, uint64(16+n), seg.NextOffset())
+
+	for i := 0; i < n; i++ {
+		off := uint64(16 + i)
+		got, err := seg.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", off)), got.Value)
+
+		found, err := seg.OffsetForTime(times[i].UnixNano())
+		require.NoError(t, err)
+		require.Equal(t, off, found)
+	}
+
+	report, err := log.Verify(dir, c)
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.Problems)
+	require.Equal(t, uint64(n), report.Segments[0].Records)
+	require.Less(t, report.Segments[0].IndexEntries, uint64(n))
+}
@@ -0,0 +1,379 @@
+package log
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rsb/failure"
+)
+
+const (
+	// ManifestFile is the last entry of a snapshot archive. It describes
+	// every segment in the archive and is written last so a truncated
+	// archive is detected when it is restored.
+	ManifestFile = "manifest.json"
+	// SnapshotVersion is the version of the snapshot archive format
+	SnapshotVersion = 1
+)
+
+// Manifest describes the segments held by a snapshot archive
+type Manifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+	// HighWaterMark is the next offset of the log when the snapshot was
+	// taken, records appended after it are not in the snapshot.
+	HighWaterMark uint64            `json:"highWaterMark"`
+	Segments      []ManifestSegment `json:"segments"`
+}
+
+// ManifestSegment describes the store of a single segment in a snapshot
+type ManifestSegment struct {
+	BaseOffset uint64 `json:"baseOffset"`
+	NextOffset uint64 `json:"nextOffset"`
+	StoreBytes uint64 `json:"storeBytes"`
+	// SHA256 is the hex encoded checksum of the store's bytes
+	SHA256 string `json:"sha256"`
+	// KeyID is the key the store is encrypted with, empty for plain text
+	KeyID string `json:"keyId,omitempty"`
+}
+
+// snapshotSegment is a store captured for a snapshot. The file is opened
+// while holding the read lock so retention or compaction replacing the
+// segment afterwards does not change what the snapshot sees.
+type snapshotSegment struct {
+	ManifestSegment
+	file *os.File
+}
+
+// Snapshot writes a tar archive of the log to w. It holds the store of every
+// local segment up to the log's high-water mark followed by a manifest with
+// their offsets and checksums. Indexes are not archived, they are rebuilt
+// from the stores when the restored log is opened. Segments that were
+// offloaded to the remote tier are not archived either.
+//
+// The read lock is only held while the segments are captured, appends carry
+// on while the archive is written.
+func (l *Log) Snapshot(w io.Writer) (*Manifest, error) {
+	segments, m, err := l.captureSnapshot()
+	if err != nil {
+		return nil, failure.Wrap(err, "l.captureSnapshot failed")
+	}
+	defer func() {
+		for _, s := range segments {
+			_ = s.file.Close()
+		}
+	}()
+
+	tw := tar.NewWriter(w)
+	for _, s := range segments {
+		sum, err := writeSnapshotStore(tw, s)
+		if err != nil {
+			return nil, failure.Wrap(err, "writeSnapshotStore failed (%d)", s.BaseOffset)
+		}
+
+		s.SHA256 = sum
+		m.Segments = append(m.Segments, s.ManifestSegment)
+	}
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, failure.ToSystem(err, "json.MarshalIndent failed for manifest")
+	}
+
+	if err = writeSnapshotEntry(tw, ManifestFile, b); err != nil {
+		return nil, failure.Wrap(err, "writeSnapshotEntry failed (%s)", ManifestFile)
+	}
+
+	if err = tw.Close(); err != nil {
+		return nil, failure.ToSystem(err, "tw.Close failed")
+	}
+
+	return &m, nil
+}
+
+// captureSnapshot opens the store of every local segment and records how
+// many of its bytes belong to the snapshot. It holds appendMu so no append
+// lands between reading one segment and the next, the high-water mark and
+// every segment's size then describe the same log.
+func (l *Log) captureSnapshot() ([]*snapshotSegment, Manifest, error) {
+	l.appendMu.Lock()
+	defer l.appendMu.Unlock()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var m Manifest
+	if err := l.checkOpen(); err != nil {
+		return nil, m, failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	m = Manifest{
+		Version:   SnapshotVersion,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	var segments []*snapshotSegment
+	closeAll := func() {
+		for _, s := range segments {
+			_ = s.file.Close()
+		}
+	}
+
+	for _, s := range l.segments {
+		next := s.NextOffset()
+		if s == l.activeSegment {
+			m.HighWaterMark = next
+		}
+		size := s.store.published.Load()
+
+		f, err := os.Open(s.store.Name())
+		if err != nil {
+			closeAll()
+			return nil, m, failure.ToSystem(err, "os.Open failed for (%s)", s.store.Name())
+		}
+
+		keyID, err := readKeyID(l.Dir, s.BaseOffset())
+		if err != nil {
+			_ = f.Close()
+			closeAll()
+			return nil, m, failure.Wrap(err, "readKeyID failed (%d)", s.BaseOffset())
+		}
+
+		segments = append(segments, &snapshotSegment{
+			ManifestSegment: ManifestSegment{
+				BaseOffset: s.BaseOffset(),
+				NextOffset: next,
+				StoreBytes: size,
+				KeyID:      keyID,
+			},
+			file: f,
+		})
+	}
+
+	return segments, m, nil
+}
+
+func writeSnapshotStore(tw *tar.Writer, s *snapshotSegment) (string, error) {
+	name := segmentName(s.BaseOffset, StoreExt)
+	hdr := tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(s.StoreBytes),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(&hdr); err != nil {
+		return "", failure.ToSystem(err, "tw.WriteHeader failed (%s)", name)
+	}
+
+	h := sha256.New()
+	r := io.NewSectionReader(s.file, 0, int64(s.StoreBytes))
+	if _, err := io.Copy(io.MultiWriter(tw, h), r); err != nil {
+		return "", failure.ToSystem(err, "io.Copy failed (%s)", name)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeSnapshotEntry(tw *tar.Writer, name string, b []byte) error {
+	hdr := tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(&hdr); err != nil {
+		return failure.ToSystem(err, "tw.WriteHeader failed (%s)", name)
+	}
+
+	if _, err := tw.Write(b); err != nil {
+		return failure.ToSystem(err, "tw.Write failed (%s)", name)
+	}
+
+	return nil
+}
+
+// Restore recreates a log in dir from a snapshot archive read from r and
+// returns the archive's manifest. The directory is created when it does not
+// exist and must not hold a log already. Every store is checked against the
+// manifest, and anything written to dir is removed again when the archive is
+// incomplete or does not match it. The restored log rebuilds its indexes the
+// first time it is opened, encrypted segments need the keys they were
+// written with. It fails with Locked while a log is open in dir.
+func Restore(dir string, r io.Reader) (*Manifest, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, failure.ToSystem(err, "os.MkdirAll failed for (%s)", dir)
+	}
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return nil, failure.Wrap(err, "lockDir failed")
+	}
+	defer func() { _ = lock.Close() }()
+
+	baseOffsets, _, err := segmentFiles(dir)
+	if err != nil {
+		return nil, failure.Wrap(err, "segmentFiles failed")
+	}
+
+	if len(baseOffsets) > 0 {
+		return nil, failure.AlreadyExists("(%s) already holds a log", dir)
+	}
+
+	var written []string
+	m, err := restoreArchive(dir, r, &written)
+	if err != nil {
+		for _, file := range written {
+			_ = os.Remove(file)
+		}
+		return nil, failure.Wrap(err, "restoreArchive failed")
+	}
+
+	return m, nil
+}
+
+// restoreArchive extracts the stores in the archive into dir, appending
+// every file it creates to written, and checks them against the manifest.
+func restoreArchive(dir string, r io.Reader, written *[]string) (*Manifest, error) {
+	type restored struct {
+		size uint64
+		sum  string
+	}
+	stores := map[string]restored{}
+
+	var m *Manifest
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, failure.ToSystem(err, "tr.Next failed")
+		}
+
+		if m != nil {
+			return nil, failure.Validation("entry (%s) found after the manifest", hdr.Name)
+		}
+
+		if hdr.Name == ManifestFile {
+			if m, err = readManifest(tr); err != nil {
+				return nil, failure.Wrap(err, "readManifest failed")
+			}
+			continue
+		}
+
+		// entry names come from the archive, only plain store names are
+		// accepted so nothing is written outside of dir
+		if !isStoreName(hdr.Name) {
+			return nil, failure.Validation("unexpected entry (%s) in snapshot", hdr.Name)
+		}
+
+		file := path.Join(dir, hdr.Name)
+		size, sum, err := extractStore(file, tr)
+		if err != nil {
+			return nil, failure.Wrap(err, "extractStore failed (%s)", hdr.Name)
+		}
+		*written = append(*written, file)
+		stores[hdr.Name] = restored{size: size, sum: sum}
+	}
+
+	if m == nil {
+		return nil, failure.Validation("snapshot has no manifest, the archive is incomplete")
+	}
+
+	if m.Version != SnapshotVersion {
+		return nil, failure.Validation("snapshot version (%d) is not supported", m.Version)
+	}
+
+	if len(m.Segments) != len(stores) {
+		return nil, failure.Validation("manifest lists (%d) segments, archive holds (%d)", len(m.Segments), len(stores))
+	}
+
+	for _, s := range m.Segments {
+		name := segmentName(s.BaseOffset, StoreExt)
+		got, ok := stores[name]
+		switch {
+		case !ok:
+			return nil, failure.Validation("store (%s) listed in the manifest is missing", name)
+		case got.size != s.StoreBytes:
+			return nil, failure.Validation("store (%s) has (%d) bytes, manifest says (%d)", name, got.size, s.StoreBytes)
+		case got.sum != s.SHA256:
+			return nil, failure.Validation("store (%s) checksum mismatch", name)
+		}
+
+		if s.KeyID == "" {
+			continue
+		}
+
+		file := path.Join(dir, segmentName(s.BaseOffset, KeyExt))
+		*written = append(*written, file)
+		if err := ioutil.WriteFile(file, []byte(s.KeyID+"\n"), 0644); err != nil {
+			return nil, failure.ToSystem(err, "ioutil.WriteFile failed for (%s)", file)
+		}
+	}
+
+	return m, nil
+}
+
+func readManifest(r io.Reader) (*Manifest, error) {
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, failure.ToValidation(err, "json.Decode failed for manifest")
+	}
+
+	return &m, nil
+}
+
+// isStoreName is true for the name of a store as written by segmentName
+func isStoreName(name string) bool {
+	off, err := strconv.ParseUint(strings.TrimSuffix(name, StoreExt), 10, 64)
+	return err == nil && segmentName(off, StoreExt) == name
+}
+
+// extractStore copies a store out of the archive and returns its size and
+// checksum. The file is removed again when it can not be written in full.
+func extractStore(file string, r io.Reader) (uint64, string, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, "", failure.ToSystem(err, "os.OpenFile failed for (%s)", file)
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(file)
+		return 0, "", failure.ToSystem(err, "io.Copy failed for (%s)", file)
+	}
+
+	if err = f.Close(); err != nil {
+		_ = os.Remove(file)
+		return 0, "", failure.ToSystem(err, "f.Close failed for (%s)", file)
+	}
+
+	return uint64(n), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readKeyID returns the ID of the key the segment is encrypted with, empty
+// when it is in plain text
+func readKeyID(dir string, baseOffset uint64) (string, error) {
+	file := path.Join(dir, segmentName(baseOffset, KeyExt))
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", failure.ToSystem(err, "ioutil.ReadFile failed for (%s)", file)
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
@@ -0,0 +1,170 @@
+package log_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/rsb/failure"
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+	"github.com/rsb/prolog/business/data/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog_Snapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.InitialOffset = 10
+	require.NoError(t, os.MkdirAll(path.Join(dir, "log"), 0755))
+	l, err := log.NewLog(path.Join(dir, "log"), c)
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	for i := 0; i < 5; i++ {
+		_, err = l.Append(&data.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	var archive bytes.Buffer
+	m, err := l.Snapshot(&archive)
+	require.NoError(t, err)
+	require.Equal(t, uint64(15), m.HighWaterMark)
+	require.Equal(t, uint64(10), m.Segments[0].BaseOffset)
+
+	// appends after the snapshot are not part of it
+	_, err = l.Append(&data.Record{Value: []byte("too late")})
+	require.NoError(t, err)
+
+	restored := path.Join(dir, "restored")
+	rm, err := log.Restore(restored, bytes.NewReader(archive.Bytes()))
+	require.NoError(t, err)
+	require.Equal(t, m.Segments, rm.Segments)
+
+	r, err := log.NewLog(restored, c)
+	require.NoError(t, err)
+
+	lowest, err := r.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), lowest)
+
+	highest, err := r.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(14), highest)
+
+	for i := 0; i < 5; i++ {
+		read, err := r.Read(uint64(10 + i))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), read.Value)
+	}
+
+	require.NoError(t, r.Close())
+	report, err := log.Verify(restored, c)
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.Problems)
+
+	// a directory that already holds a log is never overwritten
+	_, err = log.Restore(restored, bytes.NewReader(archive.Bytes()))
+	require.Error(t, err)
+	require.True(t, failure.IsAlreadyExists(err))
+}
+
+func TestLog_SnapshotWhileAppending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 1024
+	require.NoError(t, os.MkdirAll(path.Join(dir, "log"), 0755))
+	l, err := log.NewLog(path.Join(dir, "log"), c)
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for i := 0; i < 200; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := l.Append(&data.Record{Value: []byte("hello world")}); err != nil {
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		var archive bytes.Buffer
+		m, err := l.Snapshot(&archive)
+		require.NoError(t, err)
+
+		// the archive holds exactly the records below the high-water mark
+		last := m.Segments[len(m.Segments)-1]
+		require.Equal(t, m.HighWaterMark, last.NextOffset)
+
+		restored := path.Join(dir, fmt.Sprintf("restored-%d", i))
+		_, err = log.Restore(restored, bytes.NewReader(archive.Bytes()))
+		require.NoError(t, err)
+
+		r, err := log.NewLog(restored, c)
+		require.NoError(t, err)
+		highest, err := r.HighestOffset()
+		require.NoError(t, err)
+		if m.HighWaterMark > 0 {
+			require.Equal(t, m.HighWaterMark-1, highest)
+		}
+		require.NoError(t, r.Close())
+
+		report, err := log.Verify(restored, c)
+		require.NoError(t, err)
+		require.True(t, report.OK(), report.Problems)
+	}
+
+	close(done)
+	<-stopped
+}
+
+func TestRestore_Rejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	require.NoError(t, os.MkdirAll(path.Join(dir, "log"), 0755))
+	l, err := log.NewLog(path.Join(dir, "log"), log.Config{})
+	require.NoError(t, err)
+	_, err = l.Append(&data.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	var archive bytes.Buffer
+	_, err = l.Snapshot(&archive)
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	for scenario, b := range map[string][]byte{
+		"truncated": archive.Bytes()[:archive.Len()/2],
+		"tampered":  bytes.Replace(archive.Bytes(), []byte("hello world"), []byte("HELLO WORLD"), 1),
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			restored := path.Join(dir, scenario)
+			_, err := log.Restore(restored, bytes.NewReader(b))
+			require.Error(t, err)
+
+			// nothing from the rejected archive is left behind
+			files, err := ioutil.ReadDir(restored)
+			require.NoError(t, err)
+			for _, f := range files {
+				require.Equal(t, log.LockFile, f.Name())
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package log
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/rsb/failure"
+
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+)
+
+const (
+	// StateFile is written to the log directory by Close and holds the
+	// state of the idempotent producers and of the transactions as of
+	// NextOffset. Records appended after it are scanned when the log is
+	// opened to bring the state up to date.
+	StateFile = ".state.json"
+	// stateTmpFile is where StateFile is written before it is renamed into
+	// place
+	stateTmpFile = StateFile + ".tmp"
+)
+
+// logState is the content of StateFile
+type logState struct {
+	NextOffset   uint64                      `json:"next_offset"`
+	Producers    map[uint64][]ProducerBatch  `json:"producers"`
+	Transactions map[uint64]*OpenTransaction `json:"transactions"`
+	Aborted      []AbortedTransaction        `json:"aborted"`
+}
+
+// loadState rebuilds the state of the log's producers and transactions
+// from StateFile and the records appended after it. Records that only live
+// in the remote tier are not scanned, a producer whose records are all
+// offloaded is treated as new.
+func (l *Log) loadState() error {
+	l.producers = NewProducers()
+	l.transactions = NewTransactions()
+
+	var state logState
+	file := path.Join(l.Dir, StateFile)
+	b, err := ioutil.ReadFile(file)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return failure.ToSystem(err, "ioutil.ReadFile failed for (%s)", file)
+	default:
+		if err = json.Unmarshal(b, &state); err != nil {
+			return failure.ToConfig(err, "json.Unmarshal failed for (%s)", file)
+		}
+		if state.Producers != nil {
+			l.producers.batches = state.Producers
+		}
+		if state.Transactions != nil {
+			l.transactions.open = state.Transactions
+		}
+		l.transactions.setAborted(state.Aborted)
+	}
+
+	for _, s := range l.segments {
+		if s.NextOffset() <= state.NextOffset {
+			continue
+		}
+
+		err = s.scan(func(_ uint64, record *data.Record) error {
+			if record.Offset >= state.NextOffset {
+				records := []*data.Record{record}
+				l.producers.Add(records)
+				l.transactions.Add(records)
+			}
+			return nil
+		})
+		if err != nil {
+			return failure.Wrap(err, "s.scan failed (%d)", s.BaseOffset())
+		}
+	}
+	l.transactions.Prune(l.lowest())
+
+	return nil
+}
+
+// saveState writes the state of the log's producers and transactions to
+// StateFile. The caller must hold appendMu.
+func (l *Log) saveState() error {
+	l.transactions.mu.RLock()
+	b, err := json.Marshal(logState{
+		NextOffset:   l.activeSegment.NextOffset(),
+		Producers:    l.producers.batches,
+		Transactions: l.transactions.open,
+		Aborted:      l.transactions.abortedList(),
+	})
+	l.transactions.mu.RUnlock()
+	if err != nil {
+		return failure.ToSystem(err, "json.Marshal failed for state")
+	}
+
+	// the file is renamed into place so the log never reads a partial one
+	file := path.Join(l.Dir, StateFile)
+	tmp := path.Join(l.Dir, stateTmpFile)
+	if err = writeSynced(tmp, b); err != nil {
+		return failure.Wrap(err, "writeSynced failed")
+	}
+
+	if err = os.Rename(tmp, file); err != nil {
+		return failure.ToSystem(err, "os.Rename failed for (%s)", tmp)
+	}
+
+	return nil
+}
@@ -2,18 +2,43 @@ package log
 
 import (
 	"bufio"
-	"encoding/binary"
+	"crypto/cipher"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 
 	"github.com/rsb/failure"
+	"github.com/tysonmote/gommap"
 )
 
+// Store is the file holding a segment's records. Appends go through a write
+// buffer guarded by mu, readers never take it. They only see the records
+// below the published high-water mark, which moves up when the store is
+// flushed, so a read never waits for the writer or makes it flush.
 type Store struct {
 	*os.File
 	mu   sync.Mutex
 	buf  *bufio.Writer
 	size uint64
+	// synced is the size of the store the last time it was synced to disk
+	synced uint64
+	// published is the high-water mark readers see, every byte below it
+	// was flushed to the file
+	published atomic.Uint64
+	// sealed maps the whole file into memory once nothing is appended to
+	// the store anymore, reads of a sealed store make no system call.
+	// mapMu keeps the mapping from going away under a reader, a reader
+	// that is not done with the store when it is closed gets an error
+	// instead.
+	sealed gommap.MMap
+	mapMu  sync.RWMutex
+	// aead encrypts every record when the store is encrypted
+	aead cipher.AEAD
+	// format is the layout of the file, its first record starts right
+	// after the header
+	format FileFormat
 }
 
 func NewStore(f *os.File) (*Store, error) {
@@ -23,11 +48,26 @@ func NewStore(f *os.File) (*Store, error) {
 	}
 	size := uint64(fi.Size())
 
+	// nothing is truncated or rewritten in a store whose layout is not
+	// certain, the operator decides what happens to it
+	format, known, err := storeFormat(f)
+	switch {
+	case err != nil:
+		return nil, failure.Wrap(err, "storeFormat failed")
+	case !known:
+		return nil, failure.Config("store (%s) has no header and its first record is damaged, run `prolog log migrate`", f.Name())
+	case format.Version == Version0:
+		return nil, failure.Config("store (%s) was written without checksums, run `prolog log migrate`", f.Name())
+	}
+
 	s := &Store{
-		File: f,
-		size: size,
-		buf:  bufio.NewWriter(f),
+		File:   f,
+		size:   size,
+		synced: size,
+		buf:    bufio.NewWriter(f),
+		format: format,
 	}
+	s.published.Store(size)
 
 	return s, nil
 }
@@ -40,9 +80,15 @@ func (s *Store) Append(p []byte) (uint64, uint64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.aead != nil {
+		if p, err = seal(s.aead, p); err != nil {
+			return 0, 0, failure.Wrap(err, "seal failed")
+		}
+	}
+
 	pos = s.size
-	if err = binary.Write(s.buf, Enc, uint64(len(p))); err != nil {
-		return 0, 0, failure.ToSystem(err, "binary.Write failed")
+	if _, err = s.buf.Write(frameHeader(p)); err != nil {
+		return 0, 0, failure.ToSystem(err, "s.buf.Write failed for header")
 	}
 
 	w, err := s.buf.Write(p)
@@ -50,7 +96,7 @@ func (s *Store) Append(p []byte) (uint64, uint64, error) {
 		return 0, 0, failure.ToSystem(err, "s.buf.Write failed")
 	}
 
-	w += LenWidth
+	w += FrameWidth
 
 	numBytes = uint64(w)
 	s.size += numBytes
@@ -58,36 +104,202 @@ func (s *Store) Append(p []byte) (uint64, uint64, error) {
 	return numBytes, pos, nil
 }
 
+// Read returns the record at pos. Records that were appended but not
+// flushed yet are not visible, pos at or past the published high-water mark
+// is io.EOF.
 func (s *Store) Read(pos uint64) ([]byte, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	end := s.published.Load()
+	if pos >= end {
+		return nil, io.EOF
+	}
 
-	if err := s.buf.Flush(); err != nil {
+	if pos < s.format.Header {
+		return nil, Corrupt("position (%d) is inside the header", pos)
+	}
+
+	if pos+FrameWidth > end {
+		return nil, Corrupt("record header at (%d) is truncated", pos)
+	}
+
+	header := make([]byte, FrameWidth)
+	if err := s.readAt(header, pos); err != nil {
 		return nil, err
 	}
 
-	size := make([]byte, LenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
+	size := Enc.Uint64(header[:LenWidth])
+	if size > end-pos-FrameWidth {
+		return nil, Corrupt("record at (%d) claims (%d) bytes past the end of the store", pos, size)
+	}
+
+	b := make([]byte, size)
+	if err := s.readAt(b, pos+FrameWidth); err != nil {
 		return nil, err
 	}
 
-	b := make([]byte, Enc.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(pos+LenWidth)); err != nil {
-		return b, err
+	if crc32.ChecksumIEEE(b) != Enc.Uint32(header[LenWidth:]) {
+		return nil, Corrupt("checksum mismatch for record at (%d)", pos)
+	}
+
+	if s.aead != nil {
+		p, err := open(s.aead, b)
+		if err != nil {
+			return nil, failure.Wrap(err, "open failed for record at (%d)", pos)
+		}
+		return p, nil
 	}
 
 	return b, nil
 }
 
+// frameSize returns how many bytes the frame of a record read as p takes up
+// in the store, which is more than p when the store is encrypted.
+func (s *Store) frameSize(p []byte) uint64 {
+	n := FrameWidth + uint64(len(p))
+	if s.aead != nil {
+		n += uint64(s.aead.NonceSize() + s.aead.Overhead())
+	}
+
+	return n
+}
+
+// Format returns the layout the store's file was written with
+func (s *Store) Format() FileFormat {
+	return s.format
+}
+
+// ReadAt reads the store's file like io.ReaderAt but stops at the published
+// high-water mark.
 func (s *Store) ReadAt(p []byte, off int64) (int, error) {
+	end := int64(s.published.Load())
+	if off >= end {
+		return 0, io.EOF
+	}
+
+	var err error
+	n := int64(len(p))
+	if off+n > end {
+		n = end - off
+		err = io.EOF
+	}
+
+	if rerr := s.readAt(p[:n], uint64(off)); rerr != nil {
+		return 0, rerr
+	}
+
+	return int(n), err
+}
+
+// readAt fills p from pos, which the caller checked is below the published
+// high-water mark. A sealed store is read from memory, the bytes are copied
+// so nothing handed out refers to the mapping after it is unmapped.
+func (s *Store) readAt(p []byte, pos uint64) error {
+	s.mapMu.RLock()
+	defer s.mapMu.RUnlock()
+
+	if s.sealed != nil {
+		copy(p, s.sealed[pos:])
+		return nil
+	}
+
+	if _, err := s.File.ReadAt(p, int64(pos)); err != nil {
+		return failure.ToSystem(err, "s.File.ReadAt failed (%d)", pos)
+	}
+
+	return nil
+}
+
+// Flush writes out the write buffer without syncing and publishes every
+// record appended so far to readers.
+func (s *Store) Flush() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if err := s.buf.Flush(); err != nil {
-		return 0, err
+		return failure.ToSystem(err, "s.buf.Flush failed")
 	}
 
-	return s.File.ReadAt(p, off)
+	s.published.Store(s.size)
+	return nil
+}
+
+// seal flushes the store and maps it into memory. It is called once nothing
+// is appended to the store anymore.
+func (s *Store) seal() error {
+	if err := s.Flush(); err != nil {
+		return failure.Wrap(err, "s.Flush failed")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mapMu.Lock()
+	defer s.mapMu.Unlock()
+
+	// an empty file can not be mapped, there is nothing to read in it anyway
+	if s.sealed != nil || s.size == 0 {
+		return nil
+	}
+
+	m, err := gommap.Map(s.File.Fd(), gommap.PROT_READ, gommap.MAP_SHARED)
+	if err != nil {
+		return failure.ToSystem(err, "gommap.Map failed for (%s)", s.Name())
+	}
+	s.sealed = m
+
+	return nil
+}
+
+// Truncate cuts the store down to size bytes, dropping anything written after
+// that point. It is used to remove partially written records after a crash.
+func (s *Store) Truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return failure.ToSystem(err, "s.buf.Flush failed")
+	}
+
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return failure.ToSystem(err, "s.File.Truncate failed")
+	}
+
+	s.size = size
+	s.published.Store(size)
+	if s.synced > size {
+		s.synced = size
+	}
+	return nil
+}
+
+// Sync flushes the write buffer and commits the store to stable storage. It
+// does nothing when nothing was appended since the last sync.
+func (s *Store) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.synced == s.size {
+		return nil
+	}
+
+	if err := s.buf.Flush(); err != nil {
+		return failure.ToSystem(err, "s.buf.Flush failed")
+	}
+
+	if err := s.File.Sync(); err != nil {
+		return failure.ToSystem(err, "s.File.Sync failed")
+	}
+
+	s.synced = s.size
+	return nil
+}
+
+// Unsynced returns how many bytes were appended to the store since it was
+// last synced to disk
+func (s *Store) Unsynced() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size - s.synced
 }
 
 func (s *Store) Close() error {
@@ -98,9 +310,39 @@ func (s *Store) Close() error {
 		return failure.ToSystem(err, "s.buf.Flush failed")
 	}
 
+	if err := s.unmap(); err != nil {
+		return failure.Wrap(err, "s.unmap failed")
+	}
+
 	if err := s.File.Close(); err != nil {
 		return failure.ToSystem(err, "s.File.Close failed")
 	}
 
 	return nil
 }
+
+// frameHeader builds the bytes written in front of p in the store: the
+// length of p followed by its CRC32 checksum.
+func frameHeader(p []byte) []byte {
+	header := make([]byte, FrameWidth)
+	Enc.PutUint64(header[:LenWidth], uint64(len(p)))
+	Enc.PutUint32(header[LenWidth:], crc32.ChecksumIEEE(p))
+	return header
+}
+
+// unmap drops the mapping of a sealed store once no reader is using it
+func (s *Store) unmap() error {
+	s.mapMu.Lock()
+	defer s.mapMu.Unlock()
+
+	if s.sealed == nil {
+		return nil
+	}
+
+	if err := s.sealed.UnsafeUnmap(); err != nil {
+		return failure.ToSystem(err, "s.sealed.UnsafeUnmap failed")
+	}
+	s.sealed = nil
+
+	return nil
+}
@@ -1,10 +1,12 @@
 package log_test
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
 
+	"github.com/rsb/failure"
 	"github.com/rsb/prolog/business/data/log"
 
 	"github.com/stretchr/testify/require"
@@ -12,7 +14,7 @@ import (
 
 var (
 	write = []byte("Hello world")
-	width = uint64(len(write)) + log.LenWidth
+	width = uint64(len(write)) + log.FrameWidth
 )
 
 func TestStore_AppendRead(t *testing.T) {
@@ -23,6 +25,14 @@ func TestStore_AppendRead(t *testing.T) {
 	s, err := log.NewStore(f)
 	require.NoError(t, err)
 	testAppend(t, s)
+
+	// appended records are not visible until the store is flushed
+	_, err = s.Read(0)
+	require.ErrorIs(t, err, io.EOF)
+	_, err = s.ReadAt(make([]byte, 1), 0)
+	require.ErrorIs(t, err, io.EOF)
+
+	require.NoError(t, s.Flush())
 	testRead(t, s)
 	testReadAt(t, s)
 
@@ -56,14 +66,14 @@ func testReadAt(t *testing.T, s *log.Store) {
 	t.Helper()
 
 	for i, off := uint64(1), int64(0); i < 4; i++ {
-		b := make([]byte, log.LenWidth)
+		b := make([]byte, log.FrameWidth)
 		n, err := s.ReadAt(b, off)
 		require.NoError(t, err)
 
-		require.Equal(t, log.LenWidth, n)
+		require.Equal(t, log.FrameWidth, n)
 		off += int64(n)
 
-		size := log.Enc.Uint64(b)
+		size := log.Enc.Uint64(b[:log.LenWidth])
 		b = make([]byte, size)
 
 		n, err = s.ReadAt(b, off)
@@ -99,6 +109,51 @@ func TestStore_Close(t *testing.T) {
 	require.True(t, afterSize > beforeSize)
 }
 
+func TestStore_Corrupt(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_corrupt_test")
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	// a store without a header whose first record is damaged is not opened
+	// at all, its layout can not be told
+	header := make([]byte, log.HeaderWidth)
+	copy(header, log.StoreMagic)
+	log.Enc.PutUint32(header[log.MagicWidth:], log.CurrentVersion)
+	_, err = f.Write(header)
+	require.NoError(t, err)
+
+	s, err := log.NewStore(f)
+	require.NoError(t, err)
+
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	// flip a bit in the record's payload
+	f, _, err = openFile(f.Name())
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, int64(pos+log.FrameWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{b[0] ^ 0x01}, int64(pos+log.FrameWidth))
+	require.NoError(t, err)
+
+	s, err = log.NewStore(f)
+	require.NoError(t, err)
+
+	_, err = s.Read(pos)
+	require.Error(t, err)
+	require.True(t, log.IsCorrupt(err))
+	require.False(t, failure.IsOutOfRange(err))
+
+	_, err = s.Read(pos + width)
+	require.ErrorIs(t, err, io.EOF)
+}
+
 func openFile(name string) (*os.File, int64, error) {
 	f, err := os.OpenFile(
 		name,
@@ -0,0 +1,430 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rsb/failure"
+
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+)
+
+// TierCacheDir is the directory inside the log where segments fetched from
+// the remote tier are cached. It is emptied every time the log is opened.
+const TierCacheDir = ".tiered"
+
+// BlobStore is the remote tier sealed segments are offloaded to. Only the
+// store of a segment is uploaded, its indexes are rebuilt from it when the
+// segment is fetched back.
+type BlobStore interface {
+	// Put uploads the content of r under name, replacing any existing blob
+	Put(name string, r io.ReadSeeker) error
+	// Get opens the blob called name. It returns failure.NotFound when
+	// there is no such blob.
+	Get(name string) (io.ReadCloser, error)
+	// Delete removes the blob called name
+	Delete(name string) error
+	// List returns the names of every blob
+	List() ([]string, error)
+}
+
+// remoteSegment is a sealed segment that was uploaded to the remote tier.
+// The offsets it holds are encoded in its blob name so the remote tier can
+// be listed without downloading anything.
+type remoteSegment struct {
+	baseOffset uint64
+	nextOffset uint64
+}
+
+func (r remoteSegment) name() string {
+	return fmt.Sprintf("%d-%d%s", r.baseOffset, r.nextOffset, StoreExt)
+}
+
+// keyName is the blob holding the ID of the key an encrypted segment uses
+func (r remoteSegment) keyName() string {
+	return fmt.Sprintf("%d-%d%s", r.baseOffset, r.nextOffset, KeyExt)
+}
+
+// parseRemoteName is the reverse of remoteSegment.name
+func parseRemoteName(name string) (remoteSegment, bool) {
+	var r remoteSegment
+	if path.Ext(name) != StoreExt {
+		return r, false
+	}
+
+	parts := strings.Split(strings.TrimSuffix(name, StoreExt), "-")
+	if len(parts) != 2 {
+		return r, false
+	}
+
+	var err error
+	if r.baseOffset, err = strconv.ParseUint(parts[0], 10, 64); err != nil {
+		return r, false
+	}
+
+	if r.nextOffset, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return r, false
+	}
+
+	return r, r.baseOffset < r.nextOffset
+}
+
+// isTiered is true when a remote tier is configured
+func (l *Log) isTiered() bool {
+	return l.Config.Tier.Blobs != nil
+}
+
+// loadRemote lists the segments already in the remote tier
+func (l *Log) loadRemote() error {
+	names, err := l.Config.Tier.Blobs.List()
+	if err != nil {
+		return failure.Wrap(err, "l.Config.Tier.Blobs.List failed")
+	}
+
+	l.remote = nil
+	for _, name := range names {
+		if r, ok := parseRemoteName(name); ok {
+			l.remote = append(l.remote, r)
+		}
+	}
+
+	sort.Slice(l.remote, func(i, j int) bool {
+		return l.remote[i].baseOffset < l.remote[j].baseOffset
+	})
+
+	return nil
+}
+
+// Offload uploads every sealed segment that is not in the remote tier yet
+// and then evicts the local copy of uploaded segments, keeping the newest
+// Tier.KeepLocal of them on disk. Segments are uploaded without holding the
+// log's lock so appends and reads carry on meanwhile.
+func (l *Log) Offload(_ time.Time) error {
+	if !l.isTiered() {
+		return nil
+	}
+
+	l.compactMu.Lock()
+	defer l.compactMu.Unlock()
+
+	var uploads []upload
+	l.mu.RLock()
+	if err := l.checkOpen(); err != nil {
+		l.mu.RUnlock()
+		return failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	for _, s := range l.segments {
+		if s == l.activeSegment {
+			break
+		}
+
+		if l.isRemote(s.BaseOffset()) {
+			continue
+		}
+
+		// the open file keeps the data readable even if retention removes
+		// the segment while it is being uploaded.
+		if err := s.Sync(); err != nil {
+			l.mu.RUnlock()
+			closeUploads(uploads)
+			return failure.Wrap(err, "s.Sync failed (%d)", s.BaseOffset())
+		}
+
+		f, err := os.Open(s.store.Name())
+		if err != nil {
+			l.mu.RUnlock()
+			closeUploads(uploads)
+			return failure.ToSystem(err, "os.Open failed for (%s)", s.store.Name())
+		}
+
+		r := remoteSegment{baseOffset: s.BaseOffset(), nextOffset: s.NextOffset()}
+		uploads = append(uploads, upload{remote: r, file: f})
+	}
+	l.mu.RUnlock()
+
+	for i, u := range uploads {
+		// the key goes first so an encrypted store is never listed without it
+		if err := l.uploadKey(u.remote); err != nil {
+			closeUploads(uploads[i:])
+			return failure.Wrap(err, "l.uploadKey failed")
+		}
+
+		err := l.Config.Tier.Blobs.Put(u.remote.name(), u.file)
+		_ = u.file.Close()
+		if err != nil {
+			closeUploads(uploads[i+1:])
+			return failure.Wrap(err, "l.Config.Tier.Blobs.Put failed (%s)", u.remote.name())
+		}
+
+		l.mu.Lock()
+		l.remote = append(l.remote, u.remote)
+		sort.Slice(l.remote, func(i, j int) bool {
+			return l.remote[i].baseOffset < l.remote[j].baseOffset
+		})
+		l.mu.Unlock()
+
+		l.Config.Logger.Infow("tier",
+			"status", "segment uploaded",
+			"dir", l.Dir,
+			"base-offset", u.remote.baseOffset,
+			"next-offset", u.remote.nextOffset,
+		)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// the log may have been closed while segments were uploaded
+	if err := l.checkOpen(); err != nil {
+		return failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	if err := l.evict(); err != nil {
+		return failure.Wrap(err, "l.evict failed")
+	}
+
+	return nil
+}
+
+// uploadKey uploads the key file of an encrypted segment
+func (l *Log) uploadKey(r remoteSegment) error {
+	file := path.Join(l.Dir, segmentName(r.baseOffset, KeyExt))
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return failure.ToSystem(err, "os.Open failed for (%s)", file)
+	}
+	defer func() { _ = f.Close() }()
+
+	if err = l.Config.Tier.Blobs.Put(r.keyName(), f); err != nil {
+		return failure.Wrap(err, "l.Config.Tier.Blobs.Put failed (%s)", r.keyName())
+	}
+
+	return nil
+}
+
+// deleteRemote deletes a remote segment from the remote tier
+func (l *Log) deleteRemote(r remoteSegment) error {
+	if err := l.Config.Tier.Blobs.Delete(r.name()); err != nil {
+		return failure.Wrap(err, "l.Config.Tier.Blobs.Delete failed (%s)", r.name())
+	}
+
+	if err := l.Config.Tier.Blobs.Delete(r.keyName()); err != nil && !failure.IsNotFound(err) {
+		return failure.Wrap(err, "l.Config.Tier.Blobs.Delete failed (%s)", r.keyName())
+	}
+
+	return nil
+}
+
+// upload is a sealed segment waiting to be uploaded along with its open store
+type upload struct {
+	remote remoteSegment
+	file   *os.File
+}
+
+func closeUploads(uploads []upload) {
+	for _, u := range uploads {
+		_ = u.file.Close()
+	}
+}
+
+// evict removes the local copy of uploaded segments beyond the newest
+// Tier.KeepLocal sealed ones. The caller must hold the write lock.
+func (l *Log) evict() error {
+	sealed := len(l.segments) - 1
+	var removed int
+	for _, s := range l.segments {
+		if sealed-removed <= l.Config.Tier.KeepLocal || !l.isRemote(s.BaseOffset()) {
+			break
+		}
+
+		if err := s.Remove(); err != nil {
+			l.segments = l.segments[removed:]
+			return failure.Wrap(err, "s.Remove failed (%d)", s.BaseOffset())
+		}
+		removed++
+
+		l.Config.Logger.Infow("tier",
+			"status", "local segment evicted",
+			"dir", l.Dir,
+			"base-offset", s.BaseOffset(),
+			"next-offset", s.NextOffset(),
+		)
+	}
+
+	l.segments = l.segments[removed:]
+	return nil
+}
+
+// isRemote is true when the segment starting at base was uploaded. The
+// caller must hold at least the read lock.
+func (l *Log) isRemote(base uint64) bool {
+	i := sort.Search(len(l.remote), func(i int) bool {
+		return l.remote[i].baseOffset >= base
+	})
+
+	return i < len(l.remote) && l.remote[i].baseOffset == base
+}
+
+// remoteFor returns the remote segment holding off. The caller must hold at
+// least the read lock.
+func (l *Log) remoteFor(off uint64) (remoteSegment, bool) {
+	i := sort.Search(len(l.remote), func(i int) bool {
+		return l.remote[i].nextOffset > off
+	})
+
+	if i == len(l.remote) || l.remote[i].baseOffset > off {
+		return remoteSegment{}, false
+	}
+
+	return l.remote[i], true
+}
+
+// readRemote reads off from a remote segment, fetching the segment into the
+// local cache first when needed. It must be called without the log's lock.
+func (l *Log) readRemote(r remoteSegment, off uint64) (*data.Record, error) {
+	l.tierMu.Lock()
+	defer l.tierMu.Unlock()
+
+	s, err := l.cached(r)
+	if err != nil {
+		return nil, failure.Wrap(err, "l.cached failed (%d)", r.baseOffset)
+	}
+
+	rec, err := s.Read(off)
+	if err != nil {
+		return nil, failure.Wrap(err, "s.Read failed (offset: %d)", off)
+	}
+
+	return rec, nil
+}
+
+// remoteOffsetForTime looks up ts in a remote segment. It must be called
+// without the log's lock.
+func (l *Log) remoteOffsetForTime(r remoteSegment, ts int64) (uint64, error) {
+	l.tierMu.Lock()
+	defer l.tierMu.Unlock()
+
+	s, err := l.cached(r)
+	if err != nil {
+		return 0, failure.Wrap(err, "l.cached failed (%d)", r.baseOffset)
+	}
+
+	return s.OffsetForTime(ts)
+}
+
+// cached returns the cached copy of a remote segment, downloading it and
+// rebuilding its indexes when it is not cached yet. The least recently used
+// segment is dropped once the cache holds more than Tier.CacheSegments. The
+// caller must hold tierMu.
+func (l *Log) cached(r remoteSegment) (*Segment, error) {
+	// the log may have been closed since the caller released its lock
+	if l.cacheClosed {
+		return nil, Closed("log (%s) is closed", l.Dir)
+	}
+
+	for i, s := range l.cache {
+		if s.BaseOffset() == r.baseOffset {
+			l.cache = append(append(l.cache[:i:i], l.cache[i+1:]...), s)
+			return s, nil
+		}
+	}
+
+	dir := path.Join(l.Dir, TierCacheDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, failure.ToSystem(err, "os.MkdirAll failed for (%s)", dir)
+	}
+
+	keyFile := path.Join(dir, segmentName(r.baseOffset, KeyExt))
+	err := l.download(r.keyName(), keyFile)
+	if err != nil && !failure.IsNotFound(err) {
+		return nil, failure.Wrap(err, "l.download failed")
+	}
+
+	if !failure.IsNotFound(err) {
+		defer func() { _ = os.Remove(keyFile) }()
+	}
+
+	if err = l.download(r.name(), path.Join(dir, segmentName(r.baseOffset, StoreExt))); err != nil {
+		return nil, failure.Wrap(err, "l.download failed")
+	}
+
+	s, err := NewSegment(dir, r.baseOffset, l.Config)
+	if err != nil {
+		return nil, failure.Wrap(err, "NewSegment failed")
+	}
+
+	if _, err = s.Recover(); err != nil {
+		_ = s.Remove()
+		return nil, failure.Wrap(err, "s.Recover failed")
+	}
+
+	if err = s.seal(); err != nil {
+		_ = s.Remove()
+		return nil, failure.Wrap(err, "s.seal failed")
+	}
+
+	l.cache = append(l.cache, s)
+	for len(l.cache) > l.Config.Tier.CacheSegments {
+		if err = l.cache[0].Remove(); err != nil {
+			return nil, failure.Wrap(err, "Remove failed for cached segment (%d)", l.cache[0].BaseOffset())
+		}
+		l.cache = l.cache[1:]
+	}
+
+	return s, nil
+}
+
+func (l *Log) download(name, file string) error {
+	body, err := l.Config.Tier.Blobs.Get(name)
+	if err != nil {
+		return failure.Wrap(err, "l.Config.Tier.Blobs.Get failed (%s)", name)
+	}
+	defer func() { _ = body.Close() }()
+
+	f, err := os.Create(file)
+	if err != nil {
+		return failure.ToSystem(err, "os.Create failed for (%s)", file)
+	}
+
+	if _, err = io.Copy(f, body); err != nil {
+		_ = f.Close()
+		return failure.ToSystem(err, "io.Copy failed for (%s)", file)
+	}
+
+	if err = f.Close(); err != nil {
+		return failure.ToSystem(err, "f.Close failed for (%s)", file)
+	}
+
+	return nil
+}
+
+// closeCache closes every cached remote segment and removes the cache
+func (l *Log) closeCache() error {
+	l.tierMu.Lock()
+	defer l.tierMu.Unlock()
+
+	for _, s := range l.cache {
+		if err := s.Close(); err != nil {
+			return failure.Wrap(err, "s.Close failed for cached segment (%d)", s.BaseOffset())
+		}
+	}
+	l.cache = nil
+	l.cacheClosed = true
+
+	dir := path.Join(l.Dir, TierCacheDir)
+	if err := os.RemoveAll(dir); err != nil {
+		return failure.ToSystem(err, "os.RemoveAll failed for (%s)", dir)
+	}
+
+	return nil
+}
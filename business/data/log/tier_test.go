@@ -0,0 +1,240 @@
+package log_test
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+	"github.com/rsb/prolog/business/data/log"
+	"github.com/rsb/prolog/business/data/tier"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog_Tier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	blobs, err := tier.NewLocal(path.Join(dir, "remote"))
+	require.NoError(t, err)
+
+	logDir := path.Join(dir, "log")
+	require.NoError(t, os.MkdirAll(logDir, 0755))
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 16
+	c.Tier.Blobs = blobs
+	c.Tier.CacheSegments = 1
+	c.Tier.Interval = time.Hour
+	l, err := log.NewLog(logDir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		_, err = l.Append(&data.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, l.Offload(time.Now()))
+
+	names, err := blobs.List()
+	require.NoError(t, err)
+	require.Equal(t, []string{"0-1.store", "1-2.store", "2-3.store", "3-4.store"}, names)
+
+	// only the active segment is left on local disk
+	for i := 0; i < 4; i++ {
+		_, err = os.Stat(path.Join(logDir, fmt.Sprintf("%d%s", i, log.StoreExt)))
+		require.True(t, os.IsNotExist(err), i)
+	}
+
+	requireTiered(t, l, 4)
+	off, err := l.OffsetForTime(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// the remote tier is found again after a restart
+	require.NoError(t, l.Close())
+	l, err = log.NewLog(logDir, c)
+	require.NoError(t, err)
+	requireTiered(t, l, 4)
+	require.NoError(t, l.Close())
+
+	// a log that lost its local disk picks up after the remote tier
+	require.NoError(t, os.RemoveAll(logDir))
+	require.NoError(t, os.MkdirAll(logDir, 0755))
+	l, err = log.NewLog(logDir, c)
+	require.NoError(t, err)
+	requireTiered(t, l, 4)
+
+	off, err = l.Append(&data.Record{Value: []byte("record 4")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+
+	// truncating removes blobs from the remote tier as well
+	require.NoError(t, l.Truncate(1))
+	off, err = l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	names, err = blobs.List()
+	require.NoError(t, err)
+	require.Equal(t, []string{"2-3.store", "3-4.store"}, names)
+	require.NoError(t, l.Close())
+}
+
+func TestLog_TierRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	blobs, err := tier.NewLocal(path.Join(dir, "remote"))
+	require.NoError(t, err)
+
+	logDir := path.Join(dir, "log")
+	require.NoError(t, os.MkdirAll(logDir, 0755))
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 16
+	c.Retention.MaxLogBytes = 200
+	c.Tier.Blobs = blobs
+	c.Tier.Interval = time.Hour
+	l, err := log.NewLog(logDir, c)
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	// retention runs on every roll, it must leave what was not uploaded
+	for i := 0; i < 10; i++ {
+		_, err = l.Append(&data.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.EnforceRetention(time.Now()))
+	require.NoError(t, l.Offload(time.Now()))
+
+	names, err := blobs.List()
+	require.NoError(t, err)
+	require.Len(t, names, 10)
+
+	// once uploaded the local copies are fair game
+	require.NoError(t, l.EnforceRetention(time.Now()))
+	requireTiered(t, l, 10)
+}
+
+// slowBlobs blocks every Get until release is closed
+type slowBlobs struct {
+	log.BlobStore
+	fetching chan struct{}
+	release  chan struct{}
+}
+
+func (s *slowBlobs) Get(name string) (io.ReadCloser, error) {
+	s.fetching <- struct{}{}
+	<-s.release
+	return s.BlobStore.Get(name)
+}
+
+func TestLog_TierFetchUnlocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	local, err := tier.NewLocal(path.Join(dir, "remote"))
+	require.NoError(t, err)
+	blobs := &slowBlobs{BlobStore: local, fetching: make(chan struct{}, 2), release: make(chan struct{})}
+
+	logDir := path.Join(dir, "log")
+	require.NoError(t, os.MkdirAll(logDir, 0755))
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 16
+	c.Tier.Blobs = blobs
+	c.Tier.Interval = time.Hour
+	l, err := log.NewLog(logDir, c)
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	for i := 0; i < 4; i++ {
+		_, err = l.Append(&data.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Offload(time.Now()))
+
+	read := make(chan error)
+	go func() {
+		_, err := l.Read(0)
+		read <- err
+	}()
+	<-blobs.fetching
+
+	// appends carry on while the remote segment is being fetched
+	appended := make(chan error)
+	go func() {
+		_, err := l.Append(&data.Record{Value: []byte("record 4")})
+		appended <- err
+	}()
+
+	select {
+	case err = <-appended:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		close(blobs.release)
+		<-read
+		t.Fatal("append waited for the remote fetch")
+	}
+
+	close(blobs.release)
+	require.NoError(t, <-read)
+}
+
+func requireTiered(t *testing.T, l *log.Log, n int) {
+	t.Helper()
+
+	off, err := l.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	for i := 0; i < n; i++ {
+		read, err := l.Read(uint64(i))
+		require.NoError(t, err, i)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), read.Value)
+	}
+}
+
+func TestLog_TierEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-encrypted-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	blobs, err := tier.NewLocal(path.Join(dir, "remote"))
+	require.NoError(t, err)
+
+	logDir := path.Join(dir, "log")
+	require.NoError(t, os.MkdirAll(logDir, 0755))
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 16
+	c.Tier.Blobs = blobs
+	c.Tier.Interval = time.Hour
+	c.Encryption.KeyID = "k1"
+	c.Encryption.Keys = map[string][]byte{"k1": make([]byte, 32)}
+	l, err := log.NewLog(logDir, c)
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	for i := 0; i < 2; i++ {
+		_, err = l.Append(&data.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, l.Offload(time.Now()))
+
+	// the key id travels with the store so the segment can be read back
+	names, err := blobs.List()
+	require.NoError(t, err)
+	require.Equal(t, []string{"0-1.key", "0-1.store", "1-2.key", "1-2.store"}, names)
+
+	requireTiered(t, l, 2)
+}
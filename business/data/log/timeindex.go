@@ -0,0 +1,175 @@
+package log
+
+import (
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	"github.com/rsb/failure"
+
+	"github.com/tysonmote/gommap"
+)
+
+var (
+	TsWidth      uint64 = 8
+	TimeEntWidth        = TsWidth + OffWidth
+)
+
+// TimeIndex maps append timestamps to relative offsets in a segment. It is
+// laid out like Index, a memory mapped file of fixed width entries, except
+// that an entry is only written when a record's timestamp is newer than every
+// timestamp before it. That keeps the entries sorted by time even when the
+// clock steps backwards so they can be binary searched.
+type TimeIndex struct {
+	file *os.File
+	mmap gommap.MMap
+	// data is the part of mmap after the file's header
+	data gommap.MMap
+	// size is written by the appender and read by readers without a lock,
+	// an entry is written before size moves past it
+	size   atomic.Uint64
+	format FileFormat
+}
+
+func NewTimeIndex(f *os.File, c Config) (*TimeIndex, error) {
+	if f == nil {
+		return nil, failure.System("f file is nil")
+	}
+	idx := TimeIndex{file: f}
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, failure.ToSystem(err, "os.Stat failed")
+	}
+
+	// an entry is only ever written along with an offset index entry so the
+	// time index can not fill up before the offset index does.
+	if idx.format, err = readFormat(f, TimeIndexMagic); err != nil {
+		return nil, failure.Wrap(err, "readFormat failed")
+	}
+
+	idx.size.Store(uint64(fi.Size()) - idx.format.Header)
+	if err = os.Truncate(f.Name(), int64(idx.format.Header+c.Segment.MaxIndexBytes)); err != nil {
+		return nil, failure.ToSystem(err, "os.Truncate failed")
+	}
+
+	idx.mmap, err = gommap.Map(idx.file.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
+	if err != nil {
+		return nil, failure.ToSystem(err, "gommap.Map failed")
+	}
+	idx.data = idx.mmap[idx.format.Header:]
+
+	return &idx, nil
+}
+
+func (i *TimeIndex) Close() error {
+	var err error
+	if err = i.mmap.Sync(gommap.MS_SYNC); err != nil {
+		return failure.ToSystem(err, "i.mmap.Sync failed")
+	}
+
+	if err = i.file.Sync(); err != nil {
+		return failure.ToSystem(err, "i.file.Sync failed")
+	}
+
+	if err = i.file.Truncate(int64(i.format.Header + i.size.Load())); err != nil {
+		return failure.ToSystem(err, "i.file.Truncate failed")
+	}
+
+	if err = i.file.Close(); err != nil {
+		return failure.ToSystem(err, "i.file.Close failed")
+	}
+
+	return nil
+}
+
+// Last returns the newest entry in the time index or io.EOF when it is empty
+func (i *TimeIndex) Last() (int64, uint32, error) {
+	size := i.size.Load()
+	if size < TimeEntWidth {
+		return 0, 0, io.EOF
+	}
+
+	return i.entry((size / TimeEntWidth) - 1)
+}
+
+// First returns the oldest entry in the time index or io.EOF when it is empty
+func (i *TimeIndex) First() (int64, uint32, error) {
+	return i.entry(0)
+}
+
+// Write adds an entry for the record at the relative offset off when ts is
+// newer than the last entry, otherwise it does nothing. Records written
+// before they carried a timestamp have none and get no entry either.
+func (i *TimeIndex) Write(ts int64, off uint32) error {
+	if ts <= 0 {
+		return nil
+	}
+
+	if last, _, err := i.Last(); err == nil && ts <= last {
+		return nil
+	}
+
+	size := i.size.Load()
+	if uint64(len(i.data)) < size+TimeEntWidth {
+		return io.EOF
+	}
+
+	Enc.PutUint64(i.data[size:size+TsWidth], uint64(ts))
+	Enc.PutUint32(i.data[size+TsWidth:size+TimeEntWidth], off)
+	i.size.Store(size + TimeEntWidth)
+	return nil
+}
+
+// Find returns the relative offset of the first entry at or after ts. It
+// returns io.EOF when every entry is older than ts.
+func (i *TimeIndex) Find(ts int64) (uint32, error) {
+	n := i.size.Load() / TimeEntWidth
+	j := sort.Search(int(n), func(j int) bool {
+		t, _, _ := i.entry(uint64(j))
+		return t >= ts
+	})
+	if uint64(j) == n {
+		return 0, io.EOF
+	}
+
+	_, off, err := i.entry(uint64(j))
+	return off, err
+}
+
+// Before returns the relative offset of the newest entry older than ts. It
+// returns io.EOF when no entry is older than ts.
+func (i *TimeIndex) Before(ts int64) (uint32, error) {
+	n := i.size.Load() / TimeEntWidth
+	j := sort.Search(int(n), func(j int) bool {
+		t, _, _ := i.entry(uint64(j))
+		return t >= ts
+	})
+	if j == 0 {
+		return 0, io.EOF
+	}
+
+	_, off, err := i.entry(uint64(j - 1))
+	return off, err
+}
+
+// Reset drops every entry from the time index so it can be rebuilt from the
+// store.
+func (i *TimeIndex) Reset() {
+	i.size.Store(0)
+}
+
+func (i *TimeIndex) Name() string {
+	return i.file.Name()
+}
+
+func (i *TimeIndex) entry(n uint64) (int64, uint32, error) {
+	pos := n * TimeEntWidth
+	if i.size.Load() < pos+TimeEntWidth {
+		return 0, 0, io.EOF
+	}
+
+	ts := int64(Enc.Uint64(i.data[pos : pos+TsWidth]))
+	off := Enc.Uint32(i.data[pos+TsWidth : pos+TimeEntWidth])
+	return ts, off, nil
+}
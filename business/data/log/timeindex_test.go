@@ -0,0 +1,66 @@
+package log_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/rsb/prolog/business/data/log"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "timeindex_test")
+	require.NoError(t, err)
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	c := log.Config{}
+	c.Segment.MaxIndexBytes = 1024
+
+	idx, err := log.NewTimeIndex(f, c)
+	require.NoError(t, err)
+
+	_, _, err = idx.Last()
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, f.Name(), idx.Name())
+
+	require.NoError(t, idx.Write(100, 0))
+	require.NoError(t, idx.Write(200, 1))
+	// the clock stepped backwards, nothing is written
+	require.NoError(t, idx.Write(150, 2))
+	require.NoError(t, idx.Write(300, 3))
+
+	for _, tc := range []struct {
+		ts  int64
+		off uint32
+	}{
+		{ts: 0, off: 0},
+		{ts: 100, off: 0},
+		{ts: 101, off: 1},
+		{ts: 200, off: 1},
+		{ts: 250, off: 3},
+		{ts: 300, off: 3},
+	} {
+		off, err := idx.Find(tc.ts)
+		require.NoError(t, err)
+		require.Equal(t, tc.off, off, tc.ts)
+	}
+
+	_, err = idx.Find(301)
+	require.ErrorIs(t, err, io.EOF)
+
+	require.NoError(t, idx.Close())
+
+	// time index should build its state from the existing file
+	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+	idx, err = log.NewTimeIndex(f, c)
+	require.NoError(t, err)
+
+	ts, off, err := idx.Last()
+	require.NoError(t, err)
+	require.Equal(t, int64(300), ts)
+	require.Equal(t, uint32(3), off)
+	require.NoError(t, idx.Close())
+}
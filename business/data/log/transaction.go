@@ -0,0 +1,398 @@
+package log
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rsb/failure"
+
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+)
+
+// DefaultTransactionTimeout is how long a transaction may stay open before
+// it is aborted, an open transaction holds back every read committed
+// consumer of the log.
+const DefaultTransactionTimeout = time.Minute
+
+// NewTransactionID returns a random transaction id. Zero is never returned
+// since it marks records that are not part of a transaction.
+func NewTransactionID() (uint64, error) {
+	id, err := randomID()
+	if err != nil {
+		return 0, failure.Wrap(err, "randomID failed")
+	}
+
+	return id, nil
+}
+
+// OpenTransaction is a transaction that was begun and not ended yet
+type OpenTransaction struct {
+	// FirstOffset is the offset of the transaction's first record, it is
+	// only set once Records is not zero
+	FirstOffset uint64 `json:"first_offset"`
+	Records     uint64 `json:"records"`
+	// Started is when the transaction was begun, in nanoseconds since the
+	// unix epoch
+	Started int64 `json:"started"`
+}
+
+// AbortedTransaction is the range of offsets an aborted transaction spans,
+// from its first record to the control record that aborted it
+type AbortedTransaction struct {
+	ID          uint64 `json:"id"`
+	FirstOffset uint64 `json:"first_offset"`
+	LastOffset  uint64 `json:"last_offset"`
+}
+
+// Transactions tracks the transactions of a log. A transaction is begun,
+// its records are appended like any other and it is ended by a control
+// record that commits or aborts it. Read committed consumers stop at the
+// first record of the oldest open transaction, the last stable offset, and
+// skip control records and the records of aborted transactions.
+// Transactions is safe for concurrent use, readers check it while records
+// are appended.
+type Transactions struct {
+	mu   sync.RWMutex
+	open map[uint64]*OpenTransaction
+	// aborted is indexed by transaction id so a reader only looks at the
+	// ranges of the transaction its record belongs to
+	aborted map[uint64][]AbortedTransaction
+}
+
+func NewTransactions() *Transactions {
+	return &Transactions{
+		open:    map[uint64]*OpenTransaction{},
+		aborted: map[uint64][]AbortedTransaction{},
+	}
+}
+
+// Begin opens the transaction id, it fails with failure.AlreadyExists when
+// it is open already.
+func (t *Transactions) Begin(id uint64, now time.Time) error {
+	if id == 0 {
+		return failure.InvalidParam("transaction id can not be zero")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.open[id]; ok {
+		return failure.AlreadyExists("transaction (%d) is already open", id)
+	}
+
+	t.open[id] = &OpenTransaction{Started: now.UnixNano()}
+	return nil
+}
+
+// Check validates records before they are appended. Control records are
+// only written by the log itself and every record of a batch must belong to
+// the same transaction, which must be open.
+func (t *Transactions) Check(records []*data.Record) error {
+	id := records[0].TransactionId
+	for _, record := range records {
+		if record.Control != data.Control_CONTROL_NONE {
+			return failure.InvalidParam("control records are written by the log")
+		}
+
+		if record.TransactionId != id {
+			return failure.InvalidParam("batch mixes transactions (%d) and (%d)", id, record.TransactionId)
+		}
+	}
+
+	if id == 0 {
+		return nil
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if _, ok := t.open[id]; !ok {
+		return failure.NotFound("transaction (%d) is not open", id)
+	}
+
+	return nil
+}
+
+// Marker returns the control record that commits or aborts the open
+// transaction id. It fails with failure.NotFound when it is not open.
+func (t *Transactions) Marker(id uint64, control data.Control) (*data.Record, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if _, ok := t.open[id]; !ok {
+		return nil, failure.NotFound("transaction (%d) is not open", id)
+	}
+
+	return &data.Record{TransactionId: id, Control: control}, nil
+}
+
+// Add updates the transactions with records once they were appended. It is
+// called before the records are published, so a reader never finds a
+// record of a transaction that is not tracked yet. A record of a
+// transaction that is not open begins it, which is how transactions are
+// rebuilt from the records when the log is opened.
+func (t *Transactions) Add(records []*data.Record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, record := range records {
+		id := record.TransactionId
+		if id == 0 {
+			continue
+		}
+
+		open := t.open[id]
+		if record.Control != data.Control_CONTROL_NONE {
+			delete(t.open, id)
+			if record.Control == data.Control_CONTROL_ABORT && open != nil && open.Records > 0 {
+				t.aborted[id] = append(t.aborted[id], AbortedTransaction{
+					ID:          id,
+					FirstOffset: open.FirstOffset,
+					LastOffset:  record.Offset,
+				})
+			}
+			continue
+		}
+
+		if open == nil {
+			open = &OpenTransaction{Started: record.Timestamp}
+			t.open[id] = open
+		}
+
+		if open.Records == 0 {
+			open.FirstOffset = record.Offset
+		}
+		open.Records++
+	}
+}
+
+// Visibility reports whether record is stable, which it is once every
+// transaction that was open when it was appended ended, and whether a read
+// committed consumer sees it.
+func (t *Transactions) Visibility(record *data.Record) (bool, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, open := range t.open {
+		if open.Records > 0 && open.FirstOffset <= record.Offset {
+			return false, false
+		}
+	}
+
+	if record.Control != data.Control_CONTROL_NONE {
+		return true, false
+	}
+
+	if record.TransactionId == 0 {
+		return true, true
+	}
+
+	for _, aborted := range t.aborted[record.TransactionId] {
+		if aborted.FirstOffset <= record.Offset && record.Offset <= aborted.LastOffset {
+			return true, false
+		}
+	}
+
+	return true, true
+}
+
+// Expired returns the transactions that were begun before deadline
+func (t *Transactions) Expired(deadline time.Time) []uint64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var ids []uint64
+	for id, open := range t.open {
+		if open.Started < deadline.UnixNano() {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// Prune forgets the aborted transactions whose records are all below
+// lowest, they were removed from the log.
+func (t *Transactions) Prune(lowest uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id, ranges := range t.aborted {
+		kept := ranges[:0]
+		for _, a := range ranges {
+			if a.LastOffset >= lowest {
+				kept = append(kept, a)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(t.aborted, id)
+			continue
+		}
+		t.aborted[id] = kept
+	}
+}
+
+// abortedList returns the aborted transactions sorted by their first
+// offset, the order they are saved in. The caller must hold mu.
+func (t *Transactions) abortedList() []AbortedTransaction {
+	var list []AbortedTransaction
+	for _, ranges := range t.aborted {
+		list = append(list, ranges...)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].FirstOffset < list[j].FirstOffset
+	})
+
+	return list
+}
+
+// setAborted replaces the aborted transactions with list. The caller must
+// hold mu.
+func (t *Transactions) setAborted(list []AbortedTransaction) {
+	t.aborted = map[uint64][]AbortedTransaction{}
+	for _, a := range list {
+		t.aborted[a.ID] = append(t.aborted[a.ID], a)
+	}
+}
+
+// BeginTransaction opens the transaction id in the log. Records appended
+// with its id are hidden from read committed consumers until it is
+// committed and dropped for them when it is aborted. Every record of a
+// transaction is appended to the same log.
+func (l *Log) BeginTransaction(id uint64) error {
+	l.appendMu.Lock()
+	defer l.appendMu.Unlock()
+
+	if err := l.checkAppend(); err != nil {
+		return failure.Wrap(err, "l.checkAppend failed")
+	}
+
+	if err := l.transactions.Begin(id, time.Now()); err != nil {
+		return failure.Wrap(err, "l.transactions.Begin failed")
+	}
+
+	return nil
+}
+
+// CommitTransaction appends the control record that commits transaction id
+// and returns its offset
+func (l *Log) CommitTransaction(id uint64) (uint64, error) {
+	off, err := l.endTransaction(id, data.Control_CONTROL_COMMIT)
+	if err != nil {
+		return 0, failure.Wrap(err, "l.endTransaction failed")
+	}
+
+	return off, nil
+}
+
+// AbortTransaction appends the control record that aborts transaction id
+// and returns its offset
+func (l *Log) AbortTransaction(id uint64) (uint64, error) {
+	off, err := l.endTransaction(id, data.Control_CONTROL_ABORT)
+	if err != nil {
+		return 0, failure.Wrap(err, "l.endTransaction failed")
+	}
+
+	return off, nil
+}
+
+func (l *Log) endTransaction(id uint64, control data.Control) (uint64, error) {
+	l.appendMu.Lock()
+	defer l.appendMu.Unlock()
+
+	if err := l.checkAppend(); err != nil {
+		return 0, failure.Wrap(err, "l.checkAppend failed")
+	}
+
+	marker, err := l.transactions.Marker(id, control)
+	if err != nil {
+		return 0, failure.Wrap(err, "l.transactions.Marker failed")
+	}
+
+	off, _, err := l.writeRecords([]*data.Record{marker})
+	if err != nil {
+		return 0, failure.Wrap(err, "l.writeRecords failed")
+	}
+
+	return off, nil
+}
+
+// AbortExpired aborts every transaction that was open for longer than
+// Transaction.Timeout as of now
+func (l *Log) AbortExpired(now time.Time) error {
+	for _, id := range l.transactions.Expired(now.Add(-l.Config.Transaction.Timeout)) {
+		off, err := l.AbortTransaction(id)
+		if failure.IsNotFound(err) {
+			// it ended while the others were aborted
+			continue
+		}
+		if err != nil {
+			return failure.Wrap(err, "l.AbortTransaction failed (%d)", id)
+		}
+
+		l.Config.Logger.Infow("transaction",
+			"status", "transaction timed out",
+			"dir", l.Dir,
+			"transaction-id", id,
+			"offset", off,
+		)
+	}
+
+	return nil
+}
+
+// ReadCommitted is Read for read committed consumers. An offset at or past
+// the last stable offset fails with failure.OutOfRange and a record they do
+// not see with failure.NotFound.
+func (l *Log) ReadCommitted(off uint64) (*data.Record, error) {
+	rec, err := l.Read(off)
+	if err != nil {
+		return nil, failure.Wrap(err, "l.Read failed")
+	}
+
+	stable, visible := l.transactions.Visibility(rec)
+	if !stable {
+		return nil, failure.OutOfRange("offset (%d) is past the last stable offset", off)
+	}
+
+	if !visible {
+		return nil, failure.NotFound("offset (%d) is not a committed record", off)
+	}
+
+	return rec, nil
+}
+
+// ReadNextCommitted is ReadNext for read committed consumers. It skips the
+// records they do not see and blocks at the last stable offset until the
+// transaction holding it back ends.
+func (l *Log) ReadNextCommitted(ctx context.Context, off uint64) (*data.Record, error) {
+	for {
+		// taken before looking so a transaction that ends while looking
+		// still wakes the reader up
+		appended := l.appendedCh()
+
+		rec, err := l.ReadNext(ctx, off)
+		if err != nil {
+			return nil, failure.Wrap(err, "l.ReadNext failed")
+		}
+
+		stable, visible := l.transactions.Visibility(rec)
+		if !stable {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-appended:
+			}
+			continue
+		}
+
+		if visible {
+			return rec, nil
+		}
+		off = rec.Offset + 1
+	}
+}
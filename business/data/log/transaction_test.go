@@ -0,0 +1,99 @@
+package log_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/rsb/failure"
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+	"github.com/rsb/prolog/business/data/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog_TransactionsRestart(t *testing.T) {
+	for scenario, crash := range map[string]bool{
+		"clean shutdown": false,
+		"crash":          true,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "transactions-test")
+			require.NoError(t, err)
+			defer func() { _ = os.RemoveAll(dir) }()
+
+			c := log.Config{}
+			c.Segment.MaxStoreBytes = 64
+			l, err := log.NewLog(dir, c)
+			require.NoError(t, err)
+
+			for _, id := range []uint64{1, 2, 3} {
+				require.NoError(t, l.BeginTransaction(id))
+				_, err = l.Append(&data.Record{Value: []byte("hello world"), TransactionId: id})
+				require.NoError(t, err)
+			}
+			_, err = l.AbortTransaction(2)
+			require.NoError(t, err)
+			_, err = l.CommitTransaction(3)
+			require.NoError(t, err)
+			require.NoError(t, l.Close())
+
+			if crash {
+				// without the state saved by Close, the records are scanned
+				require.NoError(t, os.Remove(path.Join(dir, log.CleanShutdownFile)))
+				require.NoError(t, os.Remove(path.Join(dir, log.StateFile)))
+			}
+
+			l, err = log.NewLog(dir, c)
+			require.NoError(t, err)
+			defer func() { _ = l.Close() }()
+
+			// the first transaction is still open and holds everything back
+			_, err = l.ReadCommitted(2)
+			require.True(t, failure.IsOutOfRange(err), err)
+
+			_, err = l.CommitTransaction(1)
+			require.NoError(t, err)
+
+			rec, err := l.ReadCommitted(0)
+			require.NoError(t, err)
+			require.Equal(t, uint64(1), rec.TransactionId)
+
+			_, err = l.ReadCommitted(1)
+			require.True(t, failure.IsNotFound(err), err)
+
+			rec, err = l.ReadCommitted(2)
+			require.NoError(t, err)
+			require.Equal(t, uint64(3), rec.TransactionId)
+		})
+	}
+}
+
+func TestLog_TransactionTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transaction-timeout-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := log.Config{}
+	c.Transaction.Timeout = time.Minute
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer func() { _ = l.Close() }()
+
+	require.NoError(t, l.BeginTransaction(1))
+	_, err = l.Append(&data.Record{Value: []byte("hello world"), TransactionId: 1})
+	require.NoError(t, err)
+
+	require.NoError(t, l.AbortExpired(time.Now()))
+	_, err = l.ReadCommitted(0)
+	require.True(t, failure.IsOutOfRange(err), err)
+
+	require.NoError(t, l.AbortExpired(time.Now().Add(2*time.Minute)))
+	_, err = l.ReadCommitted(0)
+	require.True(t, failure.IsNotFound(err), err)
+
+	rec, err := l.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, data.Control_CONTROL_ABORT, rec.Control)
+}
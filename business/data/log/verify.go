@@ -0,0 +1,489 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rsb/failure"
+	"google.golang.org/protobuf/proto"
+
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+)
+
+// ProblemKind classifies an inconsistency found by Verify
+type ProblemKind string
+
+const (
+	ProblemOffsetGap      ProblemKind = "offset-gap"
+	ProblemCorruptRecord  ProblemKind = "corrupt-record"
+	ProblemUndecodable    ProblemKind = "undecodable-record"
+	ProblemOffsetMismatch ProblemKind = "offset-mismatch"
+	ProblemIndexPastStore ProblemKind = "index-past-store"
+	ProblemIndexMismatch  ProblemKind = "index-mismatch"
+	ProblemIndexUnclean   ProblemKind = "index-unclean"
+	ProblemMissingIndex   ProblemKind = "missing-index"
+	ProblemStrayFile      ProblemKind = "stray-file"
+	ProblemTimeIndex      ProblemKind = "time-index-mismatch"
+)
+
+// Problem is a single inconsistency found in a log directory
+type Problem struct {
+	Kind   ProblemKind
+	File   string
+	Detail string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("[%s] %s: %s", p.Kind, p.File, p.Detail)
+}
+
+// SegmentReport summarizes what Verify found on disk for one segment
+type SegmentReport struct {
+	// Version is the format version of the segment's store
+	Version      uint32
+	BaseOffset   uint64
+	NextOffset   uint64
+	Records      uint64
+	IndexEntries uint64
+	TimeEntries  uint64
+	StoreBytes   uint64
+}
+
+// VerifyReport is the result of walking every segment in a log directory
+type VerifyReport struct {
+	Dir      string
+	Segments []SegmentReport
+	Problems []Problem
+}
+
+// OK is true when no problems were found
+func (r VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Verify walks every segment in dir and checks that the index and the store
+// agree with each other. It only reads the files, so it is safe to run
+// against a log that is not open. The keys in c are used to decrypt
+// encrypted segments and c.Segment.IndexIntervalBytes tells whether every
+// record is expected to have an index entry. Problems with the data are
+// reported in the VerifyReport; an error is only returned when the directory
+// itself can not be read or a segment's key is not configured.
+func Verify(dir string, c Config) (VerifyReport, error) {
+	report := VerifyReport{Dir: dir}
+
+	baseOffsets, stray, err := segmentFiles(dir)
+	if err != nil {
+		return report, failure.Wrap(err, "segmentFiles failed")
+	}
+
+	for _, name := range stray {
+		report.Problems = append(report.Problems, Problem{
+			Kind:   ProblemStrayFile,
+			File:   name,
+			Detail: "file does not belong to any segment",
+		})
+	}
+
+	for i, base := range baseOffsets {
+		seg, problems, err := verifySegment(dir, base, c)
+		if err != nil {
+			return report, failure.Wrap(err, "verifySegment failed (%d)", base)
+		}
+
+		if i > 0 {
+			prev := report.Segments[i-1]
+			if prev.NextOffset != base {
+				report.Problems = append(report.Problems, Problem{
+					Kind:   ProblemOffsetGap,
+					File:   segmentName(base, StoreExt),
+					Detail: fmt.Sprintf("previous segment ends at (%d) but this one starts at (%d)", prev.NextOffset, base),
+				})
+			}
+		}
+
+		report.Segments = append(report.Segments, seg)
+		report.Problems = append(report.Problems, problems...)
+	}
+
+	return report, nil
+}
+
+func verifySegment(dir string, base uint64, c Config) (SegmentReport, []Problem, error) {
+	var problems []Problem
+	report := SegmentReport{BaseOffset: base, NextOffset: base}
+	storeName := segmentName(base, StoreExt)
+	indexName := segmentName(base, IndexExt)
+
+	f, err := os.Open(path.Join(dir, storeName))
+	if err != nil {
+		return report, nil, failure.ToSystem(err, "os.Open failed for (%s)", storeName)
+	}
+	defer func() { _ = f.Close() }()
+
+	store, err := NewStore(f)
+	if err != nil {
+		return report, nil, failure.Wrap(err, "NewStore failed")
+	}
+	report.StoreBytes = store.size
+	report.Version = store.format.Version
+
+	if store.aead, err = segmentCipher(dir, base, c, false); err != nil {
+		return report, nil, failure.Wrap(err, "segmentCipher failed")
+	}
+
+	var positions, offsets []uint64
+	pos := store.format.Header
+	for {
+		p, err := store.Read(pos)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if IsCorrupt(err) {
+			problems = append(problems, Problem{
+				Kind:   ProblemCorruptRecord,
+				File:   storeName,
+				Detail: fmt.Sprintf("offset (%d) at position (%d): %s", report.NextOffset, pos, err),
+			})
+			break
+		}
+		if err != nil {
+			return report, nil, failure.Wrap(err, "store.Read failed (%d)", pos)
+		}
+
+		record := data.Record{}
+		if err = proto.Unmarshal(p, &record); err != nil {
+			problems = append(problems, Problem{
+				Kind:   ProblemUndecodable,
+				File:   storeName,
+				Detail: fmt.Sprintf("offset (%d) at position (%d): %s", report.NextOffset, pos, err),
+			})
+		} else if record.Offset < report.NextOffset {
+			problems = append(problems, Problem{
+				Kind:   ProblemOffsetMismatch,
+				File:   storeName,
+				Detail: fmt.Sprintf("record at position (%d) has offset (%d), expected at least (%d)", pos, record.Offset, report.NextOffset),
+			})
+		} else {
+			// compaction leaves holes in the offsets but they always increase
+			report.NextOffset = record.Offset
+		}
+
+		positions = append(positions, pos)
+		offsets = append(offsets, report.NextOffset-base)
+		report.Records++
+		report.NextOffset++
+		pos += store.frameSize(p)
+	}
+
+	b, err := ioutil.ReadFile(path.Join(dir, indexName))
+	if os.IsNotExist(err) {
+		problems = append(problems, Problem{
+			Kind:   ProblemMissingIndex,
+			File:   indexName,
+			Detail: "store has no index",
+		})
+		return report, problems, nil
+	}
+	if err != nil {
+		return report, nil, failure.ToSystem(err, "ioutil.ReadFile failed for (%s)", indexName)
+	}
+
+	format, err := ParseFormat(b, IndexMagic)
+	if err != nil {
+		return report, nil, failure.Wrap(err, "ParseFormat failed for (%s)", indexName)
+	}
+	b = b[format.Header:]
+
+	if rem := uint64(len(b)) % EntWidth; rem != 0 {
+		problems = append(problems, Problem{
+			Kind:   ProblemIndexMismatch,
+			File:   indexName,
+			Detail: fmt.Sprintf("index ends with a partial entry of (%d) bytes", rem),
+		})
+	}
+
+	// a sparse index only has entries for some records, but every entry
+	// must point at a record boundary and they must be in offset order
+	boundaries := map[uint64]uint64{}
+	for i, p := range positions {
+		boundaries[p] = offsets[i]
+	}
+
+	var lastOff uint32
+	entries := uint64(len(b)) / EntWidth
+	for i := uint64(0); i < entries; i++ {
+		ent := b[i*EntWidth : (i+1)*EntWidth]
+		off := Enc.Uint32(ent[:OffWidth])
+		entPos := Enc.Uint64(ent[OffWidth:])
+
+		if i > 0 && off == 0 && entPos == 0 && isZero(b[i*EntWidth:]) {
+			problems = append(problems, Problem{
+				Kind:   ProblemIndexUnclean,
+				File:   indexName,
+				Detail: fmt.Sprintf("index is zero padded after (%d) entries, the log was not shut down cleanly", i),
+			})
+			break
+		}
+		report.IndexEntries++
+
+		switch {
+		case entPos >= store.size:
+			problems = append(problems, Problem{
+				Kind:   ProblemIndexPastStore,
+				File:   indexName,
+				Detail: fmt.Sprintf("entry (%d) points to position (%d) but the store is (%d) bytes", i, entPos, store.size),
+			})
+		case !isBoundary(boundaries, entPos, off):
+			problems = append(problems, Problem{
+				Kind:   ProblemIndexMismatch,
+				File:   indexName,
+				Detail: fmt.Sprintf("entry (%d) maps offset (%d) to position (%d) which is not a record boundary", i, off, entPos),
+			})
+		case i > 0 && off <= lastOff:
+			problems = append(problems, Problem{
+				Kind:   ProblemIndexMismatch,
+				File:   indexName,
+				Detail: fmt.Sprintf("entry (%d) has offset (%d) which is not after the previous entry (%d)", i, off, lastOff),
+			})
+		}
+		lastOff = off
+	}
+
+	switch {
+	case c.Segment.IndexIntervalBytes > 0 && report.Records > 0 && report.IndexEntries == 0:
+		problems = append(problems, Problem{
+			Kind:   ProblemIndexMismatch,
+			File:   indexName,
+			Detail: fmt.Sprintf("sparse index has no entries but the store holds (%d) records", report.Records),
+		})
+	case c.Segment.IndexIntervalBytes == 0 && report.IndexEntries < report.Records:
+		problems = append(problems, Problem{
+			Kind:   ProblemIndexMismatch,
+			File:   indexName,
+			Detail: fmt.Sprintf("index has (%d) entries but the store holds (%d) records", report.IndexEntries, report.Records),
+		})
+	}
+
+	timeProblems, err := verifyTimeIndex(dir, base, offsets, &report)
+	if err != nil {
+		return report, nil, failure.Wrap(err, "verifyTimeIndex failed")
+	}
+
+	return report, append(problems, timeProblems...), nil
+}
+
+// verifyTimeIndex checks that every entry in the segment's time index points
+// at a record in the store and that the timestamps only ever increase. Logs
+// written before records carried timestamps have no time index, which is not
+// a problem.
+func verifyTimeIndex(dir string, base uint64, offsets []uint64, report *SegmentReport) ([]Problem, error) {
+	var problems []Problem
+	name := segmentName(base, TimeIndexExt)
+
+	b, err := ioutil.ReadFile(path.Join(dir, name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, failure.ToSystem(err, "ioutil.ReadFile failed for (%s)", name)
+	}
+
+	format, err := ParseFormat(b, TimeIndexMagic)
+	if err != nil {
+		return nil, failure.Wrap(err, "ParseFormat failed for (%s)", name)
+	}
+	b = b[format.Header:]
+
+	records := map[uint64]bool{}
+	for _, off := range offsets {
+		records[off] = true
+	}
+
+	var last int64
+	entries := uint64(len(b)) / TimeEntWidth
+	for i := uint64(0); i < entries; i++ {
+		ent := b[i*TimeEntWidth : (i+1)*TimeEntWidth]
+		ts := int64(Enc.Uint64(ent[:TsWidth]))
+		off := Enc.Uint32(ent[TsWidth:])
+
+		if ts == 0 && isZero(b[i*TimeEntWidth:]) {
+			problems = append(problems, Problem{
+				Kind:   ProblemIndexUnclean,
+				File:   name,
+				Detail: fmt.Sprintf("time index is zero padded after (%d) entries, the log was not shut down cleanly", i),
+			})
+			break
+		}
+		report.TimeEntries++
+
+		switch {
+		case !records[uint64(off)]:
+			problems = append(problems, Problem{
+				Kind:   ProblemTimeIndex,
+				File:   name,
+				Detail: fmt.Sprintf("entry (%d) maps to offset (%d) which is not in the store", i, base+uint64(off)),
+			})
+		case i > 0 && ts <= last:
+			problems = append(problems, Problem{
+				Kind:   ProblemTimeIndex,
+				File:   name,
+				Detail: fmt.Sprintf("entry (%d) has timestamp (%d) which is not after the previous entry (%d)", i, ts, last),
+			})
+		}
+		last = ts
+	}
+
+	return problems, nil
+}
+
+// RepairedSegment describes what Repair changed for one segment
+type RepairedSegment struct {
+	BaseOffset     uint64
+	NextOffset     uint64
+	TruncatedBytes uint64
+}
+
+// RepairReport is the result of repairing a log directory
+type RepairReport struct {
+	Dir      string
+	Segments []RepairedSegment
+}
+
+// Repair truncates every segment in dir to its last good record and rebuilds
+// its index from the store. Stray files are left alone, they are reported
+// by Verify so an operator can decide what to do with them. The log must
+// not be open while it is being repaired, Repair fails with Locked when it
+// is.
+func Repair(dir string, c Config) (RepairReport, error) {
+	report := RepairReport{Dir: dir}
+	if c.Segment.MaxIndexBytes == 0 {
+		c.Segment.MaxIndexBytes = DefaultMaxIndexBytes
+	}
+
+	lock, err := lockDir(dir)
+	if err != nil {
+		return report, failure.Wrap(err, "lockDir failed")
+	}
+	defer func() { _ = lock.Close() }()
+
+	baseOffsets, _, err := segmentFiles(dir)
+	if err != nil {
+		return report, failure.Wrap(err, "segmentFiles failed")
+	}
+
+	for _, base := range baseOffsets {
+		seg, err := NewSegment(dir, base, c)
+		if err != nil {
+			return report, failure.Wrap(err, "NewSegment failed (%d)", base)
+		}
+
+		dropped, err := seg.Recover()
+		if err != nil {
+			_ = seg.Close()
+			return report, failure.Wrap(err, "seg.Recover failed (%d)", base)
+		}
+
+		if err = seg.Close(); err != nil {
+			return report, failure.Wrap(err, "seg.Close failed (%d)", base)
+		}
+
+		report.Segments = append(report.Segments, RepairedSegment{
+			BaseOffset:     base,
+			NextOffset:     seg.NextOffset(),
+			TruncatedBytes: dropped,
+		})
+	}
+
+	marker := path.Join(dir, CleanShutdownFile)
+	if err = ioutil.WriteFile(marker, nil, 0644); err != nil {
+		return report, failure.ToSystem(err, "ioutil.WriteFile failed for (%s)", marker)
+	}
+
+	return report, nil
+}
+
+// segmentFiles returns the sorted base offsets of every store in dir along
+// with the names of any files that do not belong to a segment.
+func segmentFiles(dir string) ([]uint64, []string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, failure.ToSystem(err, "ioutil.ReadDir failed")
+	}
+
+	stores := map[uint64]bool{}
+	indexes := map[uint64][]string{}
+	var stray []string
+	for _, file := range files {
+		name := file.Name()
+		switch name {
+		case CleanShutdownFile, StateFile, stateTmpFile, LockFile, CompactDir, MigrateDir, TierCacheDir:
+			continue
+		}
+
+		// hidden directories hold what is kept next to the log, such as the
+		// topics of the api
+		if file.IsDir() && strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		ext := path.Ext(name)
+		off, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 0)
+		if file.IsDir() || err != nil {
+			stray = append(stray, name)
+			continue
+		}
+
+		switch ext {
+		case StoreExt:
+			stores[off] = true
+		case IndexExt, TimeIndexExt, KeyExt:
+			indexes[off] = append(indexes[off], name)
+		default:
+			stray = append(stray, name)
+		}
+	}
+
+	var baseOffsets []uint64
+	for off := range stores {
+		baseOffsets = append(baseOffsets, off)
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+
+	for off, names := range indexes {
+		if !stores[off] {
+			stray = append(stray, names...)
+		}
+	}
+	sort.Strings(stray)
+
+	return baseOffsets, stray, nil
+}
+
+// isBoundary is true when a record with the relative offset off starts at
+// pos in the store
+func isBoundary(boundaries map[uint64]uint64, pos uint64, off uint32) bool {
+	want, ok := boundaries[pos]
+	return ok && want == uint64(off)
+}
+
+func segmentName(baseOffset uint64, ext string) string {
+	return fmt.Sprintf("%d%s", baseOffset, ext)
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
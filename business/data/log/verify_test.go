@@ -0,0 +1,76 @@
+package log_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+	"github.com/rsb/prolog/business/data/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyRepair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 1024
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+
+	rec := &data.Record{Value: []byte("hello world")}
+	for i := 0; i < 3; i++ {
+		_, err = l.Append(rec)
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	report, err := log.Verify(dir, log.Config{})
+	require.NoError(t, err)
+	require.True(t, report.OK(), report.Problems)
+	require.Len(t, report.Segments, 1)
+	require.Equal(t, uint64(3), report.Segments[0].Records)
+	require.Equal(t, uint64(3), report.Segments[0].NextOffset)
+
+	// damage the last record and drop a file that does not belong
+	storeFile := path.Join(dir, "0"+log.StoreExt)
+	fi, err := os.Stat(storeFile)
+	require.NoError(t, err)
+	f, err := os.OpenFile(storeFile, os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, fi.Size()-1)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, "notes.txt"), nil, 0644))
+
+	report, err = log.Verify(dir, log.Config{})
+	require.NoError(t, err)
+	require.False(t, report.OK())
+	kinds := map[log.ProblemKind]bool{}
+	for _, p := range report.Problems {
+		kinds[p.Kind] = true
+	}
+	require.True(t, kinds[log.ProblemCorruptRecord])
+	require.True(t, kinds[log.ProblemStrayFile])
+	require.True(t, kinds[log.ProblemIndexMismatch])
+
+	repaired, err := log.Repair(dir, c)
+	require.NoError(t, err)
+	require.Len(t, repaired.Segments, 1)
+	require.Equal(t, uint64(2), repaired.Segments[0].NextOffset)
+	require.NotZero(t, repaired.Segments[0].TruncatedBytes)
+
+	report, err = log.Verify(dir, log.Config{})
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	require.Equal(t, log.ProblemStrayFile, report.Problems[0].Kind)
+
+	l, err = log.NewLog(dir, c)
+	require.NoError(t, err)
+	off, err := l.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
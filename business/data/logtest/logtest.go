@@ -0,0 +1,391 @@
+// Package logtest holds the conformance suite for server.CommitLog. Every
+// implementation runs it from its own tests so the transports behave the
+// same no matter which log they are wired to.
+package logtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rsb/failure"
+	"github.com/stretchr/testify/require"
+
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+	"github.com/rsb/prolog/business/data/log"
+	"github.com/rsb/prolog/business/data/server"
+)
+
+// NewLogFn returns an empty log along with a func that releases whatever
+// the log holds once the scenario is done
+type NewLogFn func(t *testing.T) (server.CommitLog, func())
+
+// TestCommitLog runs every scenario of the conformance suite against a new
+// log created by newLog.
+func TestCommitLog(t *testing.T, newLog NewLogFn) {
+	for scenario, fn := range map[string]func(t *testing.T, cl server.CommitLog){
+		"append and read a record":          testAppendRead,
+		"read past the end is out of range": testOutOfRange,
+		"append batch is contiguous":        testAppendBatch,
+		"offsets track appends":             testOffsets,
+		"records are copied":                testCopied,
+		"read next iterates the log":        testReadNext,
+		"read next stops with ctx":          testReadNextCtx,
+		"closed log fails clearly":          testClosed,
+		"producer retries append once":      testIdempotent,
+		"read committed hides transactions": testTransactions,
+		"read committed waits for commit":   testReadNextCommitted,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			cl, cleanup := newLog(t)
+			defer cleanup()
+
+			fn(t, cl)
+		})
+	}
+}
+
+func testAppendRead(t *testing.T, cl server.CommitLog) {
+	want := &data.Record{
+		Value:   []byte("hello world"),
+		Key:     []byte("user-1"),
+		Headers: []*data.Header{{Key: "trace-id", Value: []byte("abc")}},
+	}
+
+	for i := uint64(0); i < 3; i++ {
+		off, err := cl.Append(want)
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+		require.Equal(t, i, want.Offset)
+		require.NotZero(t, want.Timestamp)
+
+		got, err := cl.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, want.Key, got.Key)
+		require.Equal(t, want.Headers[0].Value, got.Headers[0].Value)
+		require.Equal(t, want.Timestamp, got.Timestamp)
+	}
+
+	require.NotEmpty(t, cl.Durability())
+}
+
+func testOutOfRange(t *testing.T, cl server.CommitLog) {
+	_, err := cl.Read(0)
+	require.Error(t, err)
+	require.True(t, failure.IsOutOfRange(err))
+
+	_, err = cl.Append(&data.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	_, err = cl.Read(1)
+	require.Error(t, err)
+	require.True(t, failure.IsOutOfRange(err))
+}
+
+func testAppendBatch(t *testing.T, cl server.CommitLog) {
+	_, _, err := cl.AppendBatch(nil)
+	require.Error(t, err)
+	require.True(t, failure.IsInvalidParam(err))
+
+	_, err = cl.Append(&data.Record{Value: []byte("single")})
+	require.NoError(t, err)
+
+	batch := []*data.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+		{Value: []byte("third")},
+	}
+	first, last, err := cl.AppendBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Equal(t, uint64(3), last)
+
+	for i, want := range batch {
+		got, err := cl.Read(first + uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+}
+
+func testOffsets(t *testing.T, cl server.CommitLog) {
+	lowest, err := cl.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+
+	highest, err := cl.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), highest)
+
+	for i := 0; i < 3; i++ {
+		_, err = cl.Append(&data.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	lowest, err = cl.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+
+	highest, err = cl.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+}
+
+func testCopied(t *testing.T, cl server.CommitLog) {
+	rec := &data.Record{Value: []byte("hello world")}
+	off, err := cl.Append(rec)
+	require.NoError(t, err)
+
+	// neither the appended record nor the one read back share memory with
+	// what the log holds
+	rec.Value[0] = 'j'
+	got, err := cl.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), got.Value)
+
+	got.Value[0] = 'y'
+	got, err = cl.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), got.Value)
+}
+
+func testReadNext(t *testing.T, cl server.CommitLog) {
+	_, err := cl.Append(&data.Record{Value: []byte("first")})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	got, err := cl.ReadNext(ctx, 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), got.Value)
+
+	next := make(chan *data.Record, 1)
+	errs := make(chan error, 1)
+	go func() {
+		rec, err := cl.ReadNext(ctx, got.Offset+1)
+		if err != nil {
+			errs <- err
+			return
+		}
+		next <- rec
+	}()
+
+	_, err = cl.Append(&data.Record{Value: []byte("second")})
+	require.NoError(t, err)
+
+	select {
+	case rec := <-next:
+		require.Equal(t, uint64(1), rec.Offset)
+		require.Equal(t, []byte("second"), rec.Value)
+	case err = <-errs:
+		require.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal("ReadNext was not woken up by the append")
+	}
+}
+
+func testReadNextCtx(t *testing.T, cl server.CommitLog) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := cl.ReadNext(ctx, 0)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func testIdempotent(t *testing.T, cl server.CommitLog) {
+	const producer = 7
+
+	off, err := cl.Append(&data.Record{Value: []byte("first"), ProducerId: producer, Sequence: 0})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	// records without a producer id are never deduplicated
+	_, err = cl.Append(&data.Record{Value: []byte("anonymous")})
+	require.NoError(t, err)
+
+	retry := &data.Record{Value: []byte("first"), ProducerId: producer, Sequence: 0}
+	off, err = cl.Append(retry)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.Equal(t, uint64(0), retry.Offset)
+
+	batch := []*data.Record{
+		{Value: []byte("second"), ProducerId: producer, Sequence: 1},
+		{Value: []byte("third"), ProducerId: producer, Sequence: 2},
+	}
+	first, last, err := cl.AppendBatch(batch)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), first)
+	require.Equal(t, uint64(3), last)
+
+	first, last, err = cl.AppendBatch([]*data.Record{
+		{Value: []byte("second"), ProducerId: producer, Sequence: 1},
+		{Value: []byte("third"), ProducerId: producer, Sequence: 2},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), first)
+	require.Equal(t, uint64(3), last)
+
+	highest, err := cl.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), highest)
+
+	// a batch that only overlaps what was appended is neither new nor a retry
+	_, _, err = cl.AppendBatch([]*data.Record{
+		{Value: []byte("third"), ProducerId: producer, Sequence: 2},
+		{Value: []byte("fourth"), ProducerId: producer, Sequence: 3},
+	})
+	require.True(t, failure.IsAlreadyExists(err), err)
+
+	_, _, err = cl.AppendBatch([]*data.Record{
+		{Value: []byte("fourth"), ProducerId: producer, Sequence: 3},
+		{Value: []byte("fifth"), ProducerId: producer, Sequence: 5},
+	})
+	require.True(t, failure.IsInvalidParam(err), err)
+}
+
+func testTransactions(t *testing.T, cl server.CommitLog) {
+	_, err := cl.Append(&data.Record{Value: []byte("t1 record"), TransactionId: 1})
+	require.True(t, failure.IsNotFound(err), err)
+
+	require.NoError(t, cl.BeginTransaction(1))
+	require.True(t, failure.IsAlreadyExists(cl.BeginTransaction(1)))
+	require.NoError(t, cl.BeginTransaction(2))
+
+	_, _, err = cl.AppendBatch([]*data.Record{
+		{Value: []byte("t1 first"), TransactionId: 1},
+		{Value: []byte("t1 second"), TransactionId: 1},
+	})
+	require.NoError(t, err)
+	_, err = cl.Append(&data.Record{Value: []byte("plain")})
+	require.NoError(t, err)
+	_, err = cl.Append(&data.Record{Value: []byte("t2"), TransactionId: 2})
+	require.NoError(t, err)
+
+	_, err = cl.Append(&data.Record{Value: []byte("forged"), Control: data.Control_CONTROL_COMMIT})
+	require.True(t, failure.IsInvalidParam(err), err)
+
+	// nothing is stable while the first transaction is open
+	_, err = cl.ReadCommitted(2)
+	require.True(t, failure.IsOutOfRange(err), err)
+
+	rec, err := cl.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("t1 first"), rec.Value)
+
+	off, err := cl.CommitTransaction(1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+
+	rec, err = cl.ReadCommitted(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("t1 second"), rec.Value)
+
+	rec, err = cl.ReadCommitted(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("plain"), rec.Value)
+
+	_, err = cl.ReadCommitted(3)
+	require.True(t, failure.IsOutOfRange(err), err)
+
+	off, err = cl.AbortTransaction(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+
+	_, err = cl.ReadCommitted(3)
+	require.True(t, failure.IsNotFound(err), err)
+	_, err = cl.ReadCommitted(4)
+	require.True(t, failure.IsNotFound(err), err)
+
+	// the control records are still there for readers that ask for them
+	rec, err = cl.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, data.Control_CONTROL_ABORT, rec.Control)
+	require.Equal(t, uint64(2), rec.TransactionId)
+
+	_, err = cl.CommitTransaction(2)
+	require.True(t, failure.IsNotFound(err), err)
+}
+
+func testReadNextCommitted(t *testing.T, cl server.CommitLog) {
+	require.NoError(t, cl.BeginTransaction(1))
+	require.NoError(t, cl.BeginTransaction(2))
+
+	for _, rec := range []*data.Record{
+		{Value: []byte("aborted"), TransactionId: 2},
+		{Value: []byte("committed"), TransactionId: 1},
+	} {
+		_, err := cl.Append(rec)
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	next := make(chan *data.Record, 1)
+	errs := make(chan error, 1)
+	go func() {
+		rec, err := cl.ReadNextCommitted(ctx, 0)
+		if err != nil {
+			errs <- err
+			return
+		}
+		next <- rec
+	}()
+
+	_, err := cl.AbortTransaction(2)
+	require.NoError(t, err)
+
+	select {
+	case rec := <-next:
+		t.Fatalf("read (%s) before the transaction was committed", rec.Value)
+	case err = <-errs:
+		require.NoError(t, err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	_, err = cl.CommitTransaction(1)
+	require.NoError(t, err)
+
+	select {
+	case rec := <-next:
+		require.Equal(t, uint64(1), rec.Offset)
+		require.Equal(t, []byte("committed"), rec.Value)
+	case err = <-errs:
+		require.NoError(t, err)
+	case <-ctx.Done():
+		t.Fatal("ReadNextCommitted was not woken up by the commit")
+	}
+}
+
+func testClosed(t *testing.T, cl server.CommitLog) {
+	_, err := cl.Append(&data.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := cl.ReadNext(context.Background(), 1)
+		errs <- err
+	}()
+
+	require.NoError(t, cl.Close())
+	require.NoError(t, cl.Close())
+
+	select {
+	case err = <-errs:
+		require.True(t, log.IsClosed(err))
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadNext was not woken up by Close")
+	}
+
+	_, err = cl.Append(&data.Record{Value: []byte("hello world")})
+	require.True(t, log.IsClosed(err))
+
+	_, _, err = cl.AppendBatch([]*data.Record{{Value: []byte("hello world")}})
+	require.True(t, log.IsClosed(err))
+
+	_, err = cl.Read(0)
+	require.True(t, log.IsClosed(err))
+}
@@ -0,0 +1,353 @@
+// Package memlog is a commit log that only lives in memory. It serves the
+// same contract as the log on disk, so the api can run without a storage
+// directory and tests can use it in its place, but every record is lost when
+// the process exits.
+package memlog
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rsb/failure"
+	"google.golang.org/protobuf/proto"
+
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+	"github.com/rsb/prolog/business/data/log"
+)
+
+// Durability is reported for every append, nothing survives a restart
+const Durability = "memory"
+
+type Log struct {
+	mu      sync.RWMutex
+	records []*data.Record
+	// producers dedupes the appends of idempotent producers and
+	// transactions hides uncommitted records from read committed readers
+	// the same way the log on disk does, for as long as the process lives.
+	// Transactions are not aborted when they time out.
+	producers    *log.Producers
+	transactions *log.Transactions
+	// appended is closed and replaced on every append to wake up readers
+	// waiting in ReadNext.
+	appended chan struct{}
+	closed   bool
+}
+
+func New() *Log {
+	return &Log{
+		appended:     make(chan struct{}),
+		producers:    log.NewProducers(),
+		transactions: log.NewTransactions(),
+	}
+}
+
+// Append stores a copy of record and sets its offset and append timestamp,
+// the same way the log on disk does.
+func (l *Log) Append(record *data.Record) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	off, _, err := l.appendRecords([]*data.Record{record})
+	if err != nil {
+		return 0, failure.Wrap(err, "l.appendRecords failed")
+	}
+
+	return off, nil
+}
+
+// AppendBatch appends every record under a single acquisition of the lock
+// and returns the offsets of the first and last record.
+func (l *Log) AppendBatch(records []*data.Record) (uint64, uint64, error) {
+	if len(records) == 0 {
+		return 0, 0, failure.InvalidParam("batch has no records")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	first, last, err := l.appendRecords(records)
+	if err != nil {
+		return 0, 0, failure.Wrap(err, "l.appendRecords failed")
+	}
+
+	return first, last, nil
+}
+
+// appendRecords appends records unless an idempotent producer appended
+// them before, in which case their original offsets are returned. The
+// caller must hold the write lock.
+func (l *Log) appendRecords(records []*data.Record) (uint64, uint64, error) {
+	if err := l.checkOpen(); err != nil {
+		return 0, 0, failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	dup, err := l.producers.Check(records)
+	if err != nil {
+		return 0, 0, failure.Wrap(err, "l.producers.Check failed")
+	}
+
+	if dup {
+		return records[0].Offset, records[len(records)-1].Offset, nil
+	}
+
+	if err = l.transactions.Check(records); err != nil {
+		return 0, 0, failure.Wrap(err, "l.transactions.Check failed")
+	}
+
+	first, last := l.write(records)
+	return first, last, nil
+}
+
+// write appends records, updates the producers and transactions and wakes
+// up waiting readers. The caller must hold the write lock.
+func (l *Log) write(records []*data.Record) (uint64, uint64) {
+	first := uint64(len(l.records))
+	var last uint64
+	for _, record := range records {
+		last = l.append(record)
+	}
+	l.producers.Add(records)
+	l.transactions.Add(records)
+	l.notify()
+
+	return first, last
+}
+
+// BeginTransaction opens the transaction id
+func (l *Log) BeginTransaction(id uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkOpen(); err != nil {
+		return failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	if err := l.transactions.Begin(id, time.Now()); err != nil {
+		return failure.Wrap(err, "l.transactions.Begin failed")
+	}
+
+	return nil
+}
+
+func (l *Log) CommitTransaction(id uint64) (uint64, error) {
+	off, err := l.endTransaction(id, data.Control_CONTROL_COMMIT)
+	if err != nil {
+		return 0, failure.Wrap(err, "l.endTransaction failed")
+	}
+
+	return off, nil
+}
+
+func (l *Log) AbortTransaction(id uint64) (uint64, error) {
+	off, err := l.endTransaction(id, data.Control_CONTROL_ABORT)
+	if err != nil {
+		return 0, failure.Wrap(err, "l.endTransaction failed")
+	}
+
+	return off, nil
+}
+
+// endTransaction appends the control record that ends transaction id
+func (l *Log) endTransaction(id uint64, control data.Control) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.checkOpen(); err != nil {
+		return 0, failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	marker, err := l.transactions.Marker(id, control)
+	if err != nil {
+		return 0, failure.Wrap(err, "l.transactions.Marker failed")
+	}
+
+	off, _ := l.write([]*data.Record{marker})
+	return off, nil
+}
+
+// append stores the record at the next offset. The caller must hold the
+// write lock.
+func (l *Log) append(record *data.Record) uint64 {
+	record.Offset = uint64(len(l.records))
+	record.Timestamp = time.Now().UnixNano()
+	l.records = append(l.records, proto.Clone(record).(*data.Record))
+
+	return record.Offset
+}
+
+func (l *Log) Durability() string {
+	return Durability
+}
+
+func (l *Log) Read(off uint64) (*data.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
+		return nil, failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	if off >= uint64(len(l.records)) {
+		return nil, failure.OutOfRange("invalid offset %d", off)
+	}
+
+	return proto.Clone(l.records[off]).(*data.Record), nil
+}
+
+// ReadNext returns the record at off. When off has not been appended yet it
+// blocks until it is, ctx is done or the log is closed.
+func (l *Log) ReadNext(ctx context.Context, off uint64) (*data.Record, error) {
+	for {
+		rec, appended, err := l.readNext(off)
+		if err != nil {
+			return nil, failure.Wrap(err, "l.readNext failed (%d)", off)
+		}
+
+		if rec != nil {
+			return rec, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-appended:
+		}
+	}
+}
+
+// readNext reads the record at off. When there is none yet it returns the
+// channel that is closed by the next append instead.
+func (l *Log) readNext(off uint64) (*data.Record, <-chan struct{}, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
+		return nil, nil, failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	if off < uint64(len(l.records)) {
+		return proto.Clone(l.records[off]).(*data.Record), nil, nil
+	}
+
+	return nil, l.appended, nil
+}
+
+// ReadCommitted is Read for read committed readers. An offset at or past
+// the last stable offset fails with failure.OutOfRange and a record they do
+// not see with failure.NotFound.
+func (l *Log) ReadCommitted(off uint64) (*data.Record, error) {
+	rec, err := l.Read(off)
+	if err != nil {
+		return nil, failure.Wrap(err, "l.Read failed")
+	}
+
+	stable, visible := l.transactions.Visibility(rec)
+	if !stable {
+		return nil, failure.OutOfRange("offset (%d) is past the last stable offset", off)
+	}
+
+	if !visible {
+		return nil, failure.NotFound("offset (%d) is not a committed record", off)
+	}
+
+	return rec, nil
+}
+
+// ReadNextCommitted is ReadNext for read committed readers. It skips the
+// records they do not see and blocks at the last stable offset until the
+// transaction holding it back ends.
+func (l *Log) ReadNextCommitted(ctx context.Context, off uint64) (*data.Record, error) {
+	for {
+		rec, appended, err := l.readNextCommitted(off)
+		if err != nil {
+			return nil, failure.Wrap(err, "l.readNextCommitted failed (%d)", off)
+		}
+
+		if rec != nil {
+			return rec, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-appended:
+		}
+	}
+}
+
+// readNextCommitted reads the first record at or after off a read committed
+// reader sees. When there is none yet it returns the channel that is closed
+// by the next append instead.
+func (l *Log) readNextCommitted(off uint64) (*data.Record, <-chan struct{}, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if err := l.checkOpen(); err != nil {
+		return nil, nil, failure.Wrap(err, "l.checkOpen failed")
+	}
+
+	for ; off < uint64(len(l.records)); off++ {
+		stable, visible := l.transactions.Visibility(l.records[off])
+		if !stable {
+			break
+		}
+
+		if visible {
+			return proto.Clone(l.records[off]).(*data.Record), nil, nil
+		}
+	}
+
+	return nil, l.appended, nil
+}
+
+// LowestOffset is always zero, records are never removed from memory
+func (l *Log) LowestOffset() (uint64, error) {
+	return 0, nil
+}
+
+func (l *Log) HighestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if len(l.records) == 0 {
+		return 0, nil
+	}
+
+	return uint64(len(l.records) - 1), nil
+}
+
+// Close drops every record. Closing a log that is already closed does
+// nothing.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+
+	// readers blocked in ReadNext find the log closed once they wake up
+	l.closed = true
+	l.records = nil
+	l.notify()
+
+	return nil
+}
+
+// notify wakes up every reader waiting for an append. The caller must hold
+// the write lock.
+func (l *Log) notify() {
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+// checkOpen fails with log.Closed once the log was closed. The caller must
+// hold at least the read lock.
+func (l *Log) checkOpen() error {
+	if l.closed {
+		return log.Closed("log is closed")
+	}
+
+	return nil
+}
@@ -0,0 +1,16 @@
+package memlog_test
+
+import (
+	"testing"
+
+	"github.com/rsb/prolog/business/data/logtest"
+	"github.com/rsb/prolog/business/data/memlog"
+	"github.com/rsb/prolog/business/data/server"
+)
+
+func TestLog_CommitLog(t *testing.T) {
+	logtest.TestCommitLog(t, func(t *testing.T) (server.CommitLog, func()) {
+		l := memlog.New()
+		return l, func() { _ = l.Close() }
+	})
+}
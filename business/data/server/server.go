@@ -2,23 +2,61 @@ package server
 
 import (
 	"context"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	"github.com/rsb/failure"
 	data "github.com/rsb/prolog/app/api/handlers/v1"
+	"github.com/rsb/prolog/business/data/broker"
+	"github.com/rsb/prolog/business/data/group"
+	"github.com/rsb/prolog/business/data/log"
+	"github.com/rsb/prolog/business/data/memlog"
 )
 
+// CommitLog is the storage both transports read and write. The log on disk
+// and the one in memory implement it, logtest.TestCommitLog holds the
+// behavior every implementation must share.
 type CommitLog interface {
 	Append(record *data.Record) (uint64, error)
+	AppendBatch(records []*data.Record) (uint64, uint64, error)
+	Durability() string
 	Read(offset uint64) (*data.Record, error)
+	// ReadNext iterates the log, it returns the first record at or after
+	// offset and blocks until one is appended.
+	ReadNext(ctx context.Context, offset uint64) (*data.Record, error)
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+	Close() error
+
+	BeginTransaction(id uint64) error
+	CommitTransaction(id uint64) (uint64, error)
+	AbortTransaction(id uint64) (uint64, error)
+	// ReadCommitted and ReadNextCommitted are Read and ReadNext for read
+	// committed consumers, they never return control records or records of
+	// open or aborted transactions.
+	ReadCommitted(offset uint64) (*data.Record, error)
+	ReadNextCommitted(ctx context.Context, offset uint64) (*data.Record, error)
 }
 
+// Config holds the logs the server reads and writes. Requests without a
+// topic go to CommitLog and requests with one are routed to a partition of
+// that topic in the Broker. Groups coordinates the consumer groups of both.
 type Config struct {
 	CommitLog CommitLog
+	Broker    *broker.Broker
+	Groups    *group.Coordinator
 }
 
-var _ data.LogServer = (*GRPCServer)(nil)
+var (
+	_ data.LogServer  = (*GRPCServer)(nil)
+	_ CommitLog       = (*log.Log)(nil)
+	_ CommitLog       = (*memlog.Log)(nil)
+	_ group.OffsetLog = (*log.Log)(nil)
+	_ group.OffsetLog = (*memlog.Log)(nil)
+)
 
 type GRPCServer struct {
 	data.UnimplementedLogServer
@@ -41,13 +79,73 @@ func newGRPCServer(config *Config) (*GRPCServer, error) {
 	return &srv, nil
 }
 
+// Produce appends the record of req. When req carries a producer id, a
+// retry with a sequence that was appended before gets back the original
+// offset instead of appending the record again.
 func (s *GRPCServer) Produce(ctx context.Context, req *data.ProduceRequest) (*data.ProduceResponse, error) {
-	offset, err := s.CommitLog.Append(req.Record)
+	if req.Record == nil {
+		return nil, status.Error(codes.InvalidArgument, "record is required")
+	}
+
+	req.Record.ProducerId = req.ProducerId
+	req.Record.Sequence = req.Sequence
+	req.Record.TransactionId = req.TransactionId
+
+	cl, partition, err := s.producerLog(req.Topic, req.Record)
 	if err != nil {
-		return nil, failure.Wrap(err, "s.CommitLog.Append failed")
+		return nil, failure.Wrap(err, "s.producerLog failed")
 	}
 
-	return &data.ProduceResponse{Offset: offset}, nil
+	offset, err := cl.Append(req.Record)
+	if err != nil {
+		return nil, failure.Wrap(err, "cl.Append failed")
+	}
+
+	resp := data.ProduceResponse{
+		Offset:     offset,
+		Durability: cl.Durability(),
+		Partition:  partition,
+	}
+
+	return &resp, nil
+}
+
+func (s *GRPCServer) ProduceBatch(ctx context.Context, req *data.ProduceBatchRequest) (*data.ProduceBatchResponse, error) {
+	if len(req.Records) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "batch has no records")
+	}
+
+	for i, record := range req.Records {
+		if record == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "record (%d) of the batch is nil", i)
+		}
+	}
+
+	for i, record := range req.Records {
+		record.ProducerId = req.ProducerId
+		record.Sequence = req.FirstSequence + uint64(i)
+		record.TransactionId = req.TransactionId
+	}
+
+	// the whole batch goes to one partition so its offsets stay contiguous
+	cl, partition, err := s.producerLog(req.Topic, req.Records[0])
+	if err != nil {
+		return nil, failure.Wrap(err, "s.producerLog failed")
+	}
+
+	first, last, err := cl.AppendBatch(req.Records)
+	if err != nil {
+		return nil, failure.Wrap(err, "cl.AppendBatch failed")
+	}
+
+	resp := data.ProduceBatchResponse{
+		FirstOffset: first,
+		LastOffset:  last,
+		Durability:  cl.Durability(),
+		Partition:   partition,
+	}
+
+	return &resp, nil
 }
 
 func (s *GRPCServer) ProduceStream(stream data.Log_ProduceStreamServer) error {
@@ -58,6 +156,10 @@ func (s *GRPCServer) ProduceStream(stream data.Log_ProduceStreamServer) error {
 		}
 
 		result, err := s.Produce(stream.Context(), req)
+		if _, ok := status.FromError(err); ok && err != nil {
+			// wrapping would hide the status code from the client
+			return err
+		}
 		if err != nil {
 			return failure.Wrap(err, "s.Produce failed")
 		}
@@ -68,11 +170,214 @@ func (s *GRPCServer) ProduceStream(stream data.Log_ProduceStreamServer) error {
 	}
 }
 
+// InitProducer hands out the id an idempotent producer attaches to its
+// requests
+func (s *GRPCServer) InitProducer(ctx context.Context, req *data.InitProducerRequest) (*data.InitProducerResponse, error) {
+	id, err := log.NewProducerID()
+	if err != nil {
+		return nil, failure.Wrap(err, "log.NewProducerID failed")
+	}
+
+	return &data.InitProducerResponse{ProducerId: id}, nil
+}
+
+// BeginTransaction opens a transaction on the partition of the topic its
+// records are appended to, which the topic's partitioner picks from the
+// transaction id.
+func (s *GRPCServer) BeginTransaction(ctx context.Context, req *data.BeginTransactionRequest) (*data.BeginTransactionResponse, error) {
+	id, err := log.NewTransactionID()
+	if err != nil {
+		return nil, failure.Wrap(err, "log.NewTransactionID failed")
+	}
+
+	cl, partition, err := s.producerLog(req.Topic, &data.Record{TransactionId: id})
+	if err != nil {
+		return nil, failure.Wrap(err, "s.producerLog failed")
+	}
+
+	if err = cl.BeginTransaction(id); err != nil {
+		return nil, failure.Wrap(err, "cl.BeginTransaction failed")
+	}
+
+	return &data.BeginTransactionResponse{TransactionId: id, Partition: partition}, nil
+}
+
+func (s *GRPCServer) CommitTransaction(ctx context.Context, req *data.EndTransactionRequest) (*data.EndTransactionResponse, error) {
+	cl, partition, err := s.producerLog(req.Topic, &data.Record{TransactionId: req.TransactionId})
+	if err != nil {
+		return nil, failure.Wrap(err, "s.producerLog failed")
+	}
+
+	off, err := cl.CommitTransaction(req.TransactionId)
+	if err != nil {
+		return nil, failure.Wrap(err, "cl.CommitTransaction failed")
+	}
+
+	return &data.EndTransactionResponse{Offset: off, Partition: partition}, nil
+}
+
+func (s *GRPCServer) AbortTransaction(ctx context.Context, req *data.EndTransactionRequest) (*data.EndTransactionResponse, error) {
+	cl, partition, err := s.producerLog(req.Topic, &data.Record{TransactionId: req.TransactionId})
+	if err != nil {
+		return nil, failure.Wrap(err, "s.producerLog failed")
+	}
+
+	off, err := cl.AbortTransaction(req.TransactionId)
+	if err != nil {
+		return nil, failure.Wrap(err, "cl.AbortTransaction failed")
+	}
+
+	return &data.EndTransactionResponse{Offset: off, Partition: partition}, nil
+}
+
+// CreateTopic creates a topic in the server's broker with a partition count
+// that can not be changed later
+func (s *GRPCServer) CreateTopic(ctx context.Context, req *data.CreateTopicRequest) (*data.CreateTopicResponse, error) {
+	b, err := s.broker()
+	if err != nil {
+		return nil, failure.Wrap(err, "s.broker failed")
+	}
+
+	if _, err = b.CreateTopic(req.Topic, req.Partitions); err != nil {
+		return nil, failure.Wrap(err, "b.CreateTopic failed")
+	}
+
+	return &data.CreateTopicResponse{}, nil
+}
+
+// DeleteTopic removes a topic and all of its records
+func (s *GRPCServer) DeleteTopic(ctx context.Context, req *data.DeleteTopicRequest) (*data.DeleteTopicResponse, error) {
+	b, err := s.broker()
+	if err != nil {
+		return nil, failure.Wrap(err, "s.broker failed")
+	}
+
+	if err = b.DeleteTopic(req.Topic); err != nil {
+		return nil, failure.Wrap(err, "b.DeleteTopic failed")
+	}
+
+	return &data.DeleteTopicResponse{}, nil
+}
+
+func (s *GRPCServer) ListTopics(ctx context.Context, req *data.ListTopicsRequest) (*data.ListTopicsResponse, error) {
+	b, err := s.broker()
+	if err != nil {
+		return nil, failure.Wrap(err, "s.broker failed")
+	}
+
+	var resp data.ListTopicsResponse
+	for _, name := range b.Topics() {
+		t, err := b.Topic(name)
+		if failure.IsNotFound(err) {
+			// it was deleted since it was listed
+			continue
+		}
+		if err != nil {
+			return nil, failure.Wrap(err, "b.Topic failed")
+		}
+		resp.Topics = append(resp.Topics, &data.Topic{Name: name, Partitions: t.Partitions()})
+	}
+
+	return &resp, nil
+}
+
+// JoinGroup adds a member to a consumer group of a topic, or of the log
+// without a topic, and returns the partitions it consumes. Every member
+// that joins or leaves rebalances the group, members find out about it
+// from the new generation their heartbeats return.
+func (s *GRPCServer) JoinGroup(ctx context.Context, req *data.JoinGroupRequest) (*data.JoinGroupResponse, error) {
+	groups, err := s.groups()
+	if err != nil {
+		return nil, failure.Wrap(err, "s.groups failed")
+	}
+
+	partitions, err := s.partitions(req.Topic)
+	if err != nil {
+		return nil, failure.Wrap(err, "s.partitions failed")
+	}
+
+	a, err := groups.Join(req.Group, req.Topic, partitions, req.MemberId, time.Now())
+	if err != nil {
+		return nil, failure.Wrap(err, "groups.Join failed")
+	}
+
+	return &data.JoinGroupResponse{Assignment: toAssignment(a)}, nil
+}
+
+func (s *GRPCServer) Heartbeat(ctx context.Context, req *data.HeartbeatRequest) (*data.HeartbeatResponse, error) {
+	groups, err := s.groups()
+	if err != nil {
+		return nil, failure.Wrap(err, "s.groups failed")
+	}
+
+	a, err := groups.Heartbeat(req.Group, req.MemberId, time.Now())
+	if err != nil {
+		return nil, failure.Wrap(err, "groups.Heartbeat failed")
+	}
+
+	return &data.HeartbeatResponse{Assignment: toAssignment(a)}, nil
+}
+
+func (s *GRPCServer) LeaveGroup(ctx context.Context, req *data.LeaveGroupRequest) (*data.LeaveGroupResponse, error) {
+	groups, err := s.groups()
+	if err != nil {
+		return nil, failure.Wrap(err, "s.groups failed")
+	}
+
+	if err = groups.Leave(req.Group, req.MemberId); err != nil {
+		return nil, failure.Wrap(err, "groups.Leave failed")
+	}
+
+	return &data.LeaveGroupResponse{}, nil
+}
+
+func (s *GRPCServer) CommitOffset(ctx context.Context, req *data.CommitOffsetRequest) (*data.CommitOffsetResponse, error) {
+	groups, err := s.groups()
+	if err != nil {
+		return nil, failure.Wrap(err, "s.groups failed")
+	}
+
+	// only partitions that exist get an offset
+	if _, err = s.consumerLog(req.Topic, req.Partition); err != nil {
+		return nil, failure.Wrap(err, "s.consumerLog failed")
+	}
+
+	err = groups.CommitOffset(req.Group, req.Topic, req.Partition, req.Offset, req.MemberId, req.Generation)
+	if err != nil {
+		return nil, failure.Wrap(err, "groups.CommitOffset failed")
+	}
+
+	return &data.CommitOffsetResponse{}, nil
+}
+
+func (s *GRPCServer) FetchOffset(ctx context.Context, req *data.FetchOffsetRequest) (*data.FetchOffsetResponse, error) {
+	groups, err := s.groups()
+	if err != nil {
+		return nil, failure.Wrap(err, "s.groups failed")
+	}
+
+	off, err := groups.FetchOffset(req.Group, req.Topic, req.Partition)
+	if err != nil {
+		return nil, failure.Wrap(err, "groups.FetchOffset failed")
+	}
+
+	return &data.FetchOffsetResponse{Offset: off}, nil
+}
+
 func (s *GRPCServer) Consume(ctx context.Context, req *data.ConsumeRequest) (*data.ConsumeResponse, error) {
+	cl, err := s.consumerLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, failure.Wrap(err, "s.consumerLog failed")
+	}
+
+	read := cl.Read
+	if req.Isolation == data.Isolation_READ_COMMITTED {
+		read = cl.ReadCommitted
+	}
 
-	rec, err := s.CommitLog.Read(req.Offset)
+	rec, err := read(req.Offset)
 	if err != nil {
-		return nil, failure.Wrap(err, "s.CommitLog.Read failed (%s)", req.Offset)
+		return nil, failure.Wrap(err, "read failed (%d)", req.Offset)
 	}
 
 	return &data.ConsumeResponse{Record: rec}, nil
@@ -82,25 +387,162 @@ func (s *GRPCServer) ConsumeStream(
 	req *data.ConsumeRequest,
 	stream data.Log_ConsumeStreamServer,
 ) error {
+	cl, err := s.consumerLog(req.Topic, req.Partition)
+	if err != nil {
+		return failure.Wrap(err, "s.consumerLog failed")
+	}
+
+	readNext := cl.ReadNext
+	if req.Isolation == data.Isolation_READ_COMMITTED {
+		readNext = cl.ReadNextCommitted
+	}
+
+	offset, err := s.startOffset(req)
+	if err != nil {
+		return failure.Wrap(err, "s.startOffset failed")
+	}
+
+	ctx := stream.Context()
 	for {
-		select {
-		case <-stream.Context().Done():
-			return nil
-		default:
-			result, err := s.Consume(stream.Context(), req)
-			switch {
-			case err == nil:
-			case failure.IsOutOfRange(err):
-				continue
-			default:
-				return err
+		rec, err := readNext(ctx, offset)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
 			}
+			return failure.Wrap(err, "readNext failed (%d)", offset)
+		}
 
-			if err = stream.Send(result); err != nil {
-				return err
-			}
+		if err = stream.Send(&data.ConsumeResponse{Record: rec}); err != nil {
+			return failure.Wrap(err, "stream.Send failed")
+		}
+
+		offset = rec.Offset + 1
+	}
+}
 
-			req.Offset++
+// startOffset returns where a consume stream starts, which is the offset
+// the request's group committed for the partition when it has one.
+func (s *GRPCServer) startOffset(req *data.ConsumeRequest) (uint64, error) {
+	if req.Group == "" {
+		return req.Offset, nil
+	}
+
+	groups, err := s.groups()
+	if err != nil {
+		return 0, failure.Wrap(err, "s.groups failed")
+	}
+
+	off, err := groups.FetchOffset(req.Group, req.Topic, req.Partition)
+	if failure.IsNotFound(err) {
+		return req.Offset, nil
+	}
+	if err != nil {
+		return 0, failure.Wrap(err, "groups.FetchOffset failed")
+	}
+
+	return off, nil
+}
+
+// producerLog returns the log record is appended to along with its
+// partition, which the topic's partitioner picks.
+func (s *GRPCServer) producerLog(topic string, record *data.Record) (CommitLog, uint32, error) {
+	if topic == "" {
+		cl, err := s.consumerLog(topic, 0)
+		return cl, 0, err
+	}
+
+	t, err := s.topic(topic)
+	if err != nil {
+		return nil, 0, failure.Wrap(err, "s.topic failed")
+	}
+
+	p := t.PartitionFor(record)
+	l, err := t.Partition(p)
+	if err != nil {
+		return nil, 0, failure.Wrap(err, "t.Partition failed")
+	}
+
+	return l, p, nil
+}
+
+// consumerLog returns the log a request for a partition of topic is served
+// from.
+func (s *GRPCServer) consumerLog(topic string, partition uint32) (CommitLog, error) {
+	if topic == "" {
+		if s.CommitLog == nil {
+			return nil, failure.InvalidParam("topic is required")
+		}
+		if partition != 0 {
+			return nil, failure.InvalidParam("partition (%d) requested without a topic", partition)
+		}
+		return s.CommitLog, nil
+	}
+
+	t, err := s.topic(topic)
+	if err != nil {
+		return nil, failure.Wrap(err, "s.topic failed")
+	}
+
+	l, err := t.Partition(partition)
+	if err != nil {
+		return nil, failure.Wrap(err, "t.Partition failed")
+	}
+
+	return l, nil
+}
+
+func (s *GRPCServer) topic(name string) (*broker.Topic, error) {
+	b, err := s.broker()
+	if err != nil {
+		return nil, failure.Wrap(err, "s.broker failed for topic (%s)", name)
+	}
+
+	t, err := b.Topic(name)
+	if err != nil {
+		return nil, failure.Wrap(err, "s.Broker.Topic failed")
+	}
+
+	return t, nil
+}
+
+// partitions returns the number of partitions of topic, the log without a
+// topic has one.
+func (s *GRPCServer) partitions(topic string) (uint32, error) {
+	if topic == "" {
+		if _, err := s.consumerLog(topic, 0); err != nil {
+			return 0, failure.Wrap(err, "s.consumerLog failed")
 		}
+		return 1, nil
+	}
+
+	t, err := s.topic(topic)
+	if err != nil {
+		return 0, failure.Wrap(err, "s.topic failed")
+	}
+
+	return t.Partitions(), nil
+}
+
+func (s *GRPCServer) broker() (*broker.Broker, error) {
+	if s.Broker == nil {
+		return nil, failure.Config("topics requested but the server has no broker")
+	}
+
+	return s.Broker, nil
+}
+
+func (s *GRPCServer) groups() (*group.Coordinator, error) {
+	if s.Groups == nil {
+		return nil, failure.Config("consumer groups requested but the server has no group coordinator")
+	}
+
+	return s.Groups, nil
+}
+
+func toAssignment(a group.Assignment) *data.Assignment {
+	return &data.Assignment{
+		MemberId:   a.MemberID,
+		Generation: a.Generation,
+		Partitions: a.Partitions,
 	}
 }
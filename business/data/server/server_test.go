@@ -0,0 +1,193 @@
+package server_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	data "github.com/rsb/prolog/app/api/handlers/v1"
+	"github.com/rsb/prolog/business/data/broker"
+	"github.com/rsb/prolog/business/data/log"
+	"github.com/rsb/prolog/business/data/memlog"
+	"github.com/rsb/prolog/business/data/server"
+)
+
+func TestServer_Topics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	b, err := broker.New(dir, log.Config{})
+	require.NoError(t, err)
+	defer func() { _ = b.Close() }()
+
+	client := setupTest(t, &server.Config{CommitLog: memlog.New(), Broker: b})
+	ctx := context.Background()
+
+	_, err = client.CreateTopic(ctx, &data.CreateTopicRequest{Topic: "orders", Partitions: 2})
+	require.NoError(t, err)
+
+	topics, err := client.ListTopics(ctx, &data.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Len(t, topics.Topics, 1)
+	require.Equal(t, "orders", topics.Topics[0].Name)
+	require.Equal(t, uint32(2), topics.Topics[0].Partitions)
+
+	want := &data.Record{Key: []byte("customer-1"), Value: []byte("hello world")}
+	produce, err := client.Produce(ctx, &data.ProduceRequest{Topic: "orders", Record: want})
+	require.NoError(t, err)
+
+	consume, err := client.Consume(ctx, &data.ConsumeRequest{
+		Topic:     "orders",
+		Partition: produce.Partition,
+		Offset:    produce.Offset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, want.Value, consume.Record.Value)
+	require.Equal(t, want.Key, consume.Record.Key)
+
+	// the record went to the topic, not to the commit log
+	_, err = client.Consume(ctx, &data.ConsumeRequest{Offset: produce.Offset})
+	require.Error(t, err)
+
+	_, err = client.DeleteTopic(ctx, &data.DeleteTopicRequest{Topic: "orders"})
+	require.NoError(t, err)
+
+	_, err = client.Produce(ctx, &data.ProduceRequest{Topic: "orders", Record: want})
+	require.Error(t, err)
+
+	topics, err = client.ListTopics(ctx, &data.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Empty(t, topics.Topics)
+}
+
+func TestServer_Producer(t *testing.T) {
+	cl := memlog.New()
+	client := setupTest(t, &server.Config{CommitLog: cl})
+	ctx := context.Background()
+
+	init, err := client.InitProducer(ctx, &data.InitProducerRequest{})
+	require.NoError(t, err)
+	require.NotZero(t, init.ProducerId)
+
+	produce := func(seq uint64) uint64 {
+		t.Helper()
+		resp, err := client.Produce(ctx, &data.ProduceRequest{
+			Record:     &data.Record{Value: []byte("hello world")},
+			ProducerId: init.ProducerId,
+			Sequence:   seq,
+		})
+		require.NoError(t, err)
+		return resp.Offset
+	}
+
+	require.Equal(t, uint64(0), produce(0))
+	require.Equal(t, uint64(1), produce(1))
+
+	// a retry gets back the offset of the first attempt
+	require.Equal(t, uint64(0), produce(0))
+	require.Equal(t, uint64(1), produce(1))
+
+	batch := func(first uint64, n int) (*data.ProduceBatchResponse, error) {
+		req := data.ProduceBatchRequest{ProducerId: init.ProducerId, FirstSequence: first}
+		for i := 0; i < n; i++ {
+			req.Records = append(req.Records, &data.Record{Value: []byte("hello world")})
+		}
+		return client.ProduceBatch(ctx, &req)
+	}
+
+	resp, err := batch(2, 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), resp.FirstOffset)
+	require.Equal(t, uint64(4), resp.LastOffset)
+
+	resp, err = batch(2, 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), resp.FirstOffset)
+	require.Equal(t, uint64(4), resp.LastOffset)
+
+	// a batch that is only partly a duplicate is refused
+	_, err = batch(4, 2)
+	require.Error(t, err)
+
+	highest, err := cl.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), highest)
+
+	// records without a producer id are never deduplicated
+	for want := uint64(5); want < 7; want++ {
+		resp, err := client.Produce(ctx, &data.ProduceRequest{Record: &data.Record{Value: []byte("hello world")}})
+		require.NoError(t, err)
+		require.Equal(t, want, resp.Offset)
+	}
+}
+
+func TestServer_NilRecord(t *testing.T) {
+	client := setupTest(t, &server.Config{CommitLog: memlog.New()})
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &data.ProduceRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err), err)
+
+	_, err = client.ProduceBatch(ctx, &data.ProduceBatchRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err), err)
+
+	// nil records of a batch never make it over the wire, they are sent as
+	// empty records
+	srv := &server.GRPCServer{Config: &server.Config{CommitLog: memlog.New()}}
+	_, err = srv.ProduceBatch(ctx, &data.ProduceBatchRequest{
+		Records: []*data.Record{{Value: []byte("hello world")}, nil},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err), err)
+
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&data.ProduceRequest{}))
+	_, err = stream.Recv()
+	require.Equal(t, codes.InvalidArgument, status.Code(err), err)
+}
+
+func TestServer_NoBroker(t *testing.T) {
+	client := setupTest(t, &server.Config{CommitLog: memlog.New()})
+	ctx := context.Background()
+
+	_, err := client.CreateTopic(ctx, &data.CreateTopicRequest{Topic: "orders", Partitions: 1})
+	require.Error(t, err)
+
+	_, err = client.Produce(ctx, &data.ProduceRequest{
+		Topic:  "orders",
+		Record: &data.Record{Value: []byte("hello world")},
+	})
+	require.Error(t, err)
+}
+
+// setupTest serves config on a local port and returns a client for it, both
+// are stopped when the test ends.
+func setupTest(t *testing.T, config *server.Config) data.LogClient {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	gsrv, err := server.NewGRPCServer(config)
+	require.NoError(t, err)
+	go func() { _ = gsrv.Serve(l) }()
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		_ = conn.Close()
+		gsrv.Stop()
+	})
+
+	return data.NewLogClient(conn)
+}
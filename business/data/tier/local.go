@@ -0,0 +1,124 @@
+// Package tier holds the blob stores sealed log segments can be offloaded
+// to. Local keeps blobs in a directory, which is mostly useful for tests and
+// shared file systems, and S3 keeps them in an S3 compatible bucket.
+package tier
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/rsb/failure"
+
+	"github.com/rsb/prolog/business/data/log"
+)
+
+var _ log.BlobStore = (*Local)(nil)
+
+// Local is a blob store backed by a directory on the local file system
+type Local struct {
+	Dir string
+}
+
+// NewLocal creates dir when it does not exist and returns a blob store
+// that keeps its blobs in it.
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, failure.ToSystem(err, "os.MkdirAll failed for (%s)", dir)
+	}
+
+	return &Local{Dir: dir}, nil
+}
+
+// Put writes the blob to a temporary file first and renames it into place so
+// a blob is never seen half written.
+func (l *Local) Put(name string, r io.ReadSeeker) error {
+	if err := validName(name); err != nil {
+		return failure.Wrap(err, "validName failed")
+	}
+
+	f, err := ioutil.TempFile(l.Dir, ".upload-")
+	if err != nil {
+		return failure.ToSystem(err, "ioutil.TempFile failed")
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	if _, err = io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return failure.ToSystem(err, "io.Copy failed for (%s)", name)
+	}
+
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return failure.ToSystem(err, "f.Sync failed for (%s)", name)
+	}
+
+	if err = f.Close(); err != nil {
+		return failure.ToSystem(err, "f.Close failed for (%s)", name)
+	}
+
+	if err = os.Rename(f.Name(), path.Join(l.Dir, name)); err != nil {
+		return failure.ToSystem(err, "os.Rename failed for (%s)", name)
+	}
+
+	return nil
+}
+
+func (l *Local) Get(name string) (io.ReadCloser, error) {
+	if err := validName(name); err != nil {
+		return nil, failure.Wrap(err, "validName failed")
+	}
+
+	f, err := os.Open(path.Join(l.Dir, name))
+	if os.IsNotExist(err) {
+		return nil, failure.NotFound("blob (%s) does not exist", name)
+	}
+	if err != nil {
+		return nil, failure.ToSystem(err, "os.Open failed for (%s)", name)
+	}
+
+	return f, nil
+}
+
+func (l *Local) Delete(name string) error {
+	if err := validName(name); err != nil {
+		return failure.Wrap(err, "validName failed")
+	}
+
+	err := os.Remove(path.Join(l.Dir, name))
+	if err != nil && !os.IsNotExist(err) {
+		return failure.ToSystem(err, "os.Remove failed for (%s)", name)
+	}
+
+	return nil
+}
+
+func (l *Local) List() ([]string, error) {
+	files, err := ioutil.ReadDir(l.Dir)
+	if err != nil {
+		return nil, failure.ToSystem(err, "ioutil.ReadDir failed for (%s)", l.Dir)
+	}
+
+	var names []string
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		names = append(names, file.Name())
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// validName keeps blob names inside the store's directory
+func validName(name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return failure.InvalidParam("invalid blob name (%s)", name)
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package tier
+
+import (
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/rsb/failure"
+
+	"github.com/rsb/prolog/business/data/log"
+)
+
+var _ log.BlobStore = (*S3)(nil)
+
+// S3 is a blob store backed by a bucket in S3 or any service that speaks
+// its API. Every blob is stored under Prefix so several logs can share one
+// bucket.
+type S3 struct {
+	API    s3iface.S3API
+	Bucket string
+	Prefix string
+}
+
+// NewS3 returns a blob store keeping its blobs in bucket under prefix
+func NewS3(api s3iface.S3API, bucket, prefix string) (*S3, error) {
+	if api == nil {
+		return nil, failure.InvalidParam("[api] s3iface.S3API is nil")
+	}
+
+	if bucket == "" {
+		return nil, failure.InvalidParam("bucket is empty")
+	}
+
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	return &S3{API: api, Bucket: bucket, Prefix: prefix}, nil
+}
+
+func (s *S3) Put(name string, r io.ReadSeeker) error {
+	in := s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.Prefix + name),
+		Body:   r,
+	}
+
+	if _, err := s.API.PutObject(&in); err != nil {
+		return failure.ToSystem(err, "s.API.PutObject failed for (%s)", name)
+	}
+
+	return nil
+}
+
+func (s *S3) Get(name string) (io.ReadCloser, error) {
+	in := s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.Prefix + name),
+	}
+
+	out, err := s.API.GetObject(&in)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, failure.NotFound("blob (%s) does not exist", name)
+		}
+		return nil, failure.ToSystem(err, "s.API.GetObject failed for (%s)", name)
+	}
+
+	return out.Body, nil
+}
+
+func (s *S3) Delete(name string) error {
+	in := s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.Prefix + name),
+	}
+
+	if _, err := s.API.DeleteObject(&in); err != nil {
+		return failure.ToSystem(err, "s.API.DeleteObject failed for (%s)", name)
+	}
+
+	return nil
+}
+
+func (s *S3) List() ([]string, error) {
+	in := s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(s.Prefix),
+	}
+
+	var names []string
+	err := s.API.ListObjectsV2Pages(&in, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(aws.StringValue(obj.Key), s.Prefix)
+			if name != "" && !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, failure.ToSystem(err, "s.API.ListObjectsV2Pages failed")
+	}
+
+	return names, nil
+}
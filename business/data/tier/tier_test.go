@@ -0,0 +1,111 @@
+package tier_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/rsb/failure"
+	"github.com/rsb/prolog/business/data/log"
+	"github.com/rsb/prolog/business/data/tier"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-local-test")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	blobs, err := tier.NewLocal(dir)
+	require.NoError(t, err)
+	testBlobStore(t, blobs)
+
+	require.True(t, failure.IsInvalidParam(blobs.Put("../escape", strings.NewReader(""))))
+}
+
+func TestS3(t *testing.T) {
+	_, err := tier.NewS3(nil, "bucket", "")
+	require.True(t, failure.IsInvalidParam(err))
+
+	api := &fakeS3{objects: map[string][]byte{"other/0-1.store": nil}}
+	blobs, err := tier.NewS3(api, "bucket", "logs")
+	require.NoError(t, err)
+	testBlobStore(t, blobs)
+	require.Contains(t, api.objects, "logs/1-2.store")
+}
+
+func testBlobStore(t *testing.T, blobs log.BlobStore) {
+	t.Helper()
+
+	names, err := blobs.List()
+	require.NoError(t, err)
+	require.Empty(t, names)
+
+	require.NoError(t, blobs.Put("1-2.store", strings.NewReader("segment one")))
+	require.NoError(t, blobs.Put("0-1.store", strings.NewReader("segment zero")))
+
+	names, err = blobs.List()
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"0-1.store", "1-2.store"}, names)
+
+	body, err := blobs.Get("1-2.store")
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(body)
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	require.Equal(t, "segment one", string(b))
+
+	require.NoError(t, blobs.Delete("0-1.store"))
+	_, err = blobs.Get("0-1.store")
+	require.True(t, failure.IsNotFound(err))
+
+	names, err = blobs.List()
+	require.NoError(t, err)
+	require.Equal(t, []string{"1-2.store"}, names)
+}
+
+// fakeS3 keeps objects of a single bucket in memory
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+}
+
+func (f *fakeS3) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	b, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[aws.StringValue(in.Key)] = b
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	b, ok := f.objects[aws.StringValue(in.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "not found", nil)
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(b))}, nil
+}
+
+func (f *fakeS3) DeleteObject(in *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	delete(f.objects, aws.StringValue(in.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3) ListObjectsV2Pages(in *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	var page s3.ListObjectsV2Output
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.StringValue(in.Prefix)) {
+			page.Contents = append(page.Contents, &s3.Object{Key: aws.String(key)})
+		}
+	}
+	fn(&page, true)
+	return nil
+}
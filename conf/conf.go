@@ -16,6 +16,10 @@ import (
 type PrologAPI struct {
 	Version
 	API
+	CommitLog
+	LogSettings
+	Topics
+	Groups
 	Kubernetes
 }
 
@@ -27,6 +31,7 @@ type Version struct {
 type API struct {
 	Host            string        `conf:"env:PROLOG_API_HOST, cli:api-host, default:0.0.0.0:3000, cli-u:web api host"`
 	DebugHost       string        `conf:"env:PROLOG_API_DEBUG_HOST, cli:debug-host, default:0.0.0.0:4000, cli-u:debug host"`
+	GRPCHost        string        `conf:"env:PROLOG_API_GRPC_HOST, cli:api-grpc-host, default:0.0.0.0:5000, cli-u:grpc api host"`
 	IsCaseSensitive bool          `conf:"env:PROLOG_API_ROUTE_CASE_SENSITIVE, cli:api-route-case-sensitive, default:false, cli-u:will routes be case sensitive"`
 	IsETag          bool          `conf:"env:PROLOG_API_ETAG, cli:api-etag, default:false, cli-u:enable/disable etag header generation"`
 	ReadTimeout     time.Duration `conf:"env:PROLOG_API_READ_TIMEOUT,cli:api-read-timeout, default:5s"`
@@ -35,6 +40,23 @@ type API struct {
 	ShutdownTimeout time.Duration `conf:"env:PROLOG_API_SHUTDOWN_TIMEOUT,cli:api-shutdown-timeout, default:20s"`
 }
 
+// CommitLog selects the log the http and grpc transports share
+type CommitLog struct {
+	Dir string `conf:"env:PROLOG_API_LOG_DIR, cli:api-log-dir, cli-u:directory of the commit log (kept in memory when empty)"`
+}
+
+// Topics configures the broker holding the named topics of the api
+type Topics struct {
+	Dir string `conf:"env:PROLOG_API_TOPICS_DIR, cli:api-topics-dir, cli-u:directory of the topics (.topics inside the commit log directory when empty)"`
+}
+
+// Groups configures the consumer groups of the api and the internal log
+// their committed offsets are stored in
+type Groups struct {
+	Dir            string        `conf:"env:PROLOG_API_GROUP_DIR, cli:api-group-dir, cli-u:directory of the committed offsets log (.groups inside the commit log directory when empty)"`
+	SessionTimeout time.Duration `conf:"env:PROLOG_API_GROUP_SESSION_TIMEOUT, cli:api-group-session-timeout, default:10s, cli-u:how long a group member may go without a heartbeat"`
+}
+
 func (a API) NewFiberConfig() fiber.Config {
 	config := fiber.Config{
 		IdleTimeout:   a.IdleTimeout,
@@ -47,6 +69,74 @@ func (a API) NewFiberConfig() fiber.Config {
 	return config
 }
 
+// PrologLog is the configuration used by the commands that manage a log
+// directory offline, without starting a server.
+type PrologLog struct {
+	Storage
+	Force bool `conf:"env:PROLOG_LOG_FORCE, cli:force, global-flag, default:false, cli-u:let migrate drop the bytes of a segment it can not read"`
+}
+
+// Storage describes where the commit log lives on disk and how it is stored
+type Storage struct {
+	Dir string `conf:"env:PROLOG_STORAGE_DIR, cli:storage-dir, global-flag, default:/tmp/prolog, cli-u:directory holding the commit log"`
+	LogSettings
+}
+
+// LogSettings controls how the segments of a commit log are sized, retained,
+// compacted, synced and encrypted. The log commands and the api share them.
+type LogSettings struct {
+	MaxStoreBytes      uint64        `conf:"env:PROLOG_STORAGE_MAX_STORE_BYTES, cli:storage-max-store-bytes, global-flag, default:1048576, cli-u:max bytes of a segment store"`
+	MaxIndexBytes      uint64        `conf:"env:PROLOG_STORAGE_MAX_INDEX_BYTES, cli:storage-max-index-bytes, global-flag, default:1048576, cli-u:max bytes of a segment index"`
+	IndexIntervalBytes uint64        `conf:"env:PROLOG_STORAGE_INDEX_INTERVAL_BYTES, cli:storage-index-interval-bytes, global-flag, default:0, cli-u:store bytes between index entries (0 indexes every record)"`
+	MaxSegmentAge      time.Duration `conf:"env:PROLOG_STORAGE_MAX_SEGMENT_AGE, cli:storage-max-segment-age, global-flag, default:0s, cli-u:age after which the active segment is sealed (0 only rolls on size)"`
+	Retention
+	Compaction
+	Durability
+	Encryption
+	Tier
+}
+
+// Retention controls when sealed segments are deleted from disk
+type Retention struct {
+	MaxAge        time.Duration `conf:"env:PROLOG_RETENTION_MAX_AGE, cli:retention-max-age, global-flag, default:0s, cli-u:age after which sealed segments are deleted (0 keeps them forever)"`
+	MaxLogBytes   uint64        `conf:"env:PROLOG_RETENTION_MAX_LOG_BYTES, cli:retention-max-log-bytes, global-flag, default:0, cli-u:max bytes of the whole log before sealed segments are deleted (0 is unbounded)"`
+	CheckInterval time.Duration `conf:"env:PROLOG_RETENTION_CHECK_INTERVAL, cli:retention-check-interval, global-flag, default:1m, cli-u:how often the retention policy is enforced"`
+}
+
+// Compaction controls the background compaction of keyed records
+type Compaction struct {
+	Enabled         bool          `conf:"env:PROLOG_COMPACTION_ENABLED, cli:compaction-enabled, global-flag, default:false, cli-u:keep only the newest record for each key in sealed segments"`
+	DeleteRetention time.Duration `conf:"env:PROLOG_COMPACTION_DELETE_RETENTION, cli:compaction-delete-retention, global-flag, default:24h, cli-u:how long tombstones survive compaction"`
+	Interval        time.Duration `conf:"env:PROLOG_COMPACTION_INTERVAL, cli:compaction-interval, global-flag, default:10m, cli-u:how often sealed segments are compacted"`
+}
+
+// Durability controls when appended records are synced to disk
+type Durability struct {
+	Mode     string        `conf:"env:PROLOG_DURABILITY_MODE, cli:durability-mode, global-flag, default:os, cli-u:when records are synced to disk (always|records|interval|os)"`
+	Records  uint64        `conf:"env:PROLOG_DURABILITY_RECORDS, cli:durability-records, global-flag, default:1000, cli-u:records appended between syncs in the records mode"`
+	Interval time.Duration `conf:"env:PROLOG_DURABILITY_INTERVAL, cli:durability-interval, global-flag, default:1s, cli-u:how often the log is synced in the interval mode"`
+}
+
+// Encryption controls the encryption of segment stores at rest
+type Encryption struct {
+	KeyID   string `conf:"env:PROLOG_ENCRYPTION_KEY_ID, cli:encryption-key-id, global-flag, cli-u:id of the key new segments are encrypted with (empty writes plain text)"`
+	KeyFile string `conf:"env:PROLOG_ENCRYPTION_KEY_FILE, cli:encryption-key-file, global-flag, cli-u:json file mapping key ids to base64 encoded AES keys"`
+	Key     string `conf:"env:PROLOG_ENCRYPTION_KEY"`
+}
+
+// Tier controls the offloading of sealed segments to a remote blob store
+type Tier struct {
+	Store         string        `conf:"env:PROLOG_TIER_STORE, cli:tier-store, global-flag, cli-u:blob store sealed segments are offloaded to (local|s3, empty keeps every segment on local disk)"`
+	Dir           string        `conf:"env:PROLOG_TIER_DIR, cli:tier-dir, global-flag, cli-u:directory of the local blob store"`
+	Bucket        string        `conf:"env:PROLOG_TIER_BUCKET, cli:tier-bucket, global-flag, cli-u:bucket of the s3 blob store"`
+	Prefix        string        `conf:"env:PROLOG_TIER_PREFIX, cli:tier-prefix, global-flag, cli-u:prefix of every blob in the s3 bucket"`
+	Region        string        `conf:"env:PROLOG_TIER_REGION, cli:tier-region, global-flag, cli-u:region of the s3 bucket"`
+	Endpoint      string        `conf:"env:PROLOG_TIER_ENDPOINT, cli:tier-endpoint, global-flag, cli-u:endpoint of an s3 compatible service (empty uses aws)"`
+	KeepLocal     int           `conf:"env:PROLOG_TIER_KEEP_LOCAL, cli:tier-keep-local, global-flag, default:0, cli-u:newest sealed segments kept on local disk once uploaded"`
+	CacheSegments int           `conf:"env:PROLOG_TIER_CACHE_SEGMENTS, cli:tier-cache-segments, global-flag, default:2, cli-u:remote segments cached on local disk for reads"`
+	Interval      time.Duration `conf:"env:PROLOG_TIER_INTERVAL, cli:tier-interval, global-flag, default:1m, cli-u:how often sealed segments are offloaded"`
+}
+
 type HTTPClient struct {
 	Timeout            time.Duration `conf:"default: 5s,  env:LOLA_HTTP_CLIENT_TIMEOUT, cli:http-client-timeout, cli-u:timeout for http clients"`
 	MaxIdleConn        int           `conf:"default: 100, env:LOLA_HTTP_CLIENT_MAX_IDLE_CONN, cli:http-client-max-idle-con, cli-u:http client max idle connections"`
@@ -0,0 +1,226 @@
+package construct
+
+import (
+	"encoding/base64"
+	"os"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/rsb/failure"
+	"github.com/rsb/prolog/business/data/broker"
+	"github.com/rsb/prolog/business/data/group"
+	"github.com/rsb/prolog/business/data/log"
+	"github.com/rsb/prolog/business/data/memlog"
+	"github.com/rsb/prolog/business/data/server"
+	"github.com/rsb/prolog/business/data/tier"
+	"github.com/rsb/prolog/conf"
+	"go.uber.org/zap"
+)
+
+// NewCommitLog opens the log the api serves over both transports with the
+// storage settings in s. It lives in memory when no directory is configured.
+func NewCommitLog(c conf.CommitLog, s conf.LogSettings, logger *zap.SugaredLogger) (server.CommitLog, error) {
+	if c.Dir == "" {
+		return memlog.New(), nil
+	}
+
+	lc, err := NewLogConfig(s)
+	if err != nil {
+		return nil, failure.Wrap(err, "NewLogConfig failed")
+	}
+	lc.Logger = logger
+
+	l, err := log.NewLog(c.Dir, lc)
+	if err != nil {
+		return nil, failure.Wrap(err, "log.NewLog failed (%s)", c.Dir)
+	}
+
+	return l, nil
+}
+
+// TopicsDir is the subdirectory of the commit log directory the topics are
+// kept in when no directory is configured for them
+const TopicsDir = ".topics"
+
+// NewBroker opens the broker of the api's topics. Every partition is opened
+// with the storage settings in s, except for the remote tier since the
+// partitions would overwrite each other's blobs in one store. Topics need a
+// directory, when neither one is configured for them nor for the commit log
+// there is no broker and nil is returned.
+func NewBroker(c conf.Topics, cl conf.CommitLog, s conf.LogSettings, logger *zap.SugaredLogger) (*broker.Broker, error) {
+	dir, err := serviceDir(c.Dir, cl, TopicsDir)
+	if err != nil {
+		return nil, failure.Wrap(err, "serviceDir failed for topics")
+	}
+
+	if dir == "" {
+		return nil, nil
+	}
+
+	lc, err := NewLogConfig(s)
+	if err != nil {
+		return nil, failure.Wrap(err, "NewLogConfig failed")
+	}
+	lc.Logger = logger
+	lc.Tier.Blobs = nil
+
+	b, err := broker.New(dir, lc)
+	if err != nil {
+		return nil, failure.Wrap(err, "broker.New failed (%s)", dir)
+	}
+
+	return b, nil
+}
+
+// serviceDir returns the directory data the api keeps next to its commit log
+// is stored in. It defaults to the subdirectory name of the commit log's
+// directory, and is empty when the commit log is kept in memory. The commit
+// log's directory itself is refused, the data would mix with its segments.
+func serviceDir(dir string, cl conf.CommitLog, name string) (string, error) {
+	if dir == "" {
+		if cl.Dir == "" {
+			return "", nil
+		}
+		return path.Join(cl.Dir, name), nil
+	}
+
+	if cl.Dir != "" && path.Clean(dir) == path.Clean(cl.Dir) {
+		return "", failure.Config("directory (%s) is the commit log's, it needs its own", dir)
+	}
+
+	return dir, nil
+}
+
+// GroupsDir is the subdirectory of the commit log directory the committed
+// offsets are kept in when no directory is configured for them
+const GroupsDir = ".groups"
+
+// NewGroups opens the coordinator of the api's consumer groups along with
+// the log their offsets are committed to. The log is compacted since only
+// the last commit of every group and partition matters. It lives next to
+// the commit log unless it gets a directory of its own, and in memory when
+// neither has one.
+func NewGroups(c conf.Groups, cl conf.CommitLog, logger *zap.SugaredLogger) (*group.Coordinator, error) {
+	dir, err := serviceDir(c.Dir, cl, GroupsDir)
+	if err != nil {
+		return nil, failure.Wrap(err, "serviceDir failed for groups")
+	}
+
+	var l group.OffsetLog = memlog.New()
+	if dir != "" {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return nil, failure.ToSystem(err, "os.MkdirAll failed for (%s)", dir)
+		}
+
+		var lc log.Config
+		lc.Compaction.Enabled = true
+		lc.Logger = logger
+		dl, err := log.NewLog(dir, lc)
+		if err != nil {
+			return nil, failure.Wrap(err, "log.NewLog failed (%s)", dir)
+		}
+		l = dl
+	}
+
+	co, err := group.New(l, group.Config{SessionTimeout: c.SessionTimeout, Logger: logger})
+	if err != nil {
+		_ = l.Close()
+		return nil, failure.Wrap(err, "group.New failed")
+	}
+
+	return co, nil
+}
+
+// NewLogConfig maps the storage settings onto the commit log config,
+// loading the encryption keys they refer to
+func NewLogConfig(c conf.LogSettings) (log.Config, error) {
+	var lc log.Config
+	lc.Segment.MaxStoreBytes = c.MaxStoreBytes
+	lc.Segment.MaxIndexBytes = c.MaxIndexBytes
+	lc.Segment.MaxAge = c.MaxSegmentAge
+	lc.Segment.IndexIntervalBytes = c.IndexIntervalBytes
+	lc.Retention.MaxAge = c.Retention.MaxAge
+	lc.Retention.MaxLogBytes = c.Retention.MaxLogBytes
+	lc.Retention.CheckInterval = c.Retention.CheckInterval
+	lc.Compaction.Enabled = c.Compaction.Enabled
+	lc.Compaction.DeleteRetention = c.Compaction.DeleteRetention
+	lc.Compaction.Interval = c.Compaction.Interval
+	lc.Durability.Mode = log.DurabilityMode(c.Durability.Mode)
+	lc.Durability.Records = c.Durability.Records
+	lc.Durability.Interval = c.Durability.Interval
+	lc.Encryption.KeyID = c.Encryption.KeyID
+	lc.Encryption.Keys = map[string][]byte{}
+
+	if c.Encryption.KeyFile != "" {
+		keys, err := log.LoadKeyFile(c.Encryption.KeyFile)
+		if err != nil {
+			return lc, failure.Wrap(err, "log.LoadKeyFile failed")
+		}
+		lc.Encryption.Keys = keys
+	}
+
+	if c.Encryption.Key != "" {
+		key, err := base64.StdEncoding.DecodeString(c.Encryption.Key)
+		if err != nil {
+			return lc, failure.ToConfig(err, "encryption key is not base64")
+		}
+		lc.Encryption.Keys[c.Encryption.KeyID] = key
+	}
+
+	blobs, err := NewBlobStore(c.Tier)
+	if err != nil {
+		return lc, failure.Wrap(err, "NewBlobStore failed")
+	}
+	lc.Tier.Blobs = blobs
+	lc.Tier.KeepLocal = c.Tier.KeepLocal
+	lc.Tier.CacheSegments = c.Tier.CacheSegments
+	lc.Tier.Interval = c.Tier.Interval
+
+	return lc, nil
+}
+
+// NewBlobStore returns the remote tier sealed segments are offloaded to. It
+// returns nil when no store is configured, which keeps every segment on
+// local disk.
+func NewBlobStore(c conf.Tier) (log.BlobStore, error) {
+	switch c.Store {
+	case "":
+		return nil, nil
+	case "local":
+		if c.Dir == "" {
+			return nil, failure.Config("the local blob store needs a directory")
+		}
+
+		l, err := tier.NewLocal(c.Dir)
+		if err != nil {
+			return nil, failure.Wrap(err, "tier.NewLocal failed")
+		}
+
+		return l, nil
+	case "s3":
+		ac := aws.NewConfig()
+		if c.Region != "" {
+			ac = ac.WithRegion(c.Region)
+		}
+		if c.Endpoint != "" {
+			// s3 compatible services rarely support virtual hosted buckets
+			ac = ac.WithEndpoint(c.Endpoint).WithS3ForcePathStyle(true)
+		}
+
+		sess, err := session.NewSession(ac)
+		if err != nil {
+			return nil, failure.ToConfig(err, "session.NewSession failed")
+		}
+
+		s, err := tier.NewS3(s3.New(sess), c.Bucket, c.Prefix)
+		if err != nil {
+			return nil, failure.Wrap(err, "tier.NewS3 failed")
+		}
+
+		return s, nil
+	default:
+		return nil, failure.Config("unknown blob store (%s), expected local or s3", c.Store)
+	}
+}
@@ -7,13 +7,12 @@ import (
 	"github.com/rsb/prolog/app/api/handlers/consume"
 	"github.com/rsb/prolog/app/api/handlers/health"
 	"github.com/rsb/prolog/app/api/handlers/produce"
-	"github.com/rsb/prolog/business"
+	"github.com/rsb/prolog/business/data/server"
 )
 
-func AddAllRoutes(r *fiber.App, d *app.Dependencies) (*fiber.App, error) {
+func AddAllRoutes(r *fiber.App, d *app.Dependencies, l server.CommitLog) (*fiber.App, error) {
 	r = AddHealthCheckRoutes(r, d)
 
-	l := business.NewLog()
 	producer, err := produce.NewHandler(l)
 	if err != nil {
 		return nil, failure.Wrap(err, "produce.NewHandler failed")
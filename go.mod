@@ -3,6 +3,7 @@ module github.com/rsb/prolog
 go 1.19
 
 require (
+	github.com/aws/aws-sdk-go v1.44.4
 	github.com/gofiber/contrib/fiberzap v0.0.0-20220518072952-1a3033b30569
 	github.com/gofiber/fiber/v2 v2.33.0
 	github.com/joho/godotenv v1.4.0
@@ -22,7 +23,6 @@ require (
 
 require (
 	github.com/andybalholm/brotli v1.0.4 // indirect
-	github.com/aws/aws-sdk-go v1.44.4 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/fsnotify/fsnotify v1.5.1 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect